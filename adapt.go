@@ -22,3 +22,44 @@ func Script4HB(s language.Script) hblang.Script {
 	h := binary.BigEndian.Uint32(b)
 	return hblang.Script(h)
 }
+
+// ScriptFromHB returns a HarfBuzz script as a script of package x/text/language.
+func ScriptFromHB(s hblang.Script) (language.Script, error) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(s))
+	b[0] = byte(unicode.ToUpper(rune(b[0])))
+	return language.ParseScript(string(b))
+}
+
+// --- Segment properties ----------------------------------------------------
+
+// DetectScript returns the script of the first character of text which is
+// neither of common nor inherited script, or 0 if there is none.
+func DetectScript(text []rune) hblang.Script {
+	for _, r := range text {
+		if s := hblang.LookupScript(r); s.IsRealScript() {
+			return s
+		}
+	}
+	return 0
+}
+
+// HasRightToLeft returns true if text contains a character of a script written
+// from right to left.
+func HasRightToLeft(text []rune) bool {
+	for _, r := range text {
+		if IsRightToLeft(hblang.LookupScript(r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRightToLeft returns true for scripts written from right to left.
+func IsRightToLeft(s hblang.Script) bool {
+	switch s {
+	case hblang.Arabic, hblang.Hebrew, hblang.Syriac, hblang.Thaana, hblang.Nko:
+		return true
+	}
+	return false
+}
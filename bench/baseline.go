@@ -0,0 +1,306 @@
+package bench
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// --- Environment -----------------------------------------------------------
+
+// Environment describes the circumstances of a benchmark run.
+type Environment struct {
+	GoVersion         string `json:"go"`
+	TextlayoutVersion string `json:"textlayout"`
+	HarfbuzzVersion   string `json:"harfbuzz,omitempty"` // empty if the C backend is not registered
+	OS                string `json:"os"`
+	Arch              string `json:"arch"`
+	CPU               string `json:"cpu"`
+	NumCPU            int    `json:"num_cpu"`
+}
+
+const textlayoutModule = "github.com/benoitkugler/textlayout"
+
+// CurrentEnvironment returns the environment of the running process. The
+// Harfbuzz version is reported by the backend registered as "c", if it has a
+// method
+//
+//	Version() string
+func CurrentEnvironment() Environment {
+	env := Environment{
+		GoVersion:         runtime.Version(),
+		TextlayoutVersion: "unknown",
+		OS:                runtime.GOOS,
+		Arch:              runtime.GOARCH,
+		CPU:               cpuModel(),
+		NumCPU:            runtime.NumCPU(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == textlayoutModule {
+				env.TextlayoutVersion = dep.Version
+				if dep.Replace != nil {
+					env.TextlayoutVersion += " => " + dep.Replace.Path + " " + dep.Replace.Version
+				}
+			}
+		}
+	}
+	if b, err := lookupBackend("c"); err == nil {
+		if v, ok := b.(interface{ Version() string }); ok {
+			env.HarfbuzzVersion = v.Version()
+		}
+	}
+	return env
+}
+
+// cpuModel returns the CPU model name, if available, or the architecture.
+func cpuModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return runtime.GOARCH
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key, value, ok := cut(scanner.Text(), ":"); ok && strings.TrimSpace(key) == "model name" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return runtime.GOARCH
+}
+
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// Diff lists the differences between two environments, as "field: a → b".
+func (env Environment) Diff(other Environment) []string {
+	var diffs []string
+	diff := func(field, a, b string) {
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("%s: %s → %s", field, a, b))
+		}
+	}
+	diff("go", env.GoVersion, other.GoVersion)
+	diff("textlayout", env.TextlayoutVersion, other.TextlayoutVersion)
+	diff("harfbuzz", env.HarfbuzzVersion, other.HarfbuzzVersion)
+	diff("os", env.OS, other.OS)
+	diff("arch", env.Arch, other.Arch)
+	diff("cpu", env.CPU, other.CPU)
+	diff("num_cpu", fmt.Sprint(env.NumCPU), fmt.Sprint(other.NumCPU))
+	return diffs
+}
+
+// --- Baselines -------------------------------------------------------------
+
+// BaselineFormat is the version of the baseline file format.
+const BaselineFormat = 1
+
+// Baseline is a set of results, together with the environment and options
+// they have been measured with.
+type Baseline struct {
+	Format      int         `json:"format"`
+	Created     time.Time   `json:"created"`
+	Environment Environment `json:"environment"`
+	Options     Options     `json:"options"`
+	Results     []Result    `json:"results"`
+}
+
+// NewBaseline creates a baseline from results measured in the current
+// environment.
+func NewBaseline(results []Result, opts Options) Baseline {
+	return Baseline{
+		Format:      BaselineFormat,
+		Created:     time.Now().UTC().Truncate(time.Second),
+		Environment: CurrentEnvironment(),
+		Options:     opts,
+		Results:     results,
+	}
+}
+
+// Scenarios returns the scenarios of the baseline's results.
+func (b Baseline) Scenarios() []Scenario {
+	scenarios := make([]Scenario, len(b.Results))
+	for i, r := range b.Results {
+		scenarios[i] = r.Scenario
+	}
+	return scenarios
+}
+
+// WriteBaseline writes a baseline as JSON.
+func WriteBaseline(w io.Writer, b Baseline) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(b)
+}
+
+// ReadBaseline reads a baseline written by WriteBaseline.
+func ReadBaseline(r io.Reader) (Baseline, error) {
+	var b Baseline
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return b, err
+	}
+	if b.Format < 1 || b.Format > BaselineFormat {
+		return b, fmt.Errorf("unsupported baseline format %d", b.Format)
+	}
+	return b, nil
+}
+
+// --- Regression gating -----------------------------------------------------
+
+// Thresholds are the relative slowdowns of ns/op tolerated before a scenario
+// counts as regressed, e.g. 0.05 for 5%.
+type Thresholds struct {
+	Default   float64            `json:"default"`
+	Scenarios map[string]float64 `json:"scenarios"` // by pattern for scenario names
+}
+
+// For returns the threshold for a scenario: the one of the longest pattern
+// matching the scenario's name, or the default. Patterns are matched with
+// path.Match against the name and its prefixes ending before a '/', i.e.
+// "go/*" matches all scenarios of the Go backend.
+func (t Thresholds) For(s Scenario) float64 {
+	threshold, longest := t.Default, -1
+	name := s.Name()
+	for pattern, th := range t.Scenarios {
+		if matchPrefix(pattern, name) && len(pattern) > longest {
+			threshold, longest = th, len(pattern)
+		}
+	}
+	return threshold
+}
+
+func matchPrefix(pattern, name string) bool {
+	for {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		i := strings.LastIndexByte(name, '/')
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+	}
+}
+
+// Verdict is the outcome of comparing a scenario to its baseline.
+type Verdict string
+
+// Verdicts for scenarios.
+const (
+	Unchanged   Verdict = "unchanged"
+	Regression  Verdict = "regression"
+	Improvement Verdict = "improvement"
+	New         Verdict = "new"     // not in the baseline
+	Missing     Verdict = "missing" // in the baseline only
+)
+
+// Delta is the change of a scenario relative to its baseline.
+type Delta struct {
+	Scenario
+	Base      Summary `json:"base"`    // ns/op of the baseline
+	Current   Summary `json:"current"` // ns/op of the current results
+	Change    float64 `json:"change"`  // relative change of the median
+	P         float64 `json:"p"`
+	Threshold float64 `json:"threshold"`
+	Verdict   Verdict `json:"verdict"`
+}
+
+// CompareBaseline compares current results to a baseline. A scenario has
+// regressed (improved) if its median ns/op increased (decreased) by more than
+// its threshold, and the change is significant at level alpha according to a
+// Mann-Whitney U test. Note that this requires at least 4 samples per scenario
+// on both sides for alpha = 0.05.
+func CompareBaseline(base Baseline, current []Result, th Thresholds, alpha float64) []Delta {
+	current = MergeResults(current)
+	baseResults := make(map[Scenario]Result)
+	for _, r := range MergeResults(base.Results) {
+		baseResults[r.Scenario] = r
+	}
+	var deltas []Delta
+	seen := make(map[Scenario]bool)
+	for _, r := range current {
+		seen[r.Scenario] = true
+		x := nsPerOp(r.Samples)
+		d := Delta{Scenario: r.Scenario, Current: Summarize(x, alpha), Threshold: th.For(r.Scenario)}
+		b, ok := baseResults[r.Scenario]
+		if !ok {
+			d.Verdict = New
+			deltas = append(deltas, d)
+			continue
+		}
+		y := nsPerOp(b.Samples)
+		d.Base = Summarize(y, alpha)
+		if d.Base.Median > 0 {
+			d.Change = d.Current.Median/d.Base.Median - 1
+		}
+		_, d.P = MannWhitney(x, y)
+		switch {
+		case d.P >= alpha:
+			d.Verdict = Unchanged
+		case d.Change > d.Threshold:
+			d.Verdict = Regression
+		case d.Change < -d.Threshold:
+			d.Verdict = Improvement
+		default:
+			d.Verdict = Unchanged
+		}
+		deltas = append(deltas, d)
+	}
+	for _, r := range base.Results {
+		if !seen[r.Scenario] {
+			seen[r.Scenario] = true
+			deltas = append(deltas, Delta{
+				Scenario:  r.Scenario,
+				Base:      Summarize(nsPerOp(r.Samples), alpha),
+				Threshold: th.For(r.Scenario),
+				Verdict:   Missing,
+			})
+		}
+	}
+	return deltas
+}
+
+// Regressions returns the deltas with verdict Regression.
+func Regressions(deltas []Delta) []Delta {
+	var regressions []Delta
+	for _, d := range deltas {
+		if d.Verdict == Regression {
+			regressions = append(regressions, d)
+		}
+	}
+	return regressions
+}
+
+// WriteDeltas writes the comparison to a baseline as a table.
+func WriteDeltas(w io.Writer, deltas []Delta) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "scenario\tbase ns/op\tns/op\tdelta\tthreshold\tp\tverdict\t\n")
+	for _, d := range deltas {
+		base, cur, change, p := "-", "-", "-", "-"
+		if d.Base.N > 0 {
+			base = fmtNs(d.Base.Median)
+		}
+		if d.Current.N > 0 {
+			cur = fmtNs(d.Current.Median)
+		}
+		if d.Base.N > 0 && d.Current.N > 0 {
+			change = fmt.Sprintf("%+.1f%%", d.Change*100)
+			p = fmt.Sprintf("%.3f", d.P)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.1f%%\t%s\t%s\t\n", d.Name(), base, cur, change,
+			d.Threshold*100, p, d.Verdict)
+	}
+	return tw.Flush()
+}
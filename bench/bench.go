@@ -0,0 +1,456 @@
+/*
+Package bench runs shaping benchmarks for a matrix of scenarios.
+
+A scenario is a combination of font, corpus, feature set, font size and shaping
+backend. Every scenario is measured with testing.Benchmark after a warm-up,
+repeatedly, resulting in a sample per repetition. One benchmark operation
+shapes all paragraphs of a corpus.
+
+Backends are registered by name. The Go backend ("go") is always available;
+the C backend lives in package hbc, which depends on cgo, and is registered by
+commands linking with Harfbuzz (see cmd/hbbench).
+
+The duration of testing.Benchmark is controlled by flag test.benchtime of
+package testing only. Measurements therefore set this process-wide flag,
+registering the testing flags with testing.Init if necessary, and are
+serialized. Programs using package bench should not rely on the flag
+otherwise, and should run benchmarks of their own under LockBenchtime.
+*/
+package bench
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	gohb "github.com/benoitkugler/textlayout/harfbuzz"
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+	"github.com/npillmayer/schuko/tracing"
+)
+
+// tracer traces to tracing key 'hbperf.bench'.
+func tracer() tracing.Trace {
+	return tracing.Select("hbperf.bench")
+}
+
+// --- Scenarios -------------------------------------------------------------
+
+// Matrix is a set of scenarios, as the cross product of its dimensions.
+type Matrix struct {
+	Fonts       []string  `json:"fonts"`    // font names, font queries or font files, see LoadFace
+	Corpora     []string  `json:"corpora"`  // corpus names or text files, see LoadCorpus
+	FeatureSets []string  `json:"features"` // comma separated features; "" is the default set
+	Sizes       []float32 `json:"sizes"`    // font sizes in points
+	Backends    []string  `json:"backends"` // names of registered backends
+}
+
+// Scenario is a single benchmark configuration.
+type Scenario struct {
+	Backend  string  `json:"backend"`
+	Font     string  `json:"font"`
+	Corpus   string  `json:"corpus"`
+	Features string  `json:"features"`
+	Size     float32 `json:"size"`
+}
+
+// Name returns a name for s, usable as a benchmark name.
+func (s Scenario) Name() string {
+	features := s.Features
+	if features == "" {
+		features = "default"
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/%gpt", s.Backend, s.Font, s.Corpus, features, s.Size)
+}
+
+// Scenarios returns all scenarios of the matrix. Empty dimensions default to
+// the built-in corpus, the default feature set, 12pt and the Go backend.
+func (m Matrix) Scenarios() []Scenario {
+	corpora, features, sizes, backends := m.Corpora, m.FeatureSets, m.Sizes, m.Backends
+	if len(corpora) == 0 {
+		corpora = []string{BuiltinCorpus}
+	}
+	if len(features) == 0 {
+		features = []string{""}
+	}
+	if len(sizes) == 0 {
+		sizes = []float32{12}
+	}
+	if len(backends) == 0 {
+		backends = []string{"go"}
+	}
+	var scenarios []Scenario
+	for _, font := range m.Fonts {
+		for _, corpus := range corpora {
+			for _, f := range features {
+				for _, size := range sizes {
+					for _, backend := range backends {
+						scenarios = append(scenarios, Scenario{
+							Backend:  backend,
+							Font:     font,
+							Corpus:   corpus,
+							Features: f,
+							Size:     size,
+						})
+					}
+				}
+			}
+		}
+	}
+	return scenarios
+}
+
+// --- Backends --------------------------------------------------------------
+
+// Backend creates shapers for a shaping backend.
+type Backend interface {
+	// Shaper creates a shaper for a face at a font size, applying features given
+	// as a comma separated list in HarfBuzz syntax. Shapers with a method Free,
+	// e.g. to release native resources, are freed when no longer in use.
+	Shaper(face *harfbuzzgoperf.Face, size float32, features string) (harfbuzzgoperf.Shaper, error)
+}
+
+// freer is implemented by shapers holding native resources.
+type freer interface {
+	Free()
+}
+
+// freeShaper frees a shaper created by a backend, if it implements freer.
+func freeShaper(s harfbuzzgoperf.Shaper) {
+	if f, ok := s.(freer); ok {
+		f.Free()
+	}
+}
+
+var backends = struct {
+	sync.RWMutex
+	m map[string]Backend
+}{m: map[string]Backend{"go": goBackend{}}}
+
+// Register registers a backend under a name.
+func Register(name string, b Backend) {
+	backends.Lock()
+	defer backends.Unlock()
+	backends.m[name] = b
+}
+
+// Backends returns the names of all registered backends, sorted.
+func Backends() []string {
+	backends.RLock()
+	defer backends.RUnlock()
+	names := make([]string, 0, len(backends.m))
+	for name := range backends.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupBackend(name string) (Backend, error) {
+	backends.RLock()
+	defer backends.RUnlock()
+	if b, ok := backends.m[name]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", name)
+}
+
+// goBackend shapes with textlayout.
+type goBackend struct{}
+
+func (goBackend) Shaper(face *harfbuzzgoperf.Face, size float32, features string) (harfbuzzgoperf.Shaper, error) {
+	font, err := hb.FontInstance(nil, face, size, "")
+	if err != nil {
+		return nil, err
+	}
+	params := hb.InstanceParams(font)
+	if params.Features, err = goFeatures(features); err != nil {
+		return nil, err
+	}
+	return hb.NewShaper(params), nil
+}
+
+// goFeatures parses a comma separated list of features for textlayout.
+func goFeatures(features string) ([]gohb.Feature, error) {
+	var list []gohb.Feature
+	for _, f := range strings.Split(features, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		feature, err := gohb.ParseFeature(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feature %q: %v", f, err)
+		}
+		list = append(list, feature)
+	}
+	return list, nil
+}
+
+// --- Fonts and corpora -----------------------------------------------------
+
+// BuiltinCorpus is the name of the corpus of package harfbuzzgoperf.
+const BuiltinCorpus = "corpus"
+
+// LoadFace returns a face by name: the name of a font in the global font store,
+// a CSS-style font query (see harfbuzzgoperf.ParseFontQuery) or a font file.
+func LoadFace(name string) (*harfbuzzgoperf.Face, error) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	if face := harfbuzzgoperf.GlobalFontStore.FindFace(name); face != nil {
+		return face, nil
+	}
+	if binary, err := os.ReadFile(name); err == nil {
+		face, err := harfbuzzgoperf.ParseFace(name, binary)
+		if err != nil {
+			return nil, err
+		}
+		harfbuzzgoperf.GlobalFontStore.StoreFont(name, &harfbuzzgoperf.HBFont{
+			Binary: binary,
+			GoFont: gohb.NewFont(face.GoFace),
+			Face:   face,
+		})
+		return face, nil
+	}
+	q, err := harfbuzzgoperf.ParseFontQuery(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find font %q", name)
+	}
+	return harfbuzzgoperf.GlobalFontStore.MatchFace(q)
+}
+
+// LoadCorpus returns the paragraphs of a corpus: the built-in corpus or a text
+// file, with paragraphs separated by blank lines.
+func LoadCorpus(name string) ([][]rune, error) {
+	if name == BuiltinCorpus {
+		return harfbuzzgoperf.CorpusRunes, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var paragraphs [][]rune
+	var sb strings.Builder
+	flush := func() {
+		if sb.Len() > 0 {
+			paragraphs = append(paragraphs, []rune(sb.String()))
+			sb.Reset()
+		}
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			flush()
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(line)
+	}
+	flush()
+	if err = scanner.Err(); err == nil && len(paragraphs) == 0 {
+		err = errors.New("empty corpus")
+	}
+	return paragraphs, err
+}
+
+// --- Running benchmarks ----------------------------------------------------
+
+// Options control the measurement of a scenario.
+type Options struct {
+	Warmup      int    `json:"warmup"`      // number of operations before measuring
+	Repetitions int    `json:"repetitions"` // number of samples to take
+	Benchtime   string `json:"benchtime"`   // duration or iterations of a sample, e.g. "1s" or "100x"; see go test -benchtime
+	ProfileDir  string `json:"-"`           // if set, capture CPU and heap profiles to this directory
+}
+
+// DefaultOptions returns options for measurements of reasonable stability.
+func DefaultOptions() Options {
+	return Options{Warmup: 1, Repetitions: 5, Benchtime: "1s"}
+}
+
+// Sample is the result of a single benchmark run of a scenario.
+type Sample struct {
+	NsPerOp     float64 `json:"ns_op"`
+	NsPerGlyph  float64 `json:"ns_glyph"`
+	NsPerChar   float64 `json:"ns_char"`
+	AllocsPerOp int64   `json:"allocs_op"`
+	BytesPerOp  int64   `json:"bytes_op"`
+}
+
+// Result is the set of samples taken for a scenario.
+type Result struct {
+	Scenario
+	Script     string   `json:"script"`     // ISO 15924 code of the predominant script of the corpus
+	Paragraphs int      `json:"paragraphs"` // paragraphs per operation
+	Chars      int      `json:"chars"`      // characters per operation
+	Glyphs     int      `json:"glyphs"`     // glyphs per operation
+	Samples    []Sample `json:"samples"`
+	// Profile summarizes profiles captured in addition to the samples, if
+	// Options.ProfileDir is set.
+	Profile *ProfileSummary `json:"profile,omitempty"`
+}
+
+var benchtimeMx sync.Mutex
+
+// setBenchtime sets the duration of testing.Benchmark, which is controlled by a
+// flag of package testing only. It changes the process-wide flag
+// test.benchtime, and calls testing.Init if the flag has not been registered.
+// benchtimeMx must be held until the benchmark has been run.
+func setBenchtime(benchtime string) error {
+	if benchtime == "" {
+		return nil
+	}
+	if flag.Lookup("test.benchtime") == nil {
+		testing.Init()
+	}
+	return flag.Set("test.benchtime", benchtime)
+}
+
+// LockBenchtime sets the duration of testing.Benchmark for benchmarks run
+// outside of package bench, serialized with the measurements of package bench.
+// The caller has to call unlock when done benchmarking; it is nil if err is not.
+func LockBenchtime(benchtime string) (unlock func(), err error) {
+	benchtimeMx.Lock()
+	if err = setBenchtime(benchtime); err != nil {
+		benchtimeMx.Unlock()
+		return nil, err
+	}
+	return benchtimeMx.Unlock, nil
+}
+
+// Run measures a scenario.
+func Run(s Scenario, opts Options) (Result, error) {
+	result := Result{Scenario: s}
+	b, err := lookupBackend(s.Backend)
+	if err != nil {
+		return result, err
+	}
+	face, err := LoadFace(s.Font)
+	if err != nil {
+		return result, err
+	}
+	corpus, err := LoadCorpus(s.Corpus)
+	if err != nil {
+		return result, err
+	}
+	shaper, err := b.Shaper(face, s.Size, s.Features)
+	if err != nil {
+		return result, err
+	}
+	defer freeShaper(shaper)
+	result.Paragraphs = len(corpus)
+	result.Script = corpusScript(corpus)
+	for _, p := range corpus {
+		glyphs, err := shaper.Shape(p)
+		if err != nil {
+			return result, err
+		}
+		result.Chars += len(p)
+		result.Glyphs += len(glyphs)
+	}
+	for i := 1; i < opts.Warmup; i++ { // the first operation has been run above
+		if err = shapeAll(shaper, corpus); err != nil {
+			return result, err
+		}
+	}
+	benchtimeMx.Lock()
+	defer benchtimeMx.Unlock()
+	if err = setBenchtime(opts.Benchtime); err != nil {
+		return result, err
+	}
+	tracer().Infof("running %s", s.Name())
+	var shapeErr error
+	run := func(b *testing.B) {
+		b.ReportAllocs()
+		for j := 0; j < b.N; j++ {
+			if err := shapeAll(shaper, corpus); err != nil {
+				shapeErr = err
+				b.FailNow()
+			}
+		}
+	}
+	for i := 0; i < opts.Repetitions; i++ {
+		r := testing.Benchmark(run)
+		if shapeErr != nil {
+			return result, shapeErr
+		}
+		if r.N == 0 {
+			return result, fmt.Errorf("benchmark %s failed", s.Name())
+		}
+		ns := float64(r.T.Nanoseconds()) / float64(r.N)
+		result.Samples = append(result.Samples, Sample{
+			NsPerOp:     ns,
+			NsPerGlyph:  ns / float64(result.Glyphs),
+			NsPerChar:   ns / float64(result.Chars),
+			AllocsPerOp: r.AllocsPerOp(),
+			BytesPerOp:  r.AllocedBytesPerOp(),
+		})
+	}
+	if opts.ProfileDir != "" {
+		// profiling perturbs timings, so profiles are captured separately
+		if result.Profile, err = profileScenario(s, opts.ProfileDir, run); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// corpusScript returns the script detected for most paragraphs of a corpus,
+// or "Zyyy" (common) if none has been detected.
+func corpusScript(corpus [][]rune) string {
+	counts := make(map[string]int)
+	for _, p := range corpus {
+		if s, err := harfbuzzgoperf.ScriptFromHB(harfbuzzgoperf.DetectScript(p)); err == nil {
+			counts[s.String()]++
+		}
+	}
+	script, max := "Zyyy", 0
+	for s, n := range counts {
+		if n > max || n == max && s < script {
+			script, max = s, n
+		}
+	}
+	return script
+}
+
+// shapeAll shapes all paragraphs of a corpus and returns the first error.
+func shapeAll(shaper harfbuzzgoperf.Shaper, corpus [][]rune) error {
+	for _, p := range corpus {
+		if _, err := shaper.Shape(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunMatrix measures all scenarios of a matrix, in order. progress, if not nil,
+// is called after every scenario.
+func RunMatrix(m Matrix, opts Options, progress func(Result)) ([]Result, error) {
+	return RunScenarios(m.Scenarios(), opts, progress)
+}
+
+// RunScenarios measures scenarios, in order. progress, if not nil, is called
+// after every scenario.
+func RunScenarios(scenarios []Scenario, opts Options, progress func(Result)) ([]Result, error) {
+	var results []Result
+	for _, s := range scenarios {
+		r, err := Run(s, opts)
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", s.Name(), err)
+		}
+		results = append(results, r)
+		if progress != nil {
+			progress(r)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,439 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/schuko/tracing/gotestingadapter"
+)
+
+func TestScenarios(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	m := Matrix{
+		Fonts:       []string{"Go", "Calibri.ttf"},
+		FeatureSets: []string{"", "-kern"},
+		Sizes:       []float32{10, 12},
+	}
+	scenarios := m.Scenarios()
+	if len(scenarios) != 8 {
+		t.Fatalf("expected 8 scenarios, have %d", len(scenarios))
+	}
+	if name := scenarios[1].Name(); name != "go/Go/corpus/default/12pt" {
+		t.Errorf("unexpected scenario name %q", name)
+	}
+}
+
+func TestRun(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	m := Matrix{Fonts: []string{"bold Go"}, FeatureSets: []string{"-kern"}}
+	results, err := RunMatrix(m, Options{Repetitions: 2, Benchtime: "3x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := results[0]
+	if len(r.Samples) != 2 || r.Glyphs == 0 || r.Chars == 0 {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if s := r.Samples[0]; s.NsPerOp <= 0 || s.NsPerGlyph != s.NsPerOp/float64(r.Glyphs) {
+		t.Errorf("unexpected sample %+v", s)
+	}
+	var buf bytes.Buffer
+	if err = WriteCSV(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(rows) != 3 || len(rows[1]) != len(csvHeader) {
+		t.Errorf("expected header and 2 rows of CSV, have %v (%v)", rows, err)
+	}
+	buf.Reset()
+	if err = WriteJSON(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadJSON(&buf)
+	if err != nil || len(read) != 1 || read[0].Scenario != r.Scenario || len(read[0].Samples) != 2 {
+		t.Errorf("expected results to survive JSON round trip, have %+v (%v)", read, err)
+	}
+	if _, err = Run(Scenario{Backend: "none", Font: "Go"}, Options{}); err == nil {
+		t.Error("expected error for unknown backend")
+	}
+}
+
+// failingBackend creates shapers which fail after a number of paragraphs, and
+// counts the shapers freed.
+type failingBackend struct {
+	after int
+	freed *int
+}
+
+type failingShaper struct {
+	count, after int
+	freed        *int
+}
+
+func (b failingBackend) Shaper(face *harfbuzzgoperf.Face, size float32, features string) (harfbuzzgoperf.Shaper, error) {
+	return &failingShaper{after: b.after, freed: b.freed}, nil
+}
+
+func (s *failingShaper) Free() {
+	*s.freed++
+}
+
+func (s *failingShaper) Shape(text []rune) ([]harfbuzzgoperf.ShapedGlyph, error) {
+	if s.count++; s.count > s.after {
+		return nil, errors.New("shaping failed")
+	}
+	return make([]harfbuzzgoperf.ShapedGlyph, len(text)), nil
+}
+
+func TestRunShapeError(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	freed := 0
+	Register("failing", failingBackend{after: 2 * len(harfbuzzgoperf.Corpus), freed: &freed})
+	m := Matrix{Fonts: []string{"Go"}, Backends: []string{"failing"}}
+	if _, err := RunMatrix(m, Options{Repetitions: 1, Benchtime: "3x"}, nil); err == nil {
+		t.Error("expected shaping errors to fail the benchmark")
+	}
+	if freed != 1 {
+		t.Errorf("expected the shaper of the scenario to be freed, %d freed", freed)
+	}
+}
+
+func TestLoadCorpus(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	path := filepath.Join(t.TempDir(), "text.txt")
+	os.WriteFile(path, []byte("first\nparagraph\n\n\nsecond\n"), 0644)
+	corpus, err := LoadCorpus(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corpus) != 2 || string(corpus[0]) != "first paragraph" {
+		t.Errorf("unexpected corpus %q", corpus)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	s := Summarize([]float64{5, 1, 4, 2, 3}, 0.05)
+	if s.Median != 3 || s.Low != 1 || s.High != 5 || math.Abs(s.Confidence-0.9375) > 1e-9 {
+		t.Errorf("unexpected summary of 5 samples %+v", s)
+	}
+	xs := make([]float64, 20)
+	for i := range xs {
+		xs[i] = float64(i)
+	}
+	s = Summarize(xs, 0.05)
+	if s.Median != 9.5 || s.Low != 5 || s.High != 14 || s.Confidence < 0.95 {
+		t.Errorf("unexpected summary of 20 samples %+v", s)
+	}
+}
+
+func TestMannWhitney(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	// completely separated samples of size 5: p = 2/252
+	u, p := MannWhitney([]float64{6, 7, 8, 9, 10}, []float64{1, 2, 3, 4, 5})
+	if u != 25 || math.Abs(p-2.0/252) > 1e-9 {
+		t.Errorf("expected U=25, p=0.0079, have U=%g, p=%g", u, p)
+	}
+	if _, p = MannWhitney([]float64{1, 3, 5, 7}, []float64{2, 4, 6, 8}); p < 0.5 {
+		t.Errorf("expected interleaved samples not to differ, have p=%g", p)
+	}
+	if _, p = MannWhitney([]float64{1, 1, 1}, []float64{1, 1, 1}); p != 1 {
+		t.Errorf("expected p=1 for identical samples, have p=%g", p)
+	}
+}
+
+func TestCompareBackends(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	samples := func(ns ...float64) []Sample {
+		var s []Sample
+		for _, x := range ns {
+			s = append(s, Sample{NsPerOp: x})
+		}
+		return s
+	}
+	s := Scenario{Backend: "go", Font: "Go", Corpus: "corpus", Size: 12}
+	results := []Result{{Scenario: s, Script: "Latn", Samples: samples(20, 21, 22)}}
+	results = append(results, Result{Scenario: s, Script: "Latn", Samples: samples(19, 20)})
+	s.Backend = "c"
+	results = append(results, Result{Scenario: s, Script: "Latn", Samples: samples(10, 9, 11, 10, 12)})
+	report := CompareBackends(results, 0.05)
+	if len(report.Comparisons) != 1 {
+		t.Fatalf("expected 1 comparison, have %d", len(report.Comparisons))
+	}
+	c := report.Comparisons[0]
+	if c.Go.N != 5 || c.Ratio != 2 || !c.Significant {
+		t.Errorf("unexpected comparison %+v", c)
+	}
+	if len(report.Scripts) != 1 || report.Scripts[0].Name != "Latn" || report.Scripts[0].Ratio != 2 {
+		t.Errorf("unexpected ratios per script %+v", report.Scripts)
+	}
+	var buf bytes.Buffer
+	if err := WriteTable(&buf, report); err != nil || !strings.Contains(buf.String(), "2.00x") {
+		t.Errorf("unexpected table (%v):\n%s", err, buf.String())
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	samples := func(ns ...float64) []Sample {
+		var s []Sample
+		for _, x := range ns {
+			s = append(s, Sample{NsPerOp: x})
+		}
+		return s
+	}
+	fast := Scenario{Backend: "go", Font: "Go", Corpus: "corpus", Size: 12}
+	slow, gone := fast, fast
+	slow.Font, gone.Font = "Calibri.ttf", "Gone"
+	base := NewBaseline([]Result{
+		{Scenario: fast, Samples: samples(100, 101, 99, 100, 102)},
+		{Scenario: slow, Samples: samples(100, 101, 99, 100, 102)},
+		{Scenario: gone, Samples: samples(100)},
+	}, DefaultOptions())
+	if base.Environment.GoVersion == "" || base.Environment.NumCPU == 0 {
+		t.Errorf("expected environment to be recorded, have %+v", base.Environment)
+	}
+	var buf bytes.Buffer
+	if err := WriteBaseline(&buf, base); err != nil {
+		t.Fatal(err)
+	}
+	base, err := ReadBaseline(&buf)
+	if err != nil || len(base.Results) != 3 {
+		t.Fatalf("expected baseline to survive JSON round trip, have %+v (%v)", base, err)
+	}
+	current := []Result{
+		{Scenario: fast, Samples: samples(90, 91, 89, 90, 92)},
+		{Scenario: slow, Samples: samples(110, 111, 109, 110, 112)},
+	}
+	th := Thresholds{Default: 0.05, Scenarios: map[string]float64{"go/Calibri*": 0.2}}
+	deltas := CompareBaseline(base, current, th, 0.05)
+	verdicts := []Verdict{Improvement, Unchanged, Missing}
+	for i, d := range deltas {
+		if d.Verdict != verdicts[i] {
+			t.Errorf("expected %s to be %s, is %s", d.Name(), verdicts[i], d.Verdict)
+		}
+	}
+	th.Scenarios = nil
+	if r := Regressions(CompareBaseline(base, current, th, 0.05)); len(r) != 1 || r[0].Scenario != slow {
+		t.Errorf("expected %s to regress, have %+v", slow.Name(), r)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	var results []Result
+	for _, backend := range []string{"go", "c"} {
+		for _, font := range []string{"Go", "<Bold>"} {
+			s := Scenario{Backend: backend, Font: font, Corpus: "corpus", Size: 12}
+			results = append(results, Result{Scenario: s, Script: "Latn", Paragraphs: 2, Chars: 100, Glyphs: 90,
+				Samples: []Sample{{NsPerOp: 9000, NsPerGlyph: 100, BytesPerOp: 900}}})
+		}
+	}
+	old := NewBaseline(results, DefaultOptions())
+	old.Created = old.Created.Add(-time.Hour)
+	var buf bytes.Buffer
+	if err := WriteHTML(&buf, ReportInput{Title: "Test", Results: results, History: []Baseline{old}}); err != nil {
+		t.Fatal(err)
+	}
+	report := buf.String()
+	if n := strings.Count(report, "<svg"); n != 5 {
+		t.Errorf("expected 5 charts, have %d", n)
+	}
+	if strings.Contains(report, "<script") || strings.Contains(report, "<Bold>") {
+		t.Error("expected report without scripts and unescaped text")
+	}
+	if !strings.Contains(report, "Environment of the results unknown") {
+		t.Error("expected environment of bare results to be reported as unknown")
+	}
+	results[0].Glyphs = 0
+	buf.Reset()
+	env := old.Environment
+	if err := WriteHTML(&buf, ReportInput{Title: "Test", Results: results, Environment: &env}); err != nil {
+		t.Fatal(err)
+	}
+	report = buf.String()
+	if strings.Contains(report, "NaN") || strings.Contains(report, "Inf") {
+		t.Error("expected report without NaN or infinite values for results without glyphs")
+	}
+	if !strings.Contains(report, env.GoVersion) {
+		t.Error("expected environment of the results to be reported")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	dir := t.TempDir()
+	r, err := Run(Scenario{Backend: "go", Font: "Go", Corpus: BuiltinCorpus, Size: 12},
+		Options{Repetitions: 1, Benchtime: "200ms", ProfileDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := r.Profile
+	if p == nil || p.CPU == nil || p.Heap == nil {
+		t.Fatalf("expected CPU and heap profile, have %+v", p)
+	}
+	for _, file := range []string{p.CPUFile, p.HeapFile} {
+		if _, err := os.Stat(file); err != nil {
+			t.Error(err)
+		}
+	}
+	if p.CPU.Total == 0 || len(p.CPU.Top) == 0 || p.Heap.Total == 0 {
+		t.Errorf("expected samples in profiles, have %+v, %+v", p.CPU, p.Heap)
+	}
+	textlayout := false
+	for _, s := range p.CPU.Subsystems {
+		textlayout = textlayout || s.Name != SubsystemRuntime && s.Name != SubsystemOther
+	}
+	if !textlayout {
+		t.Errorf("expected CPU time attributed to textlayout, have %+v", p.CPU.Subsystems)
+	}
+	t.Logf("CPU: %+v", p.CPU.Subsystems)
+	t.Logf("heap: %+v", p.Heap.Subsystems)
+}
+
+func TestSubsystems(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	hb := textlayoutPrefix + "harfbuzz."
+	stack := []frame{
+		{function: "runtime.mallocgc", file: "malloc.go"},
+		{function: hb + "(*Buffer).append", file: "harfbuzz/buffer.go"},
+		{function: hb + "otShapeNormalize", file: "harfbuzz/ot_shape_normalize.go"},
+	}
+	if s := attribute(stack); s != SubsystemBuffer {
+		t.Errorf("expected allocation to be attributed to buffer management, is %s", s)
+	}
+	for f, expected := range map[frame]string{
+		{function: hb + "(*Font).nominalGlyph", file: "harfbuzz/fonts.go"}:              SubsystemCmap,
+		{function: hb + "lookupGSUB.dispatchApply", file: "harfbuzz/ot_layout_gsub.go"}: SubsystemGSUB,
+		{function: hb + "(*otApplyContext).applyGPOS", file: "ot_layout_gsubgpos.go"}:   SubsystemGPOS,
+		{function: hb + "(*otApplyContext).matchInput", file: "ot_layout_gsubgpos.go"}:  SubsystemLookups,
+		{function: hb + "arabicJoining", file: "harfbuzz/ot_arabic.go"}:                 SubsystemComplex,
+	} {
+		if s := subsystem(f); s != expected {
+			t.Errorf("expected %s to be attributed to %s, is %s", f.function, expected, s)
+		}
+	}
+}
+
+func TestScaling(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	for _, g := range Generators {
+		if text := g.Generate(1000); len(text) != 1000 {
+			t.Errorf("expected generator %s to generate 1000 characters, have %d", g.Name, len(text))
+		}
+	}
+	quadratic := []ScalingPoint{{Length: 10, NsPerOp: 1e6}, {Length: 100, NsPerOp: 1e4},
+		{Length: 1000, NsPerOp: 1e6}, {Length: 10000, NsPerOp: 1e8}}
+	if k := growthExponent(quadratic, func(p ScalingPoint) float64 { return p.NsPerOp }); math.Abs(k-2) > 1e-9 {
+		t.Errorf("expected exponent 2 for quadratic growth, have %g", k)
+	}
+	curves, err := RunScaling(ScalingConfig{
+		Font:       "Go",
+		Generators: []string{"words"},
+		Lengths:    []int{1, 100, 1000, 10000},
+		Benchtime:  "20x",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(curves) != 1 || len(curves[0].Points) != 4 {
+		t.Fatalf("unexpected curves %+v", curves)
+	}
+	if k := curves[0].TimeExponent; k < 0.5 || k > 1.5 {
+		t.Errorf("expected shaping words to scale about linearly, have exponent %.2f", k)
+	}
+}
+
+func TestColdStart(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	results, err := RunColdStart(ColdStartConfig{Fonts: []string{"Go"}, Benchtime: "5x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := results[0]
+	for name, p := range map[string]Phase{"parse": r.Parse, "new font": r.NewFont,
+		"first shape": r.FirstShape, "steady": r.Steady} {
+		if p.NsPerOp <= 0 {
+			t.Errorf("expected %s to be measured, have %+v", name, p)
+		}
+	}
+	if r.Cold() <= r.Steady.NsPerOp {
+		t.Errorf("expected cold start to be more expensive than steady state, have %+v", r)
+	}
+}
+
+func TestPlanCosts(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	cfg := PlanConfig{Fonts: []string{"Go"}, Scripts: []string{"Latn", "Arab"}, Compilations: 5, Benchtime: "20x"}
+	costs, err := RunPlanCosts(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(costs) != 2 {
+		t.Fatalf("expected costs for 2 scripts, have %d", len(costs))
+	}
+	var buf bytes.Buffer
+	WritePlanTable(&buf, costs)
+	t.Logf("\n%s", buf.String())
+	for _, c := range costs {
+		if c.Compile.NsPerOp <= 0 || c.Execute.NsPerOp <= 0 {
+			t.Errorf("expected compilation and execution to be measured, have %+v", c)
+		}
+	}
+	if _, err = RunPlanCosts(PlanConfig{Fonts: []string{"Go"}, Scripts: []string{"Xxxx"}}, nil); err == nil {
+		t.Error("expected error for script without sample")
+	}
+}
+
+func TestFootprint(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.bench")
+	defer teardown()
+	//
+	footprints, err := RunFootprint(FootprintConfig{Fonts: []string{"Go"}, Runs: 10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := footprints[0]
+	if fp.Native || fp.Loaded.Go <= 0 || fp.AllocPerRun <= 0 {
+		t.Errorf("unexpected footprint %+v", fp)
+	}
+	var buf bytes.Buffer
+	WriteFootprintTable(&buf, footprints)
+	t.Log("\n" + buf.String())
+}
@@ -0,0 +1,278 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+	"text/tabwriter"
+
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
+	gohb "github.com/benoitkugler/textlayout/harfbuzz"
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+)
+
+// --- Cold start ------------------------------------------------------------
+
+// ColdStarter is implemented by backends which are able to create faces and
+// fonts from scratch, bypassing all caches. Faces and fonts are opaque to
+// package bench; free functions returned may be nil.
+type ColdStarter interface {
+	// ParseFace parses a font binary.
+	ParseFace(binary []byte) (face interface{}, free func(), err error)
+	// NewFont creates a font object at a font size for a face from ParseFace.
+	NewFont(face interface{}, binary []byte, size float32) (font *harfbuzzgoperf.HBFont, free func(), err error)
+	// NewShaper creates a shaper for a font from NewFont.
+	NewShaper(font *harfbuzzgoperf.HBFont) (shaper harfbuzzgoperf.Shaper, free func(), err error)
+}
+
+// Phase is the cost of a phase of starting to shape with a font.
+type Phase struct {
+	NsPerOp     float64 `json:"ns_op"`
+	AllocsPerOp int64   `json:"allocs_op"`
+	BytesPerOp  int64   `json:"bytes_op"`
+}
+
+// ColdStart is the cost of the phases of shaping with a font from scratch:
+// parsing the font binary, creating a font object, shaping for the first time
+// with a fresh face and font (including lazy table loading and shape plan
+// compilation), and shaping once warmed up.
+type ColdStart struct {
+	Backend    string `json:"backend"`
+	Font       string `json:"font"`
+	Parse      Phase  `json:"parse"`
+	NewFont    Phase  `json:"new_font"`
+	FirstShape Phase  `json:"first_shape"`
+	Steady     Phase  `json:"steady"`
+}
+
+// Cold returns the total cost of shaping once with a new font.
+func (c ColdStart) Cold() float64 {
+	return c.Parse.NsPerOp + c.NewFont.NsPerOp + c.FirstShape.NsPerOp
+}
+
+// ColdStartConfig configures cold-start measurements.
+type ColdStartConfig struct {
+	Fonts     []string
+	Backends  []string // default: "go"
+	Size      float32  // default: 12
+	Text      string   // default: the first paragraph of the built-in corpus
+	Benchtime string   // per phase, default: "1s"
+}
+
+// RunColdStart measures the phases of starting to shape with a font, for every
+// font and backend configured.
+func RunColdStart(cfg ColdStartConfig, progress func(ColdStart)) ([]ColdStart, error) {
+	if len(cfg.Backends) == 0 {
+		cfg.Backends = []string{"go"}
+	}
+	if cfg.Size == 0 {
+		cfg.Size = 12
+	}
+	text := []rune(cfg.Text)
+	if len(text) == 0 {
+		text = harfbuzzgoperf.CorpusRunes[0]
+	}
+	benchtimeMx.Lock()
+	defer benchtimeMx.Unlock()
+	if err := setBenchtime(cfg.Benchtime); err != nil {
+		return nil, err
+	}
+	var results []ColdStart
+	for _, name := range cfg.Fonts {
+		face, err := LoadFace(name)
+		if err != nil {
+			return results, err
+		}
+		for _, backend := range cfg.Backends {
+			b, err := lookupBackend(backend)
+			if err != nil {
+				return results, err
+			}
+			cs, ok := b.(ColdStarter)
+			if !ok {
+				return results, fmt.Errorf("backend %q does not support cold-start measurements", backend)
+			}
+			tracer().Infof("cold start %s/%s", backend, name)
+			r, err := coldStart(cs, face.Binary, cfg.Size, text)
+			if err != nil {
+				return results, fmt.Errorf("%s/%s: %w", backend, name, err)
+			}
+			r.Backend, r.Font = backend, name
+			results = append(results, r)
+			if progress != nil {
+				progress(r)
+			}
+		}
+	}
+	return results, nil
+}
+
+func coldStart(cs ColdStarter, binary []byte, size float32, text []rune) (ColdStart, error) {
+	var r ColdStart
+	var err error
+	release := func(free func()) {
+		if free != nil {
+			free()
+		}
+	}
+	fresh := func() (harfbuzzgoperf.Shaper, func(), error) {
+		face, freeFace, err := cs.ParseFace(binary)
+		if err != nil {
+			return nil, nil, err
+		}
+		font, freeFont, err := cs.NewFont(face, binary, size)
+		if err != nil {
+			release(freeFace)
+			return nil, nil, err
+		}
+		shaper, freeShaper, err := cs.NewShaper(font)
+		if err != nil {
+			release(freeFont)
+			release(freeFace)
+			return nil, nil, err
+		}
+		return shaper, func() { release(freeShaper); release(freeFont); release(freeFace) }, nil
+	}
+	// the first error of a benchmark run is kept in err
+	fail := func(b *testing.B, e error) {
+		if err == nil {
+			err = e
+		}
+		b.FailNow()
+	}
+	r.Parse = phase(testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, free, e := cs.ParseFace(binary)
+			if e != nil {
+				fail(b, e)
+			}
+			release(free)
+		}
+	}))
+	if err != nil {
+		return r, err
+	}
+	face, freeFace, err := cs.ParseFace(binary)
+	if err != nil {
+		return r, err
+	}
+	r.NewFont = phase(testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, free, e := cs.NewFont(face, binary, size)
+			if e != nil {
+				fail(b, e)
+			}
+			release(free)
+		}
+	}))
+	release(freeFace)
+	if err != nil {
+		return r, err
+	}
+	r.FirstShape = phase(testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			shaper, free, e := fresh()
+			if e != nil {
+				fail(b, e)
+			}
+			b.StartTimer()
+			if _, e = shaper.Shape(text); e != nil {
+				fail(b, e)
+			}
+			b.StopTimer()
+			free()
+			b.StartTimer()
+		}
+	}))
+	if err != nil {
+		return r, err
+	}
+	shaper, free, err := fresh()
+	if err != nil {
+		return r, err
+	}
+	defer free()
+	if _, err = shaper.Shape(text); err != nil {
+		return r, err
+	}
+	r.Steady = phase(testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			shaper.Shape(text)
+		}
+	}))
+	return r, nil
+}
+
+func phase(r testing.BenchmarkResult) Phase {
+	if r.N == 0 {
+		return Phase{}
+	}
+	return Phase{
+		NsPerOp:     float64(r.T.Nanoseconds()) / float64(r.N),
+		AllocsPerOp: r.AllocsPerOp(),
+		BytesPerOp:  r.AllocedBytesPerOp(),
+	}
+}
+
+// WriteColdStartTable writes cold-start measurements as a table.
+func WriteColdStartTable(w io.Writer, results []ColdStart) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "backend/font\tparse\tnew font\tfirst shape\tcold total\tsteady\tcold/steady\t\n")
+	for _, r := range results {
+		ratio := 0.0
+		if r.Steady.NsPerOp > 0 {
+			ratio = r.Cold() / r.Steady.NsPerOp
+		}
+		fmt.Fprintf(tw, "%s/%s\t%s\t%s\t%s\t%s\t%s\t%.1fx\t\n", r.Backend, r.Font,
+			fmtNs(r.Parse.NsPerOp), fmtNs(r.NewFont.NsPerOp), fmtNs(r.FirstShape.NsPerOp),
+			fmtNs(r.Cold()), fmtNs(r.Steady.NsPerOp), ratio)
+	}
+	return tw.Flush()
+}
+
+// WriteColdStartCSV writes cold-start measurements as CSV, one row per phase.
+func WriteColdStartCSV(w io.Writer, results []ColdStart) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"backend", "font", "phase", "ns_op", "allocs_op", "bytes_op"})
+	for _, r := range results {
+		for _, p := range []struct {
+			name string
+			Phase
+		}{{"parse", r.Parse}, {"new_font", r.NewFont}, {"first_shape", r.FirstShape}, {"steady", r.Steady}} {
+			cw.Write([]string{r.Backend, r.Font, p.name, strconv.FormatFloat(p.NsPerOp, 'f', 2, 64),
+				strconv.FormatInt(p.AllocsPerOp, 10), strconv.FormatInt(p.BytesPerOp, 10)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// --- Go backend ------------------------------------------------------------
+
+func (goBackend) ParseFace(binary []byte) (interface{}, func(), error) {
+	face, err := tt.Parse(bytes.NewReader(binary), true)
+	return face, nil, err
+}
+
+func (goBackend) NewFont(face interface{}, binary []byte, size float32) (*harfbuzzgoperf.HBFont, func(), error) {
+	font := &harfbuzzgoperf.HBFont{
+		Binary: binary,
+		GoFont: gohb.NewFont(face.(*tt.Font)),
+		Size:   size,
+	}
+	font.GoFont.Ptem = size
+	return font, nil, nil
+}
+
+func (goBackend) NewShaper(font *harfbuzzgoperf.HBFont) (harfbuzzgoperf.Shaper, func(), error) {
+	return hb.NewShaper(hb.InstanceParams(font)), nil, nil
+}
@@ -0,0 +1,202 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/metrics"
+	"text/tabwriter"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// --- Memory footprint ------------------------------------------------------
+
+// NativeMemory is implemented by backends allocating memory outside of the Go
+// heap, i.e. the C backend.
+type NativeMemory interface {
+	// NativeHeapInUse returns the number of bytes allocated natively, and false
+	// if this is not available on the platform.
+	NativeHeapInUse() (int64, bool)
+}
+
+// Memory is memory used in the Go heap and natively, in bytes.
+type Memory struct {
+	Go     int64 `json:"go"`
+	Native int64 `json:"native"`
+}
+
+// Total returns the sum of Go and native memory.
+func (m Memory) Total() int64 {
+	return m.Go + m.Native
+}
+
+// Footprint is the memory a backend needs for a font.
+type Footprint struct {
+	Backend string `json:"backend"`
+	Font    string `json:"font"`
+	// Loaded is retained by a loaded face and font object. It includes the font
+	// binary for every backend, as far as the backend retains it: the Go
+	// backend's font references the binary in the Go heap, the C backend's
+	// font references it as well and Harfbuzz keeps a native copy.
+	Loaded Memory `json:"loaded"`
+	// FirstShape is retained additionally after shaping once, e.g. tables loaded
+	// lazily, shape plans and buffers.
+	FirstShape Memory `json:"first_shape"`
+	// PerRun is memory retained per additional shaped run; it should be 0.
+	PerRun Memory `json:"per_run"`
+	// AllocPerRun is Go heap allocated per shaped run, most of which is garbage.
+	AllocPerRun int64 `json:"alloc_per_run"`
+	// Native is false if native memory could not be measured.
+	Native bool `json:"native"`
+}
+
+// FootprintConfig configures memory footprint measurements.
+type FootprintConfig struct {
+	Fonts    []string
+	Backends []string // default: "go"
+	Size     float32  // default: 12
+	Text     string   // default: the first paragraph of the built-in corpus
+	Runs     int      // number of runs for per-run measurements, default: 100
+}
+
+// Names of runtime/metrics used.
+const (
+	metricHeapObjects = "/memory/classes/heap/objects:bytes"
+	metricHeapAllocs  = "/gc/heap/allocs:bytes"
+)
+
+// memorySnapshot returns live Go heap, cumulative Go heap allocations and
+// native memory in use, after garbage collection.
+func memorySnapshot(native NativeMemory) (live, allocs, nat int64) {
+	runtime.GC()
+	runtime.GC() // run finalizers queued by the first collection
+	samples := []metrics.Sample{{Name: metricHeapObjects}, {Name: metricHeapAllocs}}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() == metrics.KindUint64 {
+		live = int64(samples[0].Value.Uint64())
+	}
+	if samples[1].Value.Kind() == metrics.KindUint64 {
+		allocs = int64(samples[1].Value.Uint64())
+	}
+	if native != nil {
+		nat, _ = native.NativeHeapInUse()
+	}
+	return
+}
+
+// RunFootprint measures the memory footprint of every font and backend
+// configured. Backends have to implement ColdStarter, as faces and fonts are
+// created from scratch.
+func RunFootprint(cfg FootprintConfig, progress func(Footprint)) ([]Footprint, error) {
+	if len(cfg.Backends) == 0 {
+		cfg.Backends = []string{"go"}
+	}
+	if cfg.Size == 0 {
+		cfg.Size = 12
+	}
+	if cfg.Runs == 0 {
+		cfg.Runs = 100
+	}
+	text := []rune(cfg.Text)
+	if len(text) == 0 {
+		text = harfbuzzgoperf.CorpusRunes[0]
+	}
+	var footprints []Footprint
+	for _, name := range cfg.Fonts {
+		face, err := LoadFace(name)
+		if err != nil {
+			return footprints, err
+		}
+		for _, backend := range cfg.Backends {
+			b, err := lookupBackend(backend)
+			if err != nil {
+				return footprints, err
+			}
+			cs, ok := b.(ColdStarter)
+			if !ok {
+				return footprints, fmt.Errorf("backend %q does not support footprint measurements", backend)
+			}
+			tracer().Infof("footprint %s/%s", backend, name)
+			fp, err := footprint(cs, face.Binary, cfg.Size, text, cfg.Runs)
+			if err != nil {
+				return footprints, fmt.Errorf("%s/%s: %w", backend, name, err)
+			}
+			fp.Backend, fp.Font = backend, name
+			footprints = append(footprints, fp)
+			if progress != nil {
+				progress(fp)
+			}
+		}
+	}
+	return footprints, nil
+}
+
+func footprint(cs ColdStarter, binary []byte, size float32, text []rune, runs int) (Footprint, error) {
+	var fp Footprint
+	native, _ := cs.(NativeMemory)
+	if native != nil {
+		_, fp.Native = native.NativeHeapInUse()
+	}
+	live0, _, nat0 := memorySnapshot(native)
+	// the backend gets a binary of its own, charged to Loaded if retained
+	binary = append([]byte(nil), binary...)
+	face, freeFace, err := cs.ParseFace(binary)
+	if err != nil {
+		return fp, err
+	}
+	if freeFace != nil {
+		defer freeFace()
+	}
+	font, freeFont, err := cs.NewFont(face, binary, size)
+	if err != nil {
+		return fp, err
+	}
+	if freeFont != nil {
+		defer freeFont()
+	}
+	live1, _, nat1 := memorySnapshot(native)
+	fp.Loaded = Memory{Go: live1 - live0, Native: nat1 - nat0}
+	shaper, freeShaper, err := cs.NewShaper(font)
+	if err != nil {
+		return fp, err
+	}
+	if freeShaper != nil {
+		defer freeShaper()
+	}
+	if _, err = shaper.Shape(text); err != nil {
+		return fp, err
+	}
+	live2, allocs2, nat2 := memorySnapshot(native)
+	fp.FirstShape = Memory{Go: live2 - live1, Native: nat2 - nat1}
+	for i := 0; i < runs; i++ {
+		shaper.Shape(text)
+	}
+	live3, allocs3, nat3 := memorySnapshot(native)
+	fp.PerRun = Memory{Go: (live3 - live2) / int64(runs), Native: (nat3 - nat2) / int64(runs)}
+	fp.AllocPerRun = (allocs3 - allocs2) / int64(runs)
+	runtime.KeepAlive(face)
+	runtime.KeepAlive(font)
+	runtime.KeepAlive(shaper)
+	return fp, nil
+}
+
+// WriteFootprintTable writes memory footprints as a table.
+func WriteFootprintTable(w io.Writer, footprints []Footprint) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "backend/font\tloaded go\tnative\tfirst shape go\tnative\tper run go\tnative\talloc/run\t\n")
+	kb := func(b int64) string { return fmt.Sprintf("%.1f KB", float64(b)/1024) }
+	for _, fp := range footprints {
+		bytes := func(b int64) string { return fmt.Sprintf("%d B", b) }
+		nat := func(b int64, format func(int64) string) string {
+			if !fp.Native {
+				return "-"
+			}
+			return format(b)
+		}
+		fmt.Fprintf(tw, "%s/%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", fp.Backend, fp.Font,
+			kb(fp.Loaded.Go), nat(fp.Loaded.Native, kb), kb(fp.FirstShape.Go), nat(fp.FirstShape.Native, kb),
+			bytes(fp.PerRun.Go), nat(fp.PerRun.Native, bytes), kb(fp.AllocPerRun))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,53 @@
+package bench
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// WriteJSON writes results as a JSON array.
+func WriteJSON(w io.Writer, results []Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// ReadJSON reads results written by WriteJSON.
+func ReadJSON(r io.Reader) ([]Result, error) {
+	var results []Result
+	err := json.NewDecoder(r).Decode(&results)
+	return results, err
+}
+
+// csvHeader is the header row of CSV output.
+var csvHeader = []string{
+	"backend", "font", "corpus", "script", "features", "size", "sample",
+	"ns_op", "ns_glyph", "ns_char", "allocs_op", "bytes_op",
+}
+
+// WriteCSV writes results as CSV, one row per sample.
+func WriteCSV(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	f := func(x float64) string { return strconv.FormatFloat(x, 'f', 2, 64) }
+	for _, r := range results {
+		for i, s := range r.Samples {
+			row := []string{
+				r.Backend, r.Font, r.Corpus, r.Script, r.Features,
+				strconv.FormatFloat(float64(r.Size), 'g', -1, 32),
+				strconv.Itoa(i),
+				f(s.NsPerOp), f(s.NsPerGlyph), f(s.NsPerChar),
+				strconv.FormatInt(s.AllocsPerOp, 10), strconv.FormatInt(s.BytesPerOp, 10),
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,241 @@
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"text/tabwriter"
+
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
+	gohb "github.com/benoitkugler/textlayout/harfbuzz"
+	hblang "github.com/benoitkugler/textlayout/language"
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+)
+
+// --- Shape plans -----------------------------------------------------------
+
+// ScriptSample is a short text in a script, for measuring shape plans. Plans
+// depend on the script, as it selects the complex shaper and the language
+// system of the font.
+type ScriptSample struct {
+	Script string // ISO 15924
+	Text   string
+}
+
+// ScriptSamples are the texts plans are measured for. Fonts need not cover
+// them: plans are compiled and executed for uncovered text as well.
+var ScriptSamples = []ScriptSample{
+	{"Latn", "The quick brown fox jumps over the lazy dog."},
+	{"Cyrl", "Съешь же ещё этих мягких французских булок."},
+	{"Grek", "Ξεσκεπάζω την ψυχοφθόρα βδελυγμία."},
+	{"Arab", "نص حكيم له سر قاطع وذو شأن عظيم مكتوب على ثوب أخضر"},
+	{"Hebr", "דג סקרן שט בים מאוכזב ולפתע מצא חברה"},
+	{"Deva", "ऋषियों को सताने वाले दुष्ट राक्षसों के राजा रावण का सर्वनाश"},
+	{"Thai", "เป็นมนุษย์สุดประเสริฐเลิศคุณค่า"},
+	{"Hang", "키스의 고유조건은 입술끼리 만나야 하고"},
+}
+
+// Planner is implemented by backends which are able to separate shape plan
+// compilation from plan execution.
+type Planner interface {
+	// PlanShaping prepares shaping text with a face at a size and features.
+	PlanShaping(face *harfbuzzgoperf.Face, size float32, features string, text []rune) (PlanRun, error)
+}
+
+// PlanRun compiles shape plans and executes them for a text.
+type PlanRun struct {
+	Compile func() error // compiles a new shape plan, bypassing plan caches
+	Execute func() error // shapes the text with a plan compiled before
+	Free    func()       // may be nil
+}
+
+// PlanCost is the cost of compiling a shape plan for a script, and of
+// executing it.
+type PlanCost struct {
+	Backend string `json:"backend"`
+	Font    string `json:"font"`
+	Script  string `json:"script"`
+	Compile Phase  `json:"compile"`
+	Execute Phase  `json:"execute"`
+}
+
+// Ratio returns the cost of compiling a plan in executions of it.
+func (c PlanCost) Ratio() float64 {
+	if c.Execute.NsPerOp == 0 {
+		return 0
+	}
+	return c.Compile.NsPerOp / c.Execute.NsPerOp
+}
+
+// PlanConfig configures shape plan measurements.
+type PlanConfig struct {
+	Fonts        []string
+	Backends     []string // default: "go"
+	Scripts      []string // default: all of ScriptSamples
+	Size         float32  // default: 12
+	Features     string
+	Compilations int    // number of plans compiled, default: 100
+	Benchtime    string // for executions, default: "1s"
+}
+
+// RunPlanCosts measures the cost of shape plan compilation and execution for
+// every font, backend and script configured.
+func RunPlanCosts(cfg PlanConfig, progress func(PlanCost)) ([]PlanCost, error) {
+	if len(cfg.Backends) == 0 {
+		cfg.Backends = []string{"go"}
+	}
+	if cfg.Size == 0 {
+		cfg.Size = 12
+	}
+	if cfg.Compilations == 0 {
+		cfg.Compilations = 100
+	}
+	if cfg.Benchtime == "" {
+		cfg.Benchtime = "1s"
+	}
+	samples := ScriptSamples
+	if len(cfg.Scripts) > 0 {
+		samples = nil
+		for _, script := range cfg.Scripts {
+			found := false
+			for _, s := range ScriptSamples {
+				if s.Script == script {
+					samples, found = append(samples, s), true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("no sample text for script %q", script)
+			}
+		}
+	}
+	benchtimeMx.Lock()
+	defer benchtimeMx.Unlock()
+	var costs []PlanCost
+	for _, name := range cfg.Fonts {
+		face, err := LoadFace(name)
+		if err != nil {
+			return costs, err
+		}
+		for _, backend := range cfg.Backends {
+			b, err := lookupBackend(backend)
+			if err != nil {
+				return costs, err
+			}
+			planner, ok := b.(Planner)
+			if !ok {
+				return costs, fmt.Errorf("backend %q does not support shape plan measurements", backend)
+			}
+			for _, sample := range samples {
+				tracer().Infof("shape plans %s/%s/%s", backend, name, sample.Script)
+				c, err := planCost(planner, face, sample, cfg)
+				if err != nil {
+					return costs, fmt.Errorf("%s/%s/%s: %w", backend, name, sample.Script, err)
+				}
+				c.Backend, c.Font = backend, name
+				costs = append(costs, c)
+				if progress != nil {
+					progress(c)
+				}
+			}
+		}
+	}
+	return costs, nil
+}
+
+func planCost(planner Planner, face *harfbuzzgoperf.Face, sample ScriptSample, cfg PlanConfig) (PlanCost, error) {
+	c := PlanCost{Script: sample.Script}
+	run, err := planner.PlanShaping(face, cfg.Size, cfg.Features, []rune(sample.Text))
+	if err != nil {
+		return c, err
+	}
+	if run.Free != nil {
+		defer run.Free()
+	}
+	if err = run.Execute(); err != nil { // compile the plan executed
+		return c, err
+	}
+	measure := func(benchtime string, f func() error) (Phase, error) {
+		if err := setBenchtime(benchtime); err != nil {
+			return Phase{}, err
+		}
+		var err error
+		p := phase(testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if e := f(); e != nil {
+					err = e
+					b.FailNow()
+				}
+			}
+		}))
+		return p, err
+	}
+	if c.Compile, err = measure(fmt.Sprintf("%dx", cfg.Compilations), run.Compile); err != nil {
+		return c, err
+	}
+	c.Execute, err = measure(cfg.Benchtime, run.Execute)
+	return c, err
+}
+
+// WritePlanTable writes shape plan costs as a table.
+func WritePlanTable(w io.Writer, costs []PlanCost) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "backend/font/script\tcompile\tallocs\texecute\tallocs\tcompile/execute\t\n")
+	for _, c := range costs {
+		fmt.Fprintf(tw, "%s/%s/%s\t%s\t%d\t%s\t%d\t%.1fx\t\n", c.Backend, c.Font, c.Script,
+			fmtNs(c.Compile.NsPerOp), c.Compile.AllocsPerOp, fmtNs(c.Execute.NsPerOp), c.Execute.AllocsPerOp,
+			c.Ratio())
+	}
+	return tw.Flush()
+}
+
+// --- Go backend ------------------------------------------------------------
+
+// PlanShaping executes plans with the shared font instance of face. textlayout
+// caches plans per face for the lifetime of the process, therefore plans are
+// compiled for a private face, parsed once, and with a distinct private-use
+// language tag each time.
+//
+// Plans compiled are never released: each of them stays in textlayout's plan
+// cache for the private face, which is searched linearly before compiling. The
+// cost of compilation measured therefore includes a lookup growing with the
+// number of compilations of the benchmark, and memory grows until the process
+// exits.
+func (goBackend) PlanShaping(face *harfbuzzgoperf.Face, size float32, features string, text []rune) (PlanRun, error) {
+	var run PlanRun
+	font, err := hb.FontInstance(nil, face, size, "")
+	if err != nil {
+		return run, err
+	}
+	params := hb.InstanceParams(font)
+	if params.Features, err = goFeatures(features); err != nil {
+		return run, err
+	}
+	plan, err := hb.NewShapePlan(text, params)
+	if err != nil {
+		return run, err
+	}
+	private, err := tt.Parse(bytes.NewReader(face.Binary), true)
+	if err != nil {
+		return run, err
+	}
+	fresh := *params
+	fresh.Font = &harfbuzzgoperf.HBFont{Binary: face.Binary, GoFont: gohb.NewFont(private), Size: size}
+	fresh.Font.GoFont.Ptem = size
+	compiled := hb.ShapePlan{Params: &fresh, Props: plan.Props}
+	count := 0
+	var buf *gohb.Buffer
+	run.Compile = func() error {
+		count++
+		compiled.Props.Language = hblang.NewLanguage(fmt.Sprintf("x-plan%d", count))
+		compiled.Compile()
+		return nil
+	}
+	run.Execute = func() error {
+		buf, err = plan.Execute(text, buf)
+		return err
+	}
+	return run, nil
+}
@@ -0,0 +1,260 @@
+package bench
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// --- Reading pprof profiles ------------------------------------------------
+
+// Profiles written by runtime/pprof are gzip-compressed protocol buffers
+// (see github.com/google/pprof/proto/profile.proto). We decode just the parts
+// needed to attribute sample values to stacks of functions.
+
+// profile is a decoded pprof profile.
+type profile struct {
+	sampleTypes []valueType
+	samples     []profileSample
+}
+
+type valueType struct {
+	typ, unit string
+}
+
+// profileSample is a sample with its stack, the leaf frame first.
+type profileSample struct {
+	stack  []frame
+	values []int64
+}
+
+// frame is a function on a stack. Inlined functions have frames of their own.
+type frame struct {
+	function string
+	file     string
+	line     int64
+}
+
+// valueIndex returns the index of a sample type, or -1.
+func (p *profile) valueIndex(typ string) int {
+	for i, t := range p.sampleTypes {
+		if t.typ == typ {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseProfile decodes a profile as written by runtime/pprof.
+func parseProfile(data []byte) (*profile, error) {
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	}
+	type location struct {
+		functions []uint64
+		lines     []int64
+	}
+	type function struct {
+		name, file int64
+	}
+	type sample struct {
+		locations []uint64
+		values    []int64
+	}
+	var (
+		strs      []string
+		types     [][2]int64
+		samples   []sample
+		locations = make(map[uint64]location)
+		functions = make(map[uint64]function)
+	)
+	err := decodeMessage(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1: // sample_type
+			var t [2]int64
+			err := decodeMessage(b, func(f int, v uint64, _ []byte) error {
+				if f == 1 || f == 2 {
+					t[f-1] = int64(v)
+				}
+				return nil
+			})
+			types = append(types, t)
+			return err
+		case 2: // sample
+			var s sample
+			err := decodeMessage(b, func(f int, v uint64, b []byte) error {
+				switch f {
+				case 1:
+					return decodeRepeated(v, b, func(x uint64) { s.locations = append(s.locations, x) })
+				case 2:
+					return decodeRepeated(v, b, func(x uint64) { s.values = append(s.values, int64(x)) })
+				}
+				return nil
+			})
+			samples = append(samples, s)
+			return err
+		case 4: // location
+			var id uint64
+			var loc location
+			err := decodeMessage(b, func(f int, v uint64, b []byte) error {
+				switch f {
+				case 1:
+					id = v
+				case 4: // line
+					var fn uint64
+					var line int64
+					err := decodeMessage(b, func(f int, v uint64, _ []byte) error {
+						switch f {
+						case 1:
+							fn = v
+						case 2:
+							line = int64(v)
+						}
+						return nil
+					})
+					loc.functions = append(loc.functions, fn)
+					loc.lines = append(loc.lines, line)
+					return err
+				}
+				return nil
+			})
+			locations[id] = loc
+			return err
+		case 5: // function
+			var id uint64
+			var fn function
+			err := decodeMessage(b, func(f int, v uint64, _ []byte) error {
+				switch f {
+				case 1:
+					id = v
+				case 2:
+					fn.name = int64(v)
+				case 4:
+					fn.file = int64(v)
+				}
+				return nil
+			})
+			functions[id] = fn
+			return err
+		case 6: // string_table
+			strs = append(strs, string(b))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	str := func(i int64) string {
+		if i >= 0 && i < int64(len(strs)) {
+			return strs[i]
+		}
+		return ""
+	}
+	p := &profile{}
+	for _, t := range types {
+		p.sampleTypes = append(p.sampleTypes, valueType{str(t[0]), str(t[1])})
+	}
+	for _, s := range samples {
+		ps := profileSample{values: s.values}
+		for _, id := range s.locations {
+			loc := locations[id]
+			for i, fid := range loc.functions {
+				fn := functions[fid]
+				ps.stack = append(ps.stack, frame{str(fn.name), str(fn.file), loc.lines[i]})
+			}
+		}
+		p.samples = append(p.samples, ps)
+	}
+	return p, nil
+}
+
+var errProtobuf = errors.New("malformed profile")
+
+// decodeMessage calls field for every field of a protocol buffer message, with
+// either the value v of a varint or fixed-size field, or the bytes b of a
+// length-delimited field.
+func decodeMessage(data []byte, field func(n int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := decodeVarint(data)
+		if n == 0 {
+			return errProtobuf
+		}
+		data = data[n:]
+		var v uint64
+		var b []byte
+		switch key & 7 {
+		case 0: // varint
+			if v, n = decodeVarint(data); n == 0 {
+				return errProtobuf
+			}
+			data = data[n:]
+		case 1: // 64 bit
+			if len(data) < 8 {
+				return errProtobuf
+			}
+			for i := 7; i >= 0; i-- {
+				v = v<<8 | uint64(data[i])
+			}
+			data = data[8:]
+		case 2: // length-delimited
+			l, n := decodeVarint(data)
+			if n == 0 || uint64(len(data)-n) < l {
+				return errProtobuf
+			}
+			b, data = data[n:n+int(l)], data[n+int(l):]
+		case 5: // 32 bit
+			if len(data) < 4 {
+				return errProtobuf
+			}
+			for i := 3; i >= 0; i-- {
+				v = v<<8 | uint64(data[i])
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("%w: wire type %d", errProtobuf, key&7)
+		}
+		if err := field(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeRepeated decodes a repeated varint field, which is either a single
+// value v or a packed list b.
+func decodeRepeated(v uint64, b []byte, add func(uint64)) error {
+	if b == nil {
+		add(v)
+		return nil
+	}
+	for len(b) > 0 {
+		x, n := decodeVarint(b)
+		if n == 0 {
+			return errProtobuf
+		}
+		add(x)
+		b = b[n:]
+	}
+	return nil
+}
+
+// decodeVarint decodes a varint, returning its value and length, or length 0
+// if data does not start with a varint.
+func decodeVarint(data []byte) (uint64, int) {
+	var x uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		x |= uint64(data[i]&0x7f) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return x, i + 1
+		}
+	}
+	return 0, 0
+}
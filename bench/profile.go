@@ -0,0 +1,306 @@
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// --- Profile summaries -----------------------------------------------------
+
+// Subsystems of textlayout which profile samples are attributed to.
+const (
+	SubsystemCmap          = "cmap lookup"
+	SubsystemNormalization = "normalization"
+	SubsystemGSUB          = "GSUB"
+	SubsystemGPOS          = "GPOS"
+	SubsystemLookups       = "layout lookups" // machinery shared by GSUB and GPOS
+	SubsystemBuffer        = "buffer management"
+	SubsystemComplex       = "complex shapers"
+	SubsystemUnicode       = "unicode properties"
+	SubsystemHarfbuzz      = "harfbuzz (other)"
+	SubsystemFonts         = "font tables (other)"
+	SubsystemAdapter       = "harfbuzzgoperf" // this module's adapter code
+	SubsystemRuntime       = "runtime"
+	SubsystemOther         = "other"
+)
+
+const (
+	textlayoutPrefix = textlayoutModule + "/"
+	adapterPrefix    = "github.com/npillmayer/harfbuzzgoperf"
+)
+
+// subsystem classifies a frame of a stack.
+func subsystem(f frame) string {
+	file := filepath.Base(f.file)
+	name := f.function
+	switch {
+	case !strings.HasPrefix(name, textlayoutPrefix):
+		if strings.HasPrefix(name, "runtime.") {
+			return SubsystemRuntime
+		} else if strings.HasPrefix(name, adapterPrefix) {
+			return SubsystemAdapter
+		}
+		return SubsystemOther
+	case file == "table_cmap.go" || strings.Contains(name, "nominalGlyph") ||
+		strings.Contains(name, "NominalGlyph") || strings.Contains(name, "hasGlyph"):
+		return SubsystemCmap
+	case file == "ot_shape_normalize.go" || strings.Contains(name, "ormaliz") ||
+		strings.Contains(name, "ecompose"):
+		return SubsystemNormalization
+	case file == "ot_layout_gsub.go" || file == "table_gsub.go" || strings.Contains(name, "GSUB") ||
+		strings.Contains(name, "applySubs"):
+		return SubsystemGSUB
+	case file == "ot_layout_gpos.go" || file == "table_gpos.go" || file == "ot_kern.go" ||
+		file == "table_kern.go" || strings.Contains(name, "GPOS"):
+		return SubsystemGPOS
+	case file == "ot_layout_gsubgpos.go" || file == "ot_layout.go" || file == "ot_map.go" ||
+		file == "set_digest.go" || file == "table_layout.go" || file == "table_gdef.go":
+		return SubsystemLookups
+	case file == "buffer.go":
+		return SubsystemBuffer
+	case file == "unicode.go" || strings.HasPrefix(name, textlayoutPrefix+"unicodedata."):
+		return SubsystemUnicode
+	case strings.HasPrefix(name, textlayoutPrefix+"harfbuzz."):
+		if strings.HasPrefix(file, "ot_") && file != "ot_shaper.go" && file != "ot_shape_complex.go" &&
+			file != "ot_shape_fallback.go" && file != "ot_tag.go" && file != "ot_language.go" {
+			return SubsystemComplex // ot_arabic.go, ot_indic.go, …
+		}
+		return SubsystemHarfbuzz
+	}
+	return SubsystemFonts
+}
+
+// attribute returns the subsystem a sample is attributed to: the one of the
+// innermost frame within textlayout, such that e.g. allocations made by buffer
+// methods count as buffer management. Samples outside of textlayout are
+// attributed to the subsystem of their leaf frame.
+func attribute(stack []frame) string {
+	for _, f := range stack {
+		if strings.HasPrefix(f.function, textlayoutPrefix) {
+			return subsystem(f)
+		}
+	}
+	if len(stack) > 0 {
+		return subsystem(stack[0])
+	}
+	return SubsystemOther
+}
+
+// Share is the part of a profile's total attributed to a subsystem.
+type Share struct {
+	Name     string  `json:"name"`
+	Value    int64   `json:"value"`
+	Fraction float64 `json:"fraction"`
+}
+
+// FunctionShare is the part of a profile's total spent in a function, itself
+// (Flat) and including its callees (Cum).
+type FunctionShare struct {
+	Name      string `json:"name"`
+	Subsystem string `json:"subsystem"`
+	Flat      int64  `json:"flat"`
+	Cum       int64  `json:"cum"`
+}
+
+// Breakdown summarizes a CPU or heap profile.
+type Breakdown struct {
+	Unit       string          `json:"unit"` // "nanoseconds" or "bytes"
+	Total      int64           `json:"total"`
+	Subsystems []Share         `json:"subsystems"` // largest first
+	Top        []FunctionShare `json:"top"`        // by flat value, largest first
+}
+
+// String lists the largest subsystems of a breakdown with their shares.
+func (b *Breakdown) String() string {
+	var shares []string
+	for i, s := range b.Subsystems {
+		if i == 4 {
+			shares = append(shares, "…")
+			break
+		}
+		shares = append(shares, fmt.Sprintf("%s %.0f%%", s.Name, s.Fraction*100))
+	}
+	return strings.Join(shares, ", ")
+}
+
+// ProfileSummary summarizes the profiles captured for a scenario.
+type ProfileSummary struct {
+	CPU      *Breakdown `json:"cpu,omitempty"`
+	Heap     *Breakdown `json:"heap,omitempty"` // allocations during the scenario
+	CPUFile  string     `json:"cpu_file,omitempty"`
+	HeapFile string     `json:"heap_file,omitempty"`
+}
+
+// topFunctions is the number of functions listed in a breakdown.
+const topFunctions = 15
+
+// breakdown summarizes values of samples, selected by index.
+func breakdown(samples []profileSample, index int, unit string) *Breakdown {
+	b := &Breakdown{Unit: unit}
+	bySubsystem := make(map[string]int64)
+	flat := make(map[string]int64)
+	cum := make(map[string]int64)
+	for _, s := range samples {
+		if index < 0 || index >= len(s.values) || s.values[index] <= 0 {
+			continue
+		}
+		v := s.values[index]
+		b.Total += v
+		bySubsystem[attribute(s.stack)] += v
+		if len(s.stack) > 0 {
+			flat[s.stack[0].function] += v
+		}
+		seen := make(map[string]bool) // count recursive functions once
+		for _, f := range s.stack {
+			if !seen[f.function] {
+				seen[f.function] = true
+				cum[f.function] += v
+			}
+		}
+	}
+	for name, v := range bySubsystem {
+		b.Subsystems = append(b.Subsystems, Share{Name: name, Value: v, Fraction: float64(v) / float64(b.Total)})
+	}
+	sort.Slice(b.Subsystems, func(i, j int) bool {
+		si, sj := b.Subsystems[i], b.Subsystems[j]
+		return si.Value > sj.Value || si.Value == sj.Value && si.Name < sj.Name
+	})
+	subsystems := make(map[string]string)
+	for _, s := range samples {
+		for _, f := range s.stack {
+			subsystems[f.function] = subsystem(f)
+		}
+	}
+	for name, v := range flat {
+		b.Top = append(b.Top, FunctionShare{Name: name, Subsystem: subsystems[name], Flat: v, Cum: cum[name]})
+	}
+	sort.Slice(b.Top, func(i, j int) bool {
+		ti, tj := b.Top[i], b.Top[j]
+		return ti.Flat > tj.Flat || ti.Flat == tj.Flat && ti.Name < tj.Name
+	})
+	if len(b.Top) > topFunctions {
+		b.Top = b.Top[:topFunctions]
+	}
+	return b
+}
+
+// --- Capturing profiles ----------------------------------------------------
+
+// HeapProfileRate is the sampling rate of allocations recommended for heap
+// profiles. The runtime requires runtime.MemProfileRate to be set once, as
+// early as possible in a program, so programs capturing profiles should set it
+// before running any scenario.
+const HeapProfileRate = 4096
+
+// profileScenario captures a CPU and a heap profile of shaping a corpus, each
+// for the duration of a benchmark sample, writes them to dir and summarizes
+// them. Allocations are sampled at the current runtime.MemProfileRate, see
+// HeapProfileRate.
+func profileScenario(s Scenario, dir string, run func(b *testing.B)) (*ProfileSummary, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	base := filepath.Join(dir, profileName(s))
+	summary := &ProfileSummary{CPUFile: base + ".cpu.pprof", HeapFile: base + ".heap.pprof"}
+	// CPU
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		return nil, err
+	}
+	testing.Benchmark(run)
+	pprof.StopCPUProfile()
+	if err := os.WriteFile(summary.CPUFile, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	p, err := parseProfile(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("CPU profile: %w", err)
+	}
+	summary.CPU = breakdown(p.samples, p.valueIndex("cpu"), "nanoseconds")
+	// heap: the heap profile is cumulative, so take the difference of profiles
+	// before and after the scenario
+	before, _, err := heapProfile()
+	if err != nil {
+		return nil, err
+	}
+	testing.Benchmark(run)
+	after, data, err := heapProfile()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(summary.HeapFile, data, 0644); err != nil {
+		return nil, err
+	}
+	summary.Heap = breakdown(subtractSamples(after, before), after.valueIndex("alloc_space"), "bytes")
+	return summary, nil
+}
+
+// heapProfile returns the current heap profile, decoded and encoded.
+func heapProfile() (*profile, []byte, error) {
+	runtime.GC() // the heap profile is as of the most recent GC
+	var buf bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&buf, 0); err != nil {
+		return nil, nil, err
+	}
+	p, err := parseProfile(buf.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("heap profile: %w", err)
+	}
+	return p, buf.Bytes(), nil
+}
+
+// subtractSamples returns the samples of profile a minus the ones of b, matched
+// by stack.
+func subtractSamples(a, b *profile) []profileSample {
+	type entry struct {
+		stack  []frame
+		values []int64
+	}
+	merge := func(p *profile, sign int64, m map[string]*entry, keys *[]string) {
+		for _, s := range p.samples {
+			var sb strings.Builder
+			for _, f := range s.stack {
+				fmt.Fprintf(&sb, "%s:%d;", f.function, f.line)
+			}
+			k := sb.String()
+			e, ok := m[k]
+			if !ok {
+				e = &entry{stack: s.stack, values: make([]int64, len(s.values))}
+				m[k] = e
+				*keys = append(*keys, k)
+			}
+			for i, v := range s.values {
+				if i < len(e.values) {
+					e.values[i] += sign * v
+				}
+			}
+		}
+	}
+	m := make(map[string]*entry)
+	var keys []string
+	merge(a, 1, m, &keys)
+	merge(b, -1, m, &keys)
+	var diff []profileSample
+	for _, k := range keys {
+		diff = append(diff, profileSample{stack: m[k].stack, values: m[k].values})
+	}
+	return diff
+}
+
+// profileName returns a file name for the profiles of a scenario.
+func profileName(s Scenario) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, s.Name())
+}
@@ -0,0 +1,424 @@
+package bench
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- HTML report -----------------------------------------------------------
+
+// ReportInput is the data an HTML report is generated from.
+type ReportInput struct {
+	Title       string
+	Results     []Result     // current results
+	Environment *Environment // environment the current results were measured in, nil if unknown
+	History     []Baseline   // earlier results, in any order
+}
+
+// WriteHTML writes a self-contained HTML report with charts of time per glyph
+// by script, font and text length, allocations per glyph, and the history of
+// time per glyph over baselines. Charts are inline SVG and the report contains
+// no scripts, such that it may be passed around and viewed offline.
+func WriteHTML(w io.Writer, in ReportInput) error {
+	results := MergeResults(in.Results)
+	history := append([]Baseline(nil), in.History...)
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Created.Before(history[j].Created)
+	})
+	data := struct {
+		Title       string
+		Generated   string
+		Environment *Environment
+		Charts      []template.HTML
+		Comparison  Report
+	}{
+		Title:       in.Title,
+		Generated:   time.Now().Format("2006-01-02 15:04"),
+		Environment: in.Environment,
+		Comparison:  CompareBackends(results, 0.05),
+	}
+	nsPerGlyph := func(r Result) float64 { return medianOf(r.Samples, func(s Sample) float64 { return s.NsPerGlyph }) }
+	bytesPerGlyph := func(r Result) float64 {
+		if r.Glyphs == 0 {
+			return 0
+		}
+		return medianOf(r.Samples, func(s Sample) float64 { return float64(s.BytesPerOp) }) / float64(r.Glyphs)
+	}
+	charts := []chart{
+		groupedChart("Time per glyph by script", "ns/glyph", results,
+			func(r Result) string { return r.Script }, nsPerGlyph),
+		groupedChart("Time per glyph by font", "ns/glyph", results,
+			func(r Result) string { return r.Font }, nsPerGlyph),
+		lengthChart(results),
+		groupedChart("Allocations per glyph by font", "bytes/glyph", results,
+			func(r Result) string { return r.Font }, bytesPerGlyph),
+		historyChart(history, in.Results),
+	}
+	for _, c := range charts {
+		if c != nil && !c.empty() {
+			data.Charts = append(data.Charts, c.svg())
+		}
+	}
+	return reportTemplate.Execute(w, data)
+}
+
+// medianOf returns the median of a value of samples.
+func medianOf(samples []Sample, value func(Sample) float64) float64 {
+	xs := make([]float64, len(samples))
+	for i, s := range samples {
+		xs[i] = value(s)
+	}
+	return Summarize(xs, 1).Median
+}
+
+// geomean returns the geometric mean of positive xs.
+func geomean(xs []float64) float64 {
+	var sum float64
+	n := 0
+	for _, x := range xs {
+		if x > 0 {
+			sum += math.Log(x)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return math.Exp(sum / float64(n))
+}
+
+// backendsOf returns the backends of results in order of first occurrence.
+func backendsOf(results []Result) []string {
+	var backends []string
+	seen := make(map[string]bool)
+	for _, r := range results {
+		if !seen[r.Backend] {
+			seen[r.Backend] = true
+			backends = append(backends, r.Backend)
+		}
+	}
+	return backends
+}
+
+// groupedChart creates a bar chart of the geometric mean of a value of results,
+// grouped by a key, with a series per backend.
+func groupedChart(title, unit string, results []Result, key func(Result) string,
+	value func(Result) float64) chart {
+	//
+	c := &barChart{title: title, unit: unit}
+	values := make(map[string]map[string][]float64) // key → backend → values
+	for _, r := range results {
+		k := key(r)
+		if values[k] == nil {
+			values[k] = make(map[string][]float64)
+			c.categories = append(c.categories, k)
+		}
+		values[k][r.Backend] = append(values[k][r.Backend], value(r))
+	}
+	sort.Strings(c.categories)
+	for _, b := range backendsOf(results) {
+		s := series{name: b}
+		for _, k := range c.categories {
+			s.values = append(s.values, geomean(values[k][b]))
+		}
+		c.series = append(c.series, s)
+	}
+	return c
+}
+
+// lengthChart creates a line chart of time per glyph by the mean paragraph
+// length of corpora.
+func lengthChart(results []Result) chart {
+	type corpus struct {
+		name   string
+		length float64
+	}
+	var corpora []corpus
+	seen := make(map[string]bool)
+	for _, r := range results {
+		if !seen[r.Corpus] && r.Paragraphs > 0 {
+			seen[r.Corpus] = true
+			corpora = append(corpora, corpus{r.Corpus, float64(r.Chars) / float64(r.Paragraphs)})
+		}
+	}
+	sort.SliceStable(corpora, func(i, j int) bool { return corpora[i].length < corpora[j].length })
+	c := &lineChart{title: "Time per glyph by text length", unit: "ns/glyph"}
+	index := make(map[string]int)
+	for i, cp := range corpora {
+		index[cp.name] = i
+		c.categories = append(c.categories, fmt.Sprintf("%.0f chars (%s)", cp.length, cp.name))
+	}
+	for _, b := range backendsOf(results) {
+		values := make([][]float64, len(corpora))
+		for _, r := range results {
+			if i, ok := index[r.Corpus]; ok && r.Backend == b {
+				values[i] = append(values[i], medianOf(r.Samples, func(s Sample) float64 { return s.NsPerGlyph }))
+			}
+		}
+		s := series{name: b}
+		for _, v := range values {
+			s.values = append(s.values, geomean(v))
+		}
+		c.series = append(c.series, s)
+	}
+	return c
+}
+
+// historyChart creates a line chart of the geometric mean of time per glyph of
+// every backend over baselines, followed by the current results.
+func historyChart(history []Baseline, current []Result) chart {
+	type point struct {
+		label   string
+		results []Result
+	}
+	var points []point
+	for _, b := range history {
+		label := b.Created.Format("2006-01-02")
+		if v := b.Environment.TextlayoutVersion; v != "" && v != "unknown" {
+			label += " " + v
+		}
+		points = append(points, point{label, MergeResults(b.Results)})
+	}
+	if len(current) > 0 {
+		points = append(points, point{"current", MergeResults(current)})
+	}
+	if len(points) < 2 {
+		return nil
+	}
+	c := &lineChart{title: "History of time per glyph", unit: "ns/glyph"}
+	var all []Result
+	for _, p := range points {
+		c.categories = append(c.categories, p.label)
+		all = append(all, p.results...)
+	}
+	for _, b := range backendsOf(all) {
+		s := series{name: b}
+		for _, p := range points {
+			var v []float64
+			for _, r := range p.results {
+				if r.Backend == b {
+					v = append(v, medianOf(r.Samples, func(s Sample) float64 { return s.NsPerGlyph }))
+				}
+			}
+			s.values = append(s.values, geomean(v))
+		}
+		c.series = append(c.series, s)
+	}
+	return c
+}
+
+// --- SVG charts ------------------------------------------------------------
+
+type chart interface {
+	svg() template.HTML
+	empty() bool
+}
+
+// series is a named row of values, one per category; 0 is a missing value.
+type series struct {
+	name   string
+	values []float64
+}
+
+const (
+	chartWidth   = 720
+	chartHeight  = 320
+	chartLeft    = 70  // space for the y-axis
+	chartBottom  = 60  // space for category labels
+	chartTop     = 40  // space for the title
+	chartRight   = 110 // space for the legend
+	chartPlotW   = chartWidth - chartLeft - chartRight
+	chartPlotH   = chartHeight - chartTop - chartBottom
+	chartTickCnt = 5
+)
+
+var seriesColors = []string{"#00add8", "#ce3262", "#5dc9e2", "#fddd00", "#555555"}
+
+// axis holds the scale of a chart's y-axis.
+type axis struct {
+	max, step float64
+}
+
+// niceAxis returns a y-axis from 0 to a round number not less than max.
+func niceAxis(max float64) axis {
+	if max <= 0 {
+		return axis{1, 1.0 / chartTickCnt}
+	}
+	raw := max / chartTickCnt
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	step := mag
+	for _, f := range []float64{1, 2, 2.5, 5, 10} {
+		if step = f * mag; step >= raw {
+			break
+		}
+	}
+	return axis{step * math.Ceil(max/step), step}
+}
+
+func (a axis) y(v float64) float64 {
+	return chartTop + chartPlotH*(1-v/a.max)
+}
+
+// drawFrame writes the title, y-axis with grid lines, category labels and legend.
+func drawFrame(sb *strings.Builder, title, unit string, categories []string, all []series) axis {
+	var max float64
+	for _, s := range all {
+		for _, v := range s.values {
+			max = math.Max(max, v)
+		}
+	}
+	a := niceAxis(max)
+	fmt.Fprintf(sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`,
+		chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(sb, `<text x="%d" y="20" font-size="14" font-weight="bold">%s</text>`, chartLeft, html.EscapeString(title))
+	for v := 0.0; v <= a.max+a.step/2; v += a.step {
+		y := a.y(v)
+		fmt.Fprintf(sb, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`, chartLeft, y, chartLeft+chartPlotW, y)
+		fmt.Fprintf(sb, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, chartLeft-6, y+4, fmtValue(v))
+	}
+	fmt.Fprintf(sb, `<text transform="translate(14,%d) rotate(-90)" text-anchor="middle">%s</text>`,
+		chartTop+chartPlotH/2, html.EscapeString(unit))
+	bw := float64(chartPlotW) / float64(len(categories))
+	for i, c := range categories {
+		x := chartLeft + bw*(float64(i)+0.5)
+		fmt.Fprintf(sb, `<text x="%.1f" y="%d" text-anchor="end" transform="rotate(-25 %.1f %d)">%s</text>`,
+			x, chartTop+chartPlotH+16, x, chartTop+chartPlotH+16, html.EscapeString(c))
+	}
+	for i, s := range all {
+		y := chartTop + 10 + 18*i
+		fmt.Fprintf(sb, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, chartLeft+chartPlotW+16, y, seriesColor(i))
+		fmt.Fprintf(sb, `<text x="%d" y="%d">%s</text>`, chartLeft+chartPlotW+34, y+10, html.EscapeString(s.name))
+	}
+	fmt.Fprintf(sb, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#333"/>`,
+		chartLeft, chartTop+chartPlotH, chartLeft+chartPlotW, chartTop+chartPlotH)
+	return a
+}
+
+func seriesColor(i int) string {
+	return seriesColors[i%len(seriesColors)]
+}
+
+func fmtValue(v float64) string {
+	if v >= 1000 {
+		return fmt.Sprintf("%.0fk", v/1000)
+	}
+	return fmt.Sprintf("%g", math.Round(v*100)/100)
+}
+
+// barChart is a chart of grouped bars, a group per category.
+type barChart struct {
+	title, unit string
+	categories  []string
+	series      []series
+}
+
+func (c *barChart) empty() bool {
+	return len(c.categories) == 0 || len(c.series) == 0
+}
+
+func (c *barChart) svg() template.HTML {
+	var sb strings.Builder
+	a := drawFrame(&sb, c.title, c.unit, c.categories, c.series)
+	gw := float64(chartPlotW) / float64(len(c.categories))
+	bw := gw * 0.8 / float64(len(c.series))
+	for i := range c.categories {
+		for j, s := range c.series {
+			v := s.values[i]
+			if v <= 0 {
+				continue
+			}
+			x := chartLeft + gw*float64(i) + gw*0.1 + bw*float64(j)
+			y := a.y(v)
+			fmt.Fprintf(&sb, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s: %.2f</title></rect>`,
+				x, y, bw, chartTop+chartPlotH-y, seriesColor(j), html.EscapeString(s.name), v)
+		}
+	}
+	sb.WriteString("</svg>")
+	return template.HTML(sb.String())
+}
+
+// lineChart is a chart of lines over categories.
+type lineChart struct {
+	title, unit string
+	categories  []string
+	series      []series
+}
+
+func (c *lineChart) empty() bool {
+	return len(c.categories) == 0 || len(c.series) == 0
+}
+
+func (c *lineChart) svg() template.HTML {
+	var sb strings.Builder
+	a := drawFrame(&sb, c.title, c.unit, c.categories, c.series)
+	gw := float64(chartPlotW) / float64(len(c.categories))
+	for j, s := range c.series {
+		var points []string
+		for i, v := range s.values {
+			if v <= 0 {
+				continue
+			}
+			x, y := chartLeft+gw*(float64(i)+0.5), a.y(v)
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+			fmt.Fprintf(&sb, `<circle cx="%.1f" cy="%.1f" r="3.5" fill="%s"><title>%s: %.2f</title></circle>`,
+				x, y, seriesColor(j), html.EscapeString(s.name), v)
+		}
+		if len(points) > 1 {
+			fmt.Fprintf(&sb, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`,
+				strings.Join(points, " "), seriesColor(j))
+		}
+	}
+	sb.WriteString("</svg>")
+	return template.HTML(sb.String())
+}
+
+// --- Template --------------------------------------------------------------
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"ns":      fmtNs,
+	"ratio":   func(x float64) string { return fmt.Sprintf("%.2f×", x) },
+	"percent": func(x float64) string { return fmt.Sprintf("%.0f%%", x*100) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.sig { font-weight: bold; }
+.env td { text-align: left; }
+figure { margin: 2em 0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}}.</p>
+{{with .Environment}}<table class="env">
+<tr><td>Go</td><td>{{.GoVersion}}</td></tr>
+<tr><td>textlayout</td><td>{{.TextlayoutVersion}}</td></tr>
+{{if .HarfbuzzVersion}}<tr><td>Harfbuzz</td><td>{{.HarfbuzzVersion}}</td></tr>{{end}}
+<tr><td>CPU</td><td>{{.CPU}} ({{.NumCPU}} cores, {{.OS}}/{{.Arch}})</td></tr>
+</table>{{else}}<p>Environment of the results unknown.</p>{{end}}
+{{range .Charts}}<figure>{{.}}</figure>
+{{end}}
+{{with .Comparison.Comparisons}}
+<h2>Go vs. C</h2>
+<table>
+<tr><th>scenario</th><th>script</th><th>go</th><th>c</th><th>go/c</th><th>p</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Script}}</td><td>{{ns .Go.Median}}</td><td>{{ns .C.Median}}</td>
+<td{{if .Significant}} class="sig"{{end}}>{{if .Significant}}{{ratio .Ratio}}{{else}}~{{end}}</td><td>{{printf "%.3f" .P}}</td></tr>
+{{end}}</table>
+<p>Median time per operation; ratios which are not significant at level {{percent $.Comparison.Alpha}} are shown as ~.</p>
+{{end}}
+</body>
+</html>
+`))
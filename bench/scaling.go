@@ -0,0 +1,295 @@
+package bench
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"text/tabwriter"
+	"time"
+)
+
+// --- Generated inputs ------------------------------------------------------
+
+// Generator generates texts of a given length in characters.
+type Generator struct {
+	Name        string
+	Description string
+	Generate    func(n int) []rune
+}
+
+// Generators are the inputs for scaling benchmarks.
+var Generators = []Generator{
+	{"words", "short words separated by spaces", func(n int) []rune {
+		return cycle([]rune("a be cat dogs in the fox on it "), n)
+	}},
+	{"line", "running text as a single line", func(n int) []rune {
+		return cycle([]rune(strings.Join(corpusLatin(), " ")+" "), n)
+	}},
+	{"marks", "a single cluster: a base character followed by combining marks", func(n int) []rune {
+		text := make([]rune, n)
+		for i := range text {
+			if i == 0 {
+				text[i] = 'a'
+			} else {
+				text[i] = 0x0300 + rune(i%0x30) // combining diacritical marks
+			}
+		}
+		return text
+	}},
+	{"nobreak", "letters without any break opportunity", func(n int) []rune {
+		return cycle([]rune("abcdefghijklmnopqrstuvwxyz"), n)
+	}},
+}
+
+// lookupGenerator returns a generator by name.
+func lookupGenerator(name string) (Generator, error) {
+	for _, g := range Generators {
+		if g.Name == name {
+			return g, nil
+		}
+	}
+	return Generator{}, fmt.Errorf("unknown generator %q", name)
+}
+
+// cycle repeats pattern up to a length of n.
+func cycle(pattern []rune, n int) []rune {
+	text := make([]rune, n)
+	for i := range text {
+		text[i] = pattern[i%len(pattern)]
+	}
+	return text
+}
+
+// corpusLatin returns the paragraphs of the built-in corpus in Latin script.
+func corpusLatin() []string {
+	corpus, _ := LoadCorpus(BuiltinCorpus)
+	var paragraphs []string
+	for _, p := range corpus {
+		if corpusScript([][]rune{p}) == "Latn" {
+			paragraphs = append(paragraphs, string(p))
+		}
+	}
+	if len(paragraphs) == 0 {
+		return []string{"The quick brown fox jumps over the lazy dog."}
+	}
+	return paragraphs
+}
+
+// --- Scaling benchmarks ----------------------------------------------------
+
+// ScalingConfig configures scaling benchmarks.
+type ScalingConfig struct {
+	Font       string
+	Size       float32
+	Backends   []string      // default: "go"
+	Generators []string      // default: all
+	Lengths    []int         // default: 1, 10, …, 100000
+	Benchtime  string        // per length, default "200ms"
+	MaxOpTime  time.Duration // stop a curve after an operation takes longer, default 10s
+	Exponent   float64       // growth exponent considered super-linear, default 1.2
+}
+
+// ScalingPoint is the measurement of shaping a text of a given length.
+type ScalingPoint struct {
+	Length      int     `json:"length"`
+	NsPerOp     float64 `json:"ns_op"`
+	NsPerChar   float64 `json:"ns_char"`
+	AllocsPerOp int64   `json:"allocs_op"`
+	BytesPerOp  int64   `json:"bytes_op"`
+}
+
+// ScalingCurve is the cost of shaping generated texts of increasing length.
+// Exponents are the slopes of a least squares fit of cost over length on a
+// log-log scale, i.e. 1 for linear and 2 for quadratic growth.
+type ScalingCurve struct {
+	Backend       string         `json:"backend"`
+	Font          string         `json:"font"`
+	Generator     string         `json:"generator"`
+	Points        []ScalingPoint `json:"points"`
+	TimeExponent  float64        `json:"time_exponent"`
+	AllocExponent float64        `json:"alloc_exponent"`
+	SuperLinear   bool           `json:"super_linear"`
+	Truncated     bool           `json:"truncated,omitempty"` // stopped after exceeding MaxOpTime
+}
+
+// fitFrom is the minimum length of points used for fitting exponents, as the
+// cost of shorter texts is dominated by constant overhead.
+const fitFrom = 100
+
+// RunScaling measures the cost of shaping generated texts of increasing length
+// for every backend and generator configured.
+func RunScaling(cfg ScalingConfig, progress func(ScalingCurve)) ([]ScalingCurve, error) {
+	if len(cfg.Backends) == 0 {
+		cfg.Backends = []string{"go"}
+	}
+	if len(cfg.Generators) == 0 {
+		for _, g := range Generators {
+			cfg.Generators = append(cfg.Generators, g.Name)
+		}
+	}
+	if len(cfg.Lengths) == 0 {
+		cfg.Lengths = []int{1, 10, 100, 1000, 10000, 100000}
+	}
+	if cfg.Size == 0 {
+		cfg.Size = 12
+	}
+	if cfg.Benchtime == "" {
+		cfg.Benchtime = "200ms"
+	}
+	if cfg.MaxOpTime == 0 {
+		cfg.MaxOpTime = 10 * time.Second
+	}
+	if cfg.Exponent == 0 {
+		cfg.Exponent = 1.2
+	}
+	face, err := LoadFace(cfg.Font)
+	if err != nil {
+		return nil, err
+	}
+	benchtimeMx.Lock()
+	defer benchtimeMx.Unlock()
+	if err = setBenchtime(cfg.Benchtime); err != nil {
+		return nil, err
+	}
+	var curves []ScalingCurve
+	for _, name := range cfg.Generators {
+		g, err := lookupGenerator(name)
+		if err != nil {
+			return curves, err
+		}
+		for _, backend := range cfg.Backends {
+			b, err := lookupBackend(backend)
+			if err != nil {
+				return curves, err
+			}
+			shaper, err := b.Shaper(face, cfg.Size, "")
+			if err != nil {
+				return curves, err
+			}
+			defer freeShaper(shaper)
+			curve := ScalingCurve{Backend: backend, Font: cfg.Font, Generator: g.Name}
+			tracer().Infof("scaling %s/%s", backend, g.Name)
+			for _, n := range cfg.Lengths {
+				text := g.Generate(n)
+				start := time.Now()
+				if _, err = shaper.Shape(text); err != nil {
+					return curves, fmt.Errorf("%s/%s/%d: %w", backend, g.Name, n, err)
+				}
+				if time.Since(start) > cfg.MaxOpTime {
+					curve.Truncated = true
+					break
+				}
+				r := testing.Benchmark(func(b *testing.B) {
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						shaper.Shape(text)
+					}
+				})
+				if r.N == 0 {
+					return curves, fmt.Errorf("benchmark %s/%s/%d failed", backend, g.Name, n)
+				}
+				ns := float64(r.T.Nanoseconds()) / float64(r.N)
+				curve.Points = append(curve.Points, ScalingPoint{
+					Length:      n,
+					NsPerOp:     ns,
+					NsPerChar:   ns / float64(n),
+					AllocsPerOp: r.AllocsPerOp(),
+					BytesPerOp:  r.AllocedBytesPerOp(),
+				})
+			}
+			curve.TimeExponent = growthExponent(curve.Points, func(p ScalingPoint) float64 { return p.NsPerOp })
+			curve.AllocExponent = growthExponent(curve.Points, func(p ScalingPoint) float64 { return float64(p.BytesPerOp) })
+			curve.SuperLinear = curve.Truncated || curve.TimeExponent > cfg.Exponent ||
+				curve.AllocExponent > cfg.Exponent
+			curves = append(curves, curve)
+			if progress != nil {
+				progress(curve)
+			}
+		}
+	}
+	return curves, nil
+}
+
+// growthExponent fits cost = c·length^k to points of length ≥ fitFrom, by least
+// squares on a log-log scale, and returns k, or 0 if there are less than two
+// such points.
+func growthExponent(points []ScalingPoint, cost func(ScalingPoint) float64) float64 {
+	var xs, ys []float64
+	for _, p := range points {
+		if c := cost(p); p.Length >= fitFrom && c > 0 {
+			xs = append(xs, math.Log(float64(p.Length)))
+			ys = append(ys, math.Log(c))
+		}
+	}
+	n := float64(len(xs))
+	if n < 2 {
+		return 0
+	}
+	var sx, sy, sxx, sxy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		sxy += xs[i] * ys[i]
+	}
+	if d := n*sxx - sx*sx; d != 0 {
+		return (n*sxy - sx*sy) / d
+	}
+	return 0
+}
+
+// SuperLinear returns the curves showing super-linear growth.
+func SuperLinear(curves []ScalingCurve) []ScalingCurve {
+	var found []ScalingCurve
+	for _, c := range curves {
+		if c.SuperLinear {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// WriteScalingTable writes scaling curves as a table of ns/char and bytes/op
+// per length.
+func WriteScalingTable(w io.Writer, curves []ScalingCurve) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "curve\tlength\tns/op\tns/char\tallocs/op\tbytes/op\t\n")
+	for _, c := range curves {
+		name := c.Backend + "/" + c.Generator
+		for _, p := range c.Points {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%.1f\t%d\t%d\t\n", name, p.Length, fmtNs(p.NsPerOp),
+				p.NsPerChar, p.AllocsPerOp, p.BytesPerOp)
+			name = ""
+		}
+		verdict := "linear"
+		if c.SuperLinear {
+			verdict = "SUPER-LINEAR"
+		}
+		if c.Truncated {
+			verdict += " (truncated)"
+		}
+		fmt.Fprintf(tw, "\ttime ~ n^%.2f\t\talloc ~ n^%.2f\t\t%s\t\n", c.TimeExponent, c.AllocExponent, verdict)
+	}
+	return tw.Flush()
+}
+
+// WriteScalingCSV writes scaling curves as CSV, one row per point.
+func WriteScalingCSV(w io.Writer, curves []ScalingCurve) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"backend", "font", "generator", "length", "ns_op", "ns_char", "allocs_op", "bytes_op"})
+	for _, c := range curves {
+		for _, p := range c.Points {
+			cw.Write([]string{
+				c.Backend, c.Font, c.Generator, strconv.Itoa(p.Length),
+				strconv.FormatFloat(p.NsPerOp, 'f', 2, 64), strconv.FormatFloat(p.NsPerChar, 'f', 2, 64),
+				strconv.FormatInt(p.AllocsPerOp, 10), strconv.FormatInt(p.BytesPerOp, 10),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,365 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+)
+
+// --- Summaries -------------------------------------------------------------
+
+// Summary summarizes a set of samples by their median and a confidence
+// interval for the median.
+type Summary struct {
+	N          int     `json:"n"`
+	Median     float64 `json:"median"`
+	Low        float64 `json:"low"`        // lower bound of the confidence interval
+	High       float64 `json:"high"`       // upper bound of the confidence interval
+	Confidence float64 `json:"confidence"` // actual confidence level of [Low,High]
+}
+
+// Summarize computes the median of xs and a distribution-free confidence
+// interval for it, derived from order statistics. The interval is the
+// narrowest one with a confidence level of at least 1-alpha. For small sample
+// sizes no such interval exists; then the interval is the range of xs, and
+// Confidence reports the lower level actually reached.
+func Summarize(xs []float64, alpha float64) Summary {
+	n := len(xs)
+	if n == 0 {
+		return Summary{}
+	}
+	sorted := append([]float64(nil), xs...)
+	sort.Float64s(sorted)
+	s := Summary{N: n}
+	if n%2 == 1 {
+		s.Median = sorted[n/2]
+	} else {
+		s.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	// the interval [x(k), x(n-1-k)] (0-based) misses the median with
+	// probability 2·P(B ≤ k) for B ~ Binomial(n, ½)
+	k, cdf := 0, binomialCDF(n, 0)
+	for k+1 < n-1-(k+1) {
+		next := binomialCDF(n, k+1)
+		if 2*next > alpha {
+			break
+		}
+		k, cdf = k+1, next
+	}
+	s.Low, s.High = sorted[k], sorted[n-1-k]
+	s.Confidence = 1 - 2*cdf
+	return s
+}
+
+// binomialCDF returns P(B ≤ k) for B ~ Binomial(n, ½).
+func binomialCDF(n, k int) float64 {
+	p, c := 0.0, 1.0 // c is n choose i
+	for i := 0; i <= k && i <= n; i++ {
+		p += c
+		c = c * float64(n-i) / float64(i+1)
+	}
+	return p / math.Pow(2, float64(n))
+}
+
+// --- Significance ----------------------------------------------------------
+
+// MannWhitney performs a two-sided Mann-Whitney U test of samples x and y and
+// returns the U statistic of x and the p-value for the hypothesis that both
+// samples are drawn from the same distribution. Without ties and for small
+// samples the p-value is exact; otherwise the normal approximation with tie
+// and continuity correction is used.
+func MannWhitney(x, y []float64) (u, p float64) {
+	n1, n2 := len(x), len(y)
+	if n1 == 0 || n2 == 0 {
+		return 0, 1
+	}
+	type obs struct {
+		v float64
+		x bool
+	}
+	all := make([]obs, 0, n1+n2)
+	for _, v := range x {
+		all = append(all, obs{v, true})
+	}
+	for _, v := range y {
+		all = append(all, obs{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+	var rankSum, tieTerm float64
+	ties := false
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // mean of 1-based ranks i+1 … j
+		for k := i; k < j; k++ {
+			if all[k].x {
+				rankSum += rank
+			}
+		}
+		if t := float64(j - i); t > 1 {
+			ties = true
+			tieTerm += t*t*t - t
+		}
+		i = j
+	}
+	u = rankSum - float64(n1*(n1+1))/2
+	if !ties && n1+n2 <= 50 {
+		return u, exactMannWhitney(n1, n2, u)
+	}
+	n, mean := float64(n1+n2), float64(n1*n2)/2
+	sigma := math.Sqrt(float64(n1*n2) / 12 * ((n + 1) - tieTerm/(n*(n-1))))
+	if sigma == 0 {
+		return u, 1
+	}
+	z := (math.Abs(u-mean) - 0.5) / sigma
+	if z < 0 {
+		z = 0
+	}
+	return u, math.Min(1, math.Erfc(z/math.Sqrt2))
+}
+
+// exactMannWhitney returns the two-sided p-value of U = u for sample sizes n1
+// and n2, from the exact distribution of U without ties.
+func exactMannWhitney(n1, n2 int, u float64) float64 {
+	// counts[i][j][v] is the number of orderings of i x-values and j y-values
+	// with U = v; only the layer for the current i is kept
+	maxU := n1 * n2
+	prev := make([][]float64, n2+1)
+	for j := range prev {
+		prev[j] = make([]float64, maxU+1)
+		prev[j][0] = 1 // no x-values: U = 0
+	}
+	for i := 1; i <= n1; i++ {
+		cur := make([][]float64, n2+1)
+		for j := range cur {
+			cur[j] = make([]float64, maxU+1)
+			for v := 0; v <= i*j; v++ {
+				// the largest value is either an x (greater than all j y-values)…
+				if v >= j {
+					cur[j][v] += prev[j][v-j]
+				}
+				// …or a y
+				if j > 0 {
+					cur[j][v] += cur[j-1][v]
+				}
+			}
+		}
+		prev = cur
+	}
+	dist := prev[n2]
+	var total, lower, upper float64
+	for v, c := range dist {
+		total += c
+		if float64(v) <= u {
+			lower += c
+		}
+		if float64(v) >= u {
+			upper += c
+		}
+	}
+	return math.Min(1, 2*math.Min(lower, upper)/total)
+}
+
+// --- Backend comparison ----------------------------------------------------
+
+// Comparison compares the Go and the C backend for a scenario.
+type Comparison struct {
+	Font        string  `json:"font"`
+	Script      string  `json:"script"`
+	Corpus      string  `json:"corpus"`
+	Features    string  `json:"features"`
+	Size        float32 `json:"size"`
+	Go          Summary `json:"go"` // ns/op of the Go backend
+	C           Summary `json:"c"`  // ns/op of the C backend
+	Ratio       float64 `json:"ratio"`
+	P           float64 `json:"p"`
+	Significant bool    `json:"significant"`
+}
+
+// Name returns a name for the scenario compared.
+func (c Comparison) Name() string {
+	features := c.Features
+	if features == "" {
+		features = "default"
+	}
+	return fmt.Sprintf("%s/%s/%s/%gpt", c.Font, c.Corpus, features, c.Size)
+}
+
+// GroupRatio is the geometric mean of Go/C ratios of a group of comparisons.
+type GroupRatio struct {
+	Name  string  `json:"name"`
+	Ratio float64 `json:"ratio"`
+	N     int     `json:"n"`
+}
+
+// Report is the comparison of the Go and the C backend over a set of results.
+type Report struct {
+	Alpha       float64      `json:"alpha"`
+	Comparisons []Comparison `json:"comparisons"`
+	Fonts       []GroupRatio `json:"fonts"`
+	Scripts     []GroupRatio `json:"scripts"`
+	Corpora     []GroupRatio `json:"corpora"`
+}
+
+// MergeResults merges the samples of results for identical scenarios, e.g.
+// from several runs of hbbench. The order of first occurrence is kept.
+func MergeResults(results []Result) []Result {
+	var merged []Result
+	index := make(map[Scenario]int)
+	for _, r := range results {
+		if i, ok := index[r.Scenario]; ok {
+			merged[i].Samples = append(merged[i].Samples, r.Samples...)
+			continue
+		}
+		index[r.Scenario] = len(merged)
+		r.Samples = append([]Sample(nil), r.Samples...)
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// CompareBackends compares ns/op of the Go and the C backend for every scenario
+// measured with both. A Go/C ratio is significant if the Mann-Whitney p-value
+// is below alpha. Ratios are aggregated per font, script and corpus by their
+// geometric mean.
+func CompareBackends(results []Result, alpha float64) Report {
+	results = MergeResults(results)
+	report := Report{Alpha: alpha}
+	c := make(map[Scenario]Result)
+	for _, r := range results {
+		if r.Backend == "c" {
+			s := r.Scenario
+			s.Backend = ""
+			c[s] = r
+		}
+	}
+	for _, r := range results {
+		if r.Backend != "go" {
+			continue
+		}
+		s := r.Scenario
+		s.Backend = ""
+		rc, ok := c[s]
+		if !ok {
+			tracer().Infof("no C results for %s", r.Name())
+			continue
+		}
+		x, y := nsPerOp(r.Samples), nsPerOp(rc.Samples)
+		cmp := Comparison{
+			Font:     s.Font,
+			Script:   r.Script,
+			Corpus:   s.Corpus,
+			Features: s.Features,
+			Size:     s.Size,
+			Go:       Summarize(x, alpha),
+			C:        Summarize(y, alpha),
+		}
+		if cmp.C.Median > 0 {
+			cmp.Ratio = cmp.Go.Median / cmp.C.Median
+		}
+		_, cmp.P = MannWhitney(x, y)
+		cmp.Significant = cmp.P < alpha
+		report.Comparisons = append(report.Comparisons, cmp)
+	}
+	report.Fonts = groupRatios(report.Comparisons, func(c Comparison) string { return c.Font })
+	report.Scripts = groupRatios(report.Comparisons, func(c Comparison) string { return c.Script })
+	report.Corpora = groupRatios(report.Comparisons, func(c Comparison) string { return c.Corpus })
+	return report
+}
+
+func nsPerOp(samples []Sample) []float64 {
+	xs := make([]float64, len(samples))
+	for i, s := range samples {
+		xs[i] = s.NsPerOp
+	}
+	return xs
+}
+
+func groupRatios(cmps []Comparison, key func(Comparison) string) []GroupRatio {
+	logs := make(map[string][]float64)
+	for _, c := range cmps {
+		if c.Ratio > 0 {
+			k := key(c)
+			logs[k] = append(logs[k], math.Log(c.Ratio))
+		}
+	}
+	var groups []GroupRatio
+	for _, name := range sortedKeys(logs) {
+		var sum float64
+		for _, l := range logs[name] {
+			sum += l
+		}
+		n := len(logs[name])
+		groups = append(groups, GroupRatio{Name: name, Ratio: math.Exp(sum / float64(n)), N: n})
+	}
+	return groups
+}
+
+func sortedKeys(m map[string][]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteTable writes a report as a table. Ratios which are not significant are
+// marked by '~', as benchstat does.
+func WriteTable(w io.Writer, report Report) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "scenario\tscript\tgo ns/op\t\tc ns/op\t\tgo/c\tp\t\n")
+	for _, c := range report.Comparisons {
+		ratio := "~"
+		if c.Significant {
+			ratio = fmt.Sprintf("%.2fx", c.Ratio)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.3f\t\n", c.Name(), c.Script,
+			fmtNs(c.Go.Median), fmtCI(c.Go), fmtNs(c.C.Median), fmtCI(c.C), ratio, c.P)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, g := range []struct {
+		title  string
+		groups []GroupRatio
+	}{{"font", report.Fonts}, {"script", report.Scripts}, {"corpus", report.Corpora}} {
+		if len(g.groups) == 0 {
+			continue
+		}
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(tw, "\n%s\tn\tgo/c (geomean)\t\n", g.title)
+		for _, r := range g.groups {
+			fmt.Fprintf(tw, "%s\t%d\t%.2fx\t\n", r.Name, r.N, r.Ratio)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fmtNs(ns float64) string {
+	switch {
+	case ns >= 1e9:
+		return fmt.Sprintf("%.2fs", ns/1e9)
+	case ns >= 1e6:
+		return fmt.Sprintf("%.2fms", ns/1e6)
+	case ns >= 1e3:
+		return fmt.Sprintf("%.2fµs", ns/1e3)
+	}
+	return fmt.Sprintf("%.0fns", ns)
+}
+
+// fmtCI formats the confidence interval of s relative to its median.
+func fmtCI(s Summary) string {
+	if s.Median == 0 {
+		return ""
+	}
+	low, high := (s.Low/s.Median-1)*100, (s.High/s.Median-1)*100
+	return fmt.Sprintf("%+.0f%% %+.0f%%", low, high)
+}
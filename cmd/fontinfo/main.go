@@ -0,0 +1,106 @@
+/*
+Command fontinfo prints what a font supports: names, units per em, glyph count,
+scripts, language systems and features of the OpenType layout tables, and
+variation axes and named instances.
+
+	fontinfo [-json] [-check=false] font-file ...
+
+Information is read by textlayout and cross-checked with Harfbuzz; differences
+are reported and result in a non-zero exit status.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hbc"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "print information as JSON")
+	check := flag.Bool("check", true, "cross-check with Harfbuzz")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: fontinfo [flags] font-file ...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	status := 0
+	for _, path := range flag.Args() {
+		if err := inspect(os.Stdout, path, *asJSON, *check); err != nil {
+			fmt.Fprintf(os.Stderr, "fontinfo: %s: %v\n", path, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+func inspect(w io.Writer, path string, asJSON, check bool) error {
+	binary, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	face, err := harfbuzzgoperf.ParseFace(filepath.Base(path), binary)
+	if err != nil {
+		return err
+	}
+	info, err := (&harfbuzzgoperf.HBFont{Binary: binary, Face: face}).Info()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(info); err != nil {
+			return err
+		}
+	} else {
+		printInfo(w, path, info)
+	}
+	if !check {
+		return nil
+	}
+	if diffs := info.Compare(hbc.Inspect(face)); len(diffs) > 0 {
+		return fmt.Errorf("textlayout and Harfbuzz differ:\n\t%s", strings.Join(diffs, "\n\t"))
+	}
+	return nil
+}
+
+func printInfo(w io.Writer, path string, info harfbuzzgoperf.FontInfo) {
+	fmt.Fprintf(w, "%s\n", path)
+	fmt.Fprintf(w, "  family:      %s\n", info.Family)
+	fmt.Fprintf(w, "  style:       %s (weight %d, %s, stretch %g%%)\n", info.Subfamily, info.Weight,
+		info.Style, info.Stretch)
+	fmt.Fprintf(w, "  units/em:    %d\n", info.UnitsPerEm)
+	fmt.Fprintf(w, "  glyphs:      %d\n", info.NumGlyphs)
+	fmt.Fprintf(w, "  scripts:     %s\n", strings.Join(info.Scripts(), " "))
+	fmt.Fprintf(w, "  languages:   %s\n", strings.Join(info.Languages(), " "))
+	for _, t := range info.Layout {
+		fmt.Fprintf(w, "  %s\n", t.Tag)
+		for _, s := range t.Scripts {
+			for _, l := range s.Languages {
+				tags := make([]string, len(l.Features))
+				for i, f := range l.Features {
+					tags[i] = f.Tag
+				}
+				fmt.Fprintf(w, "    %-4s/%-4s  %s\n", s.Tag, l.Tag, strings.Join(tags, " "))
+			}
+		}
+	}
+	for _, a := range info.Axes {
+		fmt.Fprintf(w, "  axis %s:   %g … %g, default %g\n", a.Tag, a.Min, a.Max, a.Default)
+	}
+	for _, inst := range info.Instances {
+		fmt.Fprintf(w, "  instance:    %s %v\n", inst.Name, inst.Coords)
+	}
+}
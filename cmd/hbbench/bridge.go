@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"text/tabwriter"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/bench"
+	"github.com/npillmayer/harfbuzzgoperf/hbc"
+)
+
+// runBridge breaks down the shaping time of the C backend into the primitives
+// of the cgo bridge and Harfbuzz, for every font given.
+func runBridge(fonts []string, size float32, benchtime, format, out string) {
+	if format != "json" {
+		fatal(fmt.Errorf("format %q not supported for -cgo", format))
+	}
+	unlock, err := bench.LockBenchtime(benchtime)
+	if err != nil {
+		fatal(err)
+	}
+	defer unlock()
+	measure := func(run func(n int)) float64 {
+		r := testing.Benchmark(func(b *testing.B) { run(b.N) })
+		if r.N == 0 {
+			return 0
+		}
+		return float64(r.T.Nanoseconds()) / float64(r.N)
+	}
+	var breakdowns []hbc.BridgeBreakdown
+	for _, name := range fonts {
+		face, err := bench.LoadFace(name)
+		if err != nil {
+			fatal(err)
+		}
+		font, err := hbc.FontInstance(nil, face, size, "", 0)
+		if err != nil {
+			fatal(err)
+		}
+		bd := hbc.MeasureBridge(font, harfbuzzgoperf.CorpusRunes[0], measure)
+		bd.Font = name
+		writeBridgeTable(os.Stderr, bd)
+		breakdowns = append(breakdowns, bd)
+	}
+	w := os.Stdout
+	if out != "" {
+		if w, err = os.Create(out); err != nil {
+			fatal(err)
+		}
+		defer w.Close()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(breakdowns); err != nil {
+		fatal(err)
+	}
+}
+
+// writeBridgeTable writes the costs of bridge primitives per shaping, and the
+// estimated time spent in Harfbuzz.
+func writeBridgeTable(w io.Writer, bd hbc.BridgeBreakdown) error {
+	fmt.Fprintf(w, "%s: %d chars, %d glyphs\n", bd.Font, bd.Chars, bd.Glyphs)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "primitive\tns/call\tcalls\tns/shape\tshare\t\n")
+	for _, c := range bd.Costs {
+		if c.Calls == 0 {
+			fmt.Fprintf(tw, "(%s)\t%.1f\t\t\t\t\n", c.Name, c.NsPerCall)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%.1f\t%d\t%.0f\t%.1f%%\t\n", c.Name, c.NsPerCall, c.Calls, c.NsPerRun, c.Fraction*100)
+	}
+	share := func(ns float64) float64 {
+		if bd.Full == 0 {
+			return 0
+		}
+		return ns / bd.Full * 100
+	}
+	fmt.Fprintf(tw, "bridge\t\t\t%.0f\t%.1f%%\t\n", bd.Bridge, share(bd.Bridge))
+	fmt.Fprintf(tw, "cgo transitions\t\t%d\t%.0f\t%.1f%%\t\n", bd.Transitions, bd.Cgo, share(bd.Cgo))
+	fmt.Fprintf(tw, "harfbuzz\t\t\t%.0f\t%.1f%%\t\n", bd.Harfbuzz, share(bd.Harfbuzz))
+	fmt.Fprintf(tw, "Shaper.Shape\t\t\t%.0f\t100%%\t\n", bd.Full)
+	return tw.Flush()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/bench"
+	"github.com/npillmayer/harfbuzzgoperf/hbc"
+	"golang.org/x/text/language"
+)
+
+func init() {
+	bench.Register("c", cBackend{})
+}
+
+// cBackend shapes with Harfbuzz.
+type cBackend struct{}
+
+func (cBackend) Shaper(face *harfbuzzgoperf.Face, size float32, features string) (harfbuzzgoperf.Shaper, error) {
+	font, err := hbc.FontInstance(nil, face, size, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	shaper := hbc.NewShaper(font)
+	if err = shaper.SetFeatures(features); err != nil {
+		shaper.Free()
+		return nil, err
+	}
+	return shaper, nil
+}
+
+// Version returns the Harfbuzz version, to be recorded in baselines.
+func (cBackend) Version() string {
+	return hbc.Version()
+}
+
+func (cBackend) ParseFace(binary []byte) (interface{}, func(), error) {
+	face := hbc.NewFace(binary)
+	return face, func() { hbc.FreeFace(face) }, nil
+}
+
+func (cBackend) NewFont(face interface{}, binary []byte, size float32) (*harfbuzzgoperf.HBFont, func(), error) {
+	font := hbc.NewFont(face.(uintptr), binary, size)
+	return font, func() { hbc.FreeFont(font) }, nil
+}
+
+func (cBackend) NewShaper(font *harfbuzzgoperf.HBFont) (harfbuzzgoperf.Shaper, func(), error) {
+	shaper := hbc.NewShaper(font)
+	return shaper, shaper.Free, nil
+}
+
+// NativeHeapInUse reports memory allocated by Harfbuzz, for footprint
+// measurements.
+func (cBackend) NativeHeapInUse() (int64, bool) {
+	return hbc.NativeHeapInUse()
+}
+
+// PlanShaping executes a cached plan of the shared font instance of face, and
+// compiles new plans bypassing the plan cache.
+func (cBackend) PlanShaping(face *harfbuzzgoperf.Face, size float32, features string, text []rune) (bench.PlanRun, error) {
+	var run bench.PlanRun
+	font, err := hbc.FontInstance(nil, face, size, "", 0)
+	if err != nil {
+		return run, err
+	}
+	dir, script := hbc.LeftToRight, language.MustParseScript("Zyyy")
+	if s := harfbuzzgoperf.DetectScript(text); s != 0 {
+		if script, err = harfbuzzgoperf.ScriptFromHB(s); err != nil {
+			return run, err
+		}
+		if harfbuzzgoperf.IsRightToLeft(s) {
+			dir = hbc.RightToLeft
+		}
+	}
+	plan, err := hbc.NewShapePlan(font, dir, script, "", features)
+	if err != nil {
+		return run, err
+	}
+	buf := hbc.AllocHBBuffer()
+	str := string(text)
+	run.Compile = func() error {
+		p, err := hbc.CompileShapePlan(font, dir, script, "", features)
+		if err == nil {
+			p.Free()
+		}
+		return err
+	}
+	run.Execute = func() error {
+		_, err := plan.Execute(buf, str, font)
+		return err
+	}
+	run.Free = func() {
+		plan.Free()
+		buf.Free()
+	}
+	return run, nil
+}
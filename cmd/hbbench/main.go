@@ -0,0 +1,461 @@
+/*
+Command hbbench runs a matrix of shaping benchmarks and writes the results as
+JSON or CSV.
+
+	hbbench [flags]
+
+The matrix is either given by flags or read from a JSON file (-matrix), e.g.
+
+	{
+	  "fonts":    ["Calibri.ttf", "bold Go"],
+	  "corpora":  ["corpus", "testdata/arabic.txt"],
+	  "features": ["", "-kern,-liga"],
+	  "sizes":    [12],
+	  "backends": ["go", "c"]
+	}
+
+Every scenario of the matrix is run with a warm-up and a number of repetitions
+(-count). Results contain ns/op, ns/glyph, ns/char, allocs/op and bytes/op for
+every repetition, where one operation shapes all paragraphs of a corpus.
+
+With -save-baseline, results are additionally saved as a baseline file, which
+records the versions of Go, textlayout and Harfbuzz and the CPU as well. With
+-baseline, results are compared to a baseline file; without a matrix given by
+flags, the scenarios and options of the baseline are measured again. A scenario
+has regressed if its median ns/op increased by more than its threshold
+(-threshold, or per scenario name pattern from a JSON file given by
+-thresholds), and the change is significant. For example, a thresholds file
+
+	{
+	  "default": 0.05,
+	  "scenarios": {"go/*": 0.03, "c/*": 0.1}
+	}
+
+gates the Go backend more tightly than the C backend. hbbench exits with status
+1 if any scenario has regressed, and with status 2 on errors.
+
+With -profile, a CPU and a heap profile are captured for every scenario, in
+addition to the measurements, and written to the directory given. Results
+include a summary of each profile: the top functions and the shares of
+textlayout subsystems (cmap lookup, normalization, GSUB, GPOS, buffer
+management, …), for example
+
+	hbbench -backends go -profile prof -o results.json
+	go tool pprof -top prof/go_Go_corpus_default_12pt.cpu.pprof
+
+With -scaling, hbbench measures the cost of shaping generated texts of 1 to
+100,000 characters instead (see bench.Generators): short words, running text
+as a single long line, a single cluster of combining marks, and letters without
+break opportunities. Time and allocations per length are reported for the
+first font and size given and every backend. hbbench exits with status 1 if
+time or allocations grow super-linearly with text length.
+
+With -coldstart, hbbench measures the phases of shaping with a font from
+scratch for every font and backend given: parsing the font binary (tt.Parse
+vs. hb_face_create, which loads tables lazily), creating a font object,
+shaping for the first time with a fresh face and font, and shaping in steady
+state.
+
+With -memory, hbbench measures the memory footprint of every font and backend
+given: Go heap and native memory retained by a loaded face and font, retained
+additionally after shaping once, and retained and allocated per shaped run.
+Native memory is measured with glibc's mallinfo2 and is available on Linux
+only; run with MALLOC_ARENA_MAX=1 for exact numbers.
+
+With -plans, hbbench measures the cost of compiling a shape plan and of
+executing it, for sample texts of the scripts given (see bench.ScriptSamples)
+and every font and backend given. Harfbuzz plans are compiled with
+hb_shape_plan_create, bypassing the plan cache; textlayout plans are compiled
+for a private face, as textlayout caches plans per face.
+
+With -cgo, hbbench measures the primitives of the cgo bridge of the C backend
+for the first paragraph of the built-in corpus and every font given: buffer
+reset, setting direction and script, C.CString and hb_buffer_add_utf8, hb_shape
+on empty and one-character input, and retrieving glyph infos. Their costs per
+shaping are subtracted from the time of a full shaping, which leaves the time
+spent in Harfbuzz itself.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/npillmayer/harfbuzzgoperf/bench"
+)
+
+func main() {
+	matrixFile := flag.String("matrix", "", "JSON file with benchmark matrix")
+	fonts := flag.String("fonts", "Calibri.ttf", "comma separated fonts (names, queries or files)")
+	corpora := flag.String("corpora", bench.BuiltinCorpus, "comma separated corpora (\"corpus\" or text files)")
+	features := flag.String("features", "", "semicolon separated feature sets, each a comma separated feature list")
+	sizes := flag.String("sizes", "12", "comma separated font sizes")
+	backends := flag.String("backends", "go,c", "comma separated backends")
+	warmup := flag.Int("warmup", 1, "number of operations to run before measuring")
+	count := flag.Int("count", 5, "number of repetitions per scenario")
+	benchtime := flag.String("benchtime", "1s", "run each repetition for duration d or N times (\"Nx\")")
+	format := flag.String("format", "json", "output format: json or csv")
+	out := flag.String("o", "", "output file (default: stdout)")
+	saveBaseline := flag.String("save-baseline", "", "save results as baseline file")
+	baselineFile := flag.String("baseline", "", "compare results to baseline file")
+	thresholdsFile := flag.String("thresholds", "", "JSON file with regression thresholds per scenario")
+	threshold := flag.Float64("threshold", 0.05, "tolerated relative slowdown")
+	alpha := flag.Float64("alpha", 0.05, "significance level for regressions")
+	profileDir := flag.String("profile", "", "capture CPU and heap profiles per scenario to this directory")
+	scaling := flag.String("scaling", "", "run scaling benchmarks with comma separated generators, or \"all\"")
+	coldstart := flag.Bool("coldstart", false, "measure cold start: font parsing, font creation, first and steady shaping")
+	memory := flag.Bool("memory", false, "measure memory footprint per font and backend")
+	plans := flag.String("plans", "", "measure shape plan compilation and execution for comma separated scripts, or \"all\"")
+	cgo := flag.Bool("cgo", false, "break down C backend shaping time into cgo bridge primitives and Harfbuzz")
+	lengths := flag.String("lengths", "1,10,100,1000,10000,100000", "comma separated text lengths for -scaling")
+	flag.Parse()
+	if *profileDir != "" {
+		runtime.MemProfileRate = bench.HeapProfileRate // before any allocation to be profiled
+	}
+	if *count < 1 {
+		fatal(fmt.Errorf("invalid count %d", *count))
+	}
+	// check the output format before measuring; -memory, -plans and -cgo write
+	// JSON only
+	jsonOnly := !*coldstart && (*memory || *plans != "" || *cgo)
+	if *format != "json" && (*format != "csv" || jsonOnly) {
+		fatal(fmt.Errorf("format %q not supported", *format))
+	}
+	//
+	matrixFlags, benchtimeFlag := false, false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "matrix", "fonts", "corpora", "features", "sizes", "backends":
+			matrixFlags = true
+		case "benchtime":
+			benchtimeFlag = true
+		}
+	})
+	if *coldstart {
+		cfg := bench.ColdStartConfig{Fonts: split(*fonts, ","), Backends: split(*backends, ",")}
+		if benchtimeFlag {
+			cfg.Benchtime = *benchtime
+		}
+		runColdStart(cfg, *format, *out)
+		return
+	}
+	if *memory {
+		runFootprint(bench.FootprintConfig{Fonts: split(*fonts, ","), Backends: split(*backends, ",")}, *format, *out)
+		return
+	}
+	if *plans != "" {
+		cfg := bench.PlanConfig{Fonts: split(*fonts, ","), Backends: split(*backends, ",")}
+		if *plans != "all" {
+			cfg.Scripts = split(*plans, ",")
+		}
+		if fs := split(*features, ";"); len(fs) > 0 {
+			cfg.Features = fs[0]
+		}
+		if benchtimeFlag {
+			cfg.Benchtime = *benchtime
+		}
+		runPlanCosts(cfg, *format, *out)
+		return
+	}
+	if *cgo {
+		size, err := strconv.ParseFloat(split(*sizes, ",")[0], 32)
+		if err != nil {
+			fatal(err)
+		}
+		runBridge(split(*fonts, ","), float32(size), *benchtime, *format, *out)
+		return
+	}
+	if *scaling != "" {
+		cfg := bench.ScalingConfig{
+			Font:     split(*fonts, ",")[0],
+			Backends: split(*backends, ","),
+		}
+		if *scaling != "all" {
+			cfg.Generators = split(*scaling, ",")
+		}
+		if benchtimeFlag {
+			cfg.Benchtime = *benchtime
+		}
+		if sz := split(*sizes, ","); len(sz) > 0 {
+			size, err := strconv.ParseFloat(sz[0], 32)
+			if err != nil {
+				fatal(fmt.Errorf("invalid size %q", sz[0]))
+			}
+			cfg.Size = float32(size)
+		}
+		for _, l := range split(*lengths, ",") {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 {
+				fatal(fmt.Errorf("invalid length %q", l))
+			}
+			cfg.Lengths = append(cfg.Lengths, n)
+		}
+		runScaling(cfg, *format, *out)
+		return
+	}
+	var baseline bench.Baseline
+	if *baselineFile != "" {
+		var err error
+		if baseline, err = readBaseline(*baselineFile); err != nil {
+			fatal(err)
+		}
+		if diffs := bench.CurrentEnvironment().Diff(baseline.Environment); len(diffs) > 0 {
+			fmt.Fprintf(os.Stderr, "hbbench: environment differs from baseline:\n\t%s\n",
+				strings.Join(diffs, "\n\t"))
+		}
+	}
+	var scenarios []bench.Scenario
+	opts := bench.Options{Warmup: *warmup, Repetitions: *count, Benchtime: *benchtime}
+	if *baselineFile != "" && !matrixFlags {
+		scenarios = baseline.Scenarios()
+		opts = baseline.Options
+	} else if *matrixFile != "" {
+		var m bench.Matrix
+		data, err := os.ReadFile(*matrixFile)
+		if err == nil {
+			err = json.Unmarshal(data, &m)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		scenarios = m.Scenarios()
+	} else {
+		m := bench.Matrix{
+			Fonts:       split(*fonts, ","),
+			Corpora:     split(*corpora, ","),
+			FeatureSets: strings.Split(*features, ";"),
+			Backends:    split(*backends, ","),
+		}
+		for _, s := range split(*sizes, ",") {
+			size, err := strconv.ParseFloat(s, 32)
+			if err != nil {
+				fatal(fmt.Errorf("invalid size %q", s))
+			}
+			m.Sizes = append(m.Sizes, float32(size))
+		}
+		scenarios = m.Scenarios()
+	}
+	if opts.Repetitions < 1 {
+		fatal(fmt.Errorf("invalid number of repetitions %d", opts.Repetitions))
+	}
+	opts.ProfileDir = *profileDir
+	results, err := bench.RunScenarios(scenarios, opts, func(r bench.Result) {
+		fmt.Fprintf(os.Stderr, "%-50s %12.0f ns/op\n", r.Name(), r.Samples[0].NsPerOp)
+		if p := r.Profile; p != nil {
+			fmt.Fprintf(os.Stderr, "    cpu:  %v\n    heap: %v\n", p.CPU, p.Heap)
+		}
+	})
+	if err != nil {
+		fatal(err)
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *format {
+	case "json":
+		err = bench.WriteJSON(w, results)
+	case "csv":
+		err = bench.WriteCSV(w, results)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if *saveBaseline != "" {
+		if err = writeBaseline(*saveBaseline, bench.NewBaseline(results, opts)); err != nil {
+			fatal(err)
+		}
+	}
+	if *baselineFile != "" {
+		th := bench.Thresholds{Default: *threshold}
+		if *thresholdsFile != "" {
+			data, err := os.ReadFile(*thresholdsFile)
+			if err == nil {
+				err = json.Unmarshal(data, &th)
+			}
+			if err != nil {
+				fatal(err)
+			}
+		}
+		deltas := bench.CompareBaseline(baseline, results, th, *alpha)
+		bench.WriteDeltas(os.Stderr, deltas)
+		if regressions := bench.Regressions(deltas); len(regressions) > 0 {
+			fmt.Fprintf(os.Stderr, "hbbench: %d scenario(s) regressed\n", len(regressions))
+			os.Exit(1)
+		}
+	}
+}
+
+// runColdStart runs cold-start measurements.
+func runColdStart(cfg bench.ColdStartConfig, format, out string) {
+	results, err := bench.RunColdStart(cfg, func(r bench.ColdStart) {
+		bench.WriteColdStartTable(os.Stderr, []bench.ColdStart{r})
+	})
+	if err != nil {
+		fatal(err)
+	}
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	case "csv":
+		err = bench.WriteColdStartCSV(w, results)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// runFootprint runs memory footprint measurements.
+func runFootprint(cfg bench.FootprintConfig, format, out string) {
+	footprints, err := bench.RunFootprint(cfg, nil)
+	if err != nil {
+		fatal(err)
+	}
+	bench.WriteFootprintTable(os.Stderr, footprints)
+	if format != "json" {
+		fatal(fmt.Errorf("format %q not supported for -memory", format))
+	}
+	w := os.Stdout
+	if out != "" {
+		if w, err = os.Create(out); err != nil {
+			fatal(err)
+		}
+		defer w.Close()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(footprints); err != nil {
+		fatal(err)
+	}
+}
+
+// runPlanCosts runs shape plan measurements.
+func runPlanCosts(cfg bench.PlanConfig, format, out string) {
+	costs, err := bench.RunPlanCosts(cfg, func(c bench.PlanCost) {
+		bench.WritePlanTable(os.Stderr, []bench.PlanCost{c})
+	})
+	if err != nil {
+		fatal(err)
+	}
+	if format != "json" {
+		fatal(fmt.Errorf("format %q not supported for -plans", format))
+	}
+	w := os.Stdout
+	if out != "" {
+		if w, err = os.Create(out); err != nil {
+			fatal(err)
+		}
+		defer w.Close()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(costs); err != nil {
+		fatal(err)
+	}
+}
+
+// runScaling runs scaling benchmarks and exits with status 1 if super-linear
+// growth has been detected.
+func runScaling(cfg bench.ScalingConfig, format, out string) {
+	curves, err := bench.RunScaling(cfg, func(c bench.ScalingCurve) {
+		bench.WriteScalingTable(os.Stderr, []bench.ScalingCurve{c})
+	})
+	if err != nil {
+		fatal(err)
+	}
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(curves)
+	case "csv":
+		err = bench.WriteScalingCSV(w, curves)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if found := bench.SuperLinear(curves); len(found) > 0 {
+		for _, c := range found {
+			fmt.Fprintf(os.Stderr, "hbbench: super-linear growth for %s/%s: time ~ n^%.2f, alloc ~ n^%.2f\n",
+				c.Backend, c.Generator, c.TimeExponent, c.AllocExponent)
+		}
+		os.Exit(1)
+	}
+}
+
+func readBaseline(name string) (bench.Baseline, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return bench.Baseline{}, err
+	}
+	defer f.Close()
+	b, err := bench.ReadBaseline(f)
+	if err != nil {
+		return b, fmt.Errorf("%s: %v", name, err)
+	}
+	return b, nil
+}
+
+func writeBaseline(name string, b bench.Baseline) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = bench.WriteBaseline(f, b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func split(list, sep string) []string {
+	var items []string
+	for _, item := range strings.Split(list, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "hbbench: %v\n", err)
+	os.Exit(2)
+}
@@ -0,0 +1,90 @@
+/*
+Command hbreport generates a self-contained HTML report from benchmark results
+written by hbbench.
+
+	hbreport [-title TITLE] [-o report.html] file.json...
+
+Files are either results as written by hbbench in JSON format, or baselines as
+written by hbbench -save-baseline. Baselines contribute to the history chart.
+If no results files are given, the most recent baseline is reported on.
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/npillmayer/harfbuzzgoperf/bench"
+)
+
+func main() {
+	title := flag.String("title", "Shaping performance", "title of the report")
+	out := flag.String("o", "", "output file (default: stdout)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: hbreport [options] file.json...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	in := bench.ReportInput{Title: *title}
+	for _, name := range flag.Args() {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			fatal(err)
+		}
+		if isBaseline(data) {
+			b, err := bench.ReadBaseline(bytes.NewReader(data))
+			if err != nil {
+				fatal(fmt.Errorf("%s: %v", name, err))
+			}
+			in.History = append(in.History, b)
+			continue
+		}
+		results, err := bench.ReadJSON(bytes.NewReader(data))
+		if err != nil {
+			fatal(fmt.Errorf("%s: %v", name, err))
+		}
+		in.Results = append(in.Results, results...)
+	}
+	if len(in.Results) == 0 && len(in.History) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if len(in.Results) == 0 {
+		latest := 0
+		for i, b := range in.History {
+			if b.Created.After(in.History[latest].Created) {
+				latest = i
+			}
+		}
+		env := in.History[latest].Environment
+		in.Results, in.Environment = in.History[latest].Results, &env
+		in.History = append(in.History[:latest], in.History[latest+1:]...)
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := bench.WriteHTML(w, in); err != nil {
+		fatal(err)
+	}
+}
+
+// isBaseline returns true if data is a JSON object, i.e. a baseline rather
+// than an array of results.
+func isBaseline(data []byte) bool {
+	return strings.HasPrefix(strings.TrimSpace(string(data)), "{")
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "hbreport: %v\n", err)
+	os.Exit(2)
+}
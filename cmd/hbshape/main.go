@@ -0,0 +1,188 @@
+/*
+Command hbshape shapes text with either or both shaping backends and prints
+the glyphs, in the output format of HarfBuzz' hb-shape utility.
+
+	hbshape [options] [font-file] [text]
+
+The options follow hb-shape:
+
+	--font-file=FILE      font file to use
+	--text=TEXT           text to shape
+	--text-file=FILE      file with lines of text to shape; "-" is stdin
+	--direction=DIR       ltr, rtl, ttb or btt (default: from script)
+	--script=ISO15924     script, e.g. Latn (default: from text)
+	--language=BCP47      language, e.g. tr
+	--features=LIST       comma separated features, e.g. "liga=0,+smcp"
+	--variations=LIST     comma separated variations, e.g. "wght=700"
+	--shapers=LIST        comma separated shapers to try, e.g. "fallback"
+	--font-size=SIZE      font size (default: units per em)
+	--backend=BACKEND     go, c or both (default: go)
+	--output-format=FMT   text or json
+	--no-glyph-names      output glyph IDs instead of names
+	--no-positions        do not output positions
+	--no-advances         do not output advances
+	--no-clusters         do not output clusters
+	--show-flags          output glyph flags
+	--utf8-clusters       output clusters as byte offsets into the UTF-8 text
+
+With --backend=both, output of both backends is printed and compared. hbshape
+exits with status 1 if they differ.
+
+With --shapers, the first shaper of the list able to shape with the font is
+used: "ot" for OpenType shaping or "fallback" for nominal glyphs and advances
+without OpenType layout, e.g. to compare fallback positioning of both
+backends. The Go backend supports "ot", "fallback" and "graphite2".
+*/
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+type options struct {
+	fontFile, text, textFile    string
+	direction, script, language string
+	features, variations        string
+	shapers                     string
+	fontSize                    float64
+	backend, outputFormat       string
+	noGlyphNames, noPositions   bool
+	noAdvances, noClusters      bool
+	showFlags, utf8Clusters     bool
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.fontFile, "font-file", "", "font file to use")
+	flag.StringVar(&opts.text, "text", "", "text to shape")
+	flag.StringVar(&opts.textFile, "text-file", "", "file with lines of text to shape; \"-\" is stdin")
+	flag.StringVar(&opts.direction, "direction", "", "text direction: ltr, rtl, ttb or btt (default: from script)")
+	flag.StringVar(&opts.script, "script", "", "ISO 15924 script tag, e.g. Latn (default: from text)")
+	flag.StringVar(&opts.language, "language", "", "BCP 47 language tag")
+	flag.StringVar(&opts.features, "features", "", "comma separated list of font features")
+	flag.StringVar(&opts.variations, "variations", "", "comma separated list of font variations")
+	flag.StringVar(&opts.shapers, "shapers", "", "comma separated list of shapers to try")
+	flag.Float64Var(&opts.fontSize, "font-size", 0, "font size (default: units per em)")
+	flag.StringVar(&opts.backend, "backend", "go", "shaping backend: go, c or both")
+	flag.StringVar(&opts.outputFormat, "output-format", "text", "output format: text or json")
+	flag.BoolVar(&opts.noGlyphNames, "no-glyph-names", false, "output glyph IDs instead of names")
+	flag.BoolVar(&opts.noPositions, "no-positions", false, "do not output glyph positions")
+	flag.BoolVar(&opts.noAdvances, "no-advances", false, "do not output glyph advances")
+	flag.BoolVar(&opts.noClusters, "no-clusters", false, "do not output cluster indices")
+	flag.BoolVar(&opts.showFlags, "show-flags", false, "output glyph flags")
+	flag.BoolVar(&opts.utf8Clusters, "utf8-clusters", false, "output clusters as UTF-8 byte offsets")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: hbshape [options] [font-file] [text]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if opts.fontFile == "" && len(args) > 0 {
+		opts.fontFile, args = args[0], args[1:]
+	}
+	if opts.text == "" && opts.textFile == "" && len(args) > 0 {
+		opts.text, args = args[0], args[1:]
+	}
+	if opts.text == "" && opts.textFile == "" {
+		opts.textFile = "-"
+	}
+	if opts.fontFile == "" || len(args) > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	same, err := run(os.Stdout, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hbshape: %v\n", err)
+		os.Exit(2)
+	}
+	if !same {
+		os.Exit(1)
+	}
+}
+
+// run shapes every line of input and prints the output. It returns false if
+// backends have been compared and differ.
+func run(w io.Writer, opts options) (bool, error) {
+	lines, err := readLines(opts)
+	if err != nil {
+		return false, err
+	}
+	binary, err := os.ReadFile(opts.fontFile)
+	if err != nil {
+		return false, err
+	}
+	face, err := harfbuzzgoperf.ParseFace(filepath.Base(opts.fontFile), binary)
+	if err != nil {
+		return false, err
+	}
+	if opts.fontSize == 0 {
+		opts.fontSize = float64(face.GoFace.Upem())
+	}
+	var backends []string
+	switch opts.backend {
+	case "go", "c":
+		backends = []string{opts.backend}
+	case "both":
+		backends = []string{"go", "c"}
+	default:
+		return false, fmt.Errorf("unknown backend %q", opts.backend)
+	}
+	same := true
+	for _, line := range lines {
+		text := []rune(line)
+		if len(text) == 0 {
+			continue
+		}
+		var outputs []string
+		for _, backend := range backends {
+			glyphs, names, err := shape(backend, face, text, opts)
+			if err != nil {
+				return false, err
+			}
+			outputs = append(outputs, serialize(glyphs, names, line, opts))
+		}
+		if len(outputs) == 1 {
+			fmt.Fprintln(w, outputs[0])
+			continue
+		}
+		fmt.Fprintf(w, "go: %s\nc:  %s\n", outputs[0], outputs[1])
+		if outputs[0] != outputs[1] {
+			fmt.Fprintln(w, "backends differ")
+			same = false
+		}
+	}
+	return same, nil
+}
+
+func readLines(opts options) ([]string, error) {
+	if opts.textFile == "" {
+		return strings.Split(opts.text, "\n"), nil
+	}
+	var r io.Reader = os.Stdin
+	if opts.textFile != "-" {
+		f, err := os.Open(opts.textFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) == 0 && scanner.Err() == nil {
+		return nil, errors.New("no text to shape")
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/benoitkugler/textlayout/fonts"
+	gohb "github.com/benoitkugler/textlayout/harfbuzz"
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+	"github.com/npillmayer/harfbuzzgoperf/hbc"
+	"golang.org/x/text/language"
+)
+
+// shape shapes text with a backend. It returns the glyphs and a function to look
+// up glyph names.
+func shape(backend string, face *harfbuzzgoperf.Face, text []rune, opts options) (
+	[]harfbuzzgoperf.ShapedGlyph, func(uint32) string, error) {
+	//
+	script, rtl, err := segmentScript(text, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := float32(opts.fontSize)
+	if backend == "go" {
+		font, err := hb.FontInstance(nil, face, size, opts.variations)
+		if err != nil {
+			return nil, nil, err
+		}
+		params := hb.InstanceParams(font)
+		params.Script = script
+		if params.Direction, err = goDirection(opts.direction, rtl); err != nil {
+			return nil, nil, err
+		}
+		if opts.language != "" {
+			if params.Language, err = language.Parse(opts.language); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, f := range splitList(opts.features) {
+			feature, err := gohb.ParseFeature(f)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid feature %q: %v", f, err)
+			}
+			params.Features = append(params.Features, feature)
+		}
+		if params, err = params.WithShapers(splitList(opts.shapers)); err != nil {
+			return nil, nil, err
+		}
+		glyphs, err := hb.NewShaper(params).Shape(text)
+		names := func(gid uint32) string { return font.GoFont.Face().GlyphName(fonts.GID(gid)) }
+		return glyphs, names, err
+	}
+	font, err := hbc.FontInstance(nil, face, size, opts.variations, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	shaper := hbc.NewShaper(font)
+	shaper.Script = script
+	shaper.Language = opts.language
+	shaper.Shapers = splitList(opts.shapers)
+	if shaper.Direction, err = cDirection(opts.direction, rtl); err != nil {
+		return nil, nil, err
+	}
+	if err = shaper.SetFeatures(opts.features); err != nil {
+		return nil, nil, err
+	}
+	glyphs, err := shaper.Shape(text)
+	names := func(gid uint32) string {
+		name := hbc.GlyphName(font.CFont, gid)
+		runtime.KeepAlive(font)
+		return name
+	}
+	return glyphs, names, err
+}
+
+// segmentScript returns the script from the options or else from the text, and
+// whether it is written right-to-left.
+func segmentScript(text []rune, opts options) (language.Script, bool, error) {
+	if opts.script != "" {
+		script, err := language.ParseScript(opts.script)
+		if err != nil {
+			return script, false, err
+		}
+		return script, harfbuzzgoperf.IsRightToLeft(harfbuzzgoperf.Script4HB(script)), nil
+	}
+	s := harfbuzzgoperf.DetectScript(text)
+	if s == 0 {
+		return language.MustParseScript("Zyyy"), false, nil
+	}
+	script, err := harfbuzzgoperf.ScriptFromHB(s)
+	return script, harfbuzzgoperf.IsRightToLeft(s), err
+}
+
+func goDirection(dir string, rtl bool) (gohb.Direction, error) {
+	switch strings.ToLower(dir) {
+	case "":
+		if rtl {
+			return gohb.RightToLeft, nil
+		}
+		return gohb.LeftToRight, nil
+	case "ltr":
+		return gohb.LeftToRight, nil
+	case "rtl":
+		return gohb.RightToLeft, nil
+	case "ttb":
+		return gohb.TopToBottom, nil
+	case "btt":
+		return gohb.BottomToTop, nil
+	}
+	return 0, fmt.Errorf("invalid direction %q", dir)
+}
+
+func cDirection(dir string, rtl bool) (hbc.Direction, error) {
+	d, err := goDirection(dir, rtl)
+	switch d {
+	case gohb.RightToLeft:
+		return hbc.RightToLeft, err
+	case gohb.TopToBottom:
+		return hbc.TopToBottom, err
+	case gohb.BottomToTop:
+		return hbc.BottomToTop, err
+	}
+	return hbc.LeftToRight, err
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// --- Serialization ---------------------------------------------------------
+
+// serialize formats glyphs like hb-shape, either as text
+//
+//	[name=cluster@dx,dy+ax,ay#flags|…]
+//
+// or as JSON.
+func serialize(glyphs []harfbuzzgoperf.ShapedGlyph, names func(uint32) string, text string, opts options) string {
+	var byteOffset []int
+	if opts.utf8Clusters {
+		for i := range text {
+			byteOffset = append(byteOffset, i)
+		}
+		byteOffset = append(byteOffset, len(text))
+	}
+	var sb strings.Builder
+	sb.WriteByte('[')
+	for i, g := range glyphs {
+		name := strconv.Itoa(int(g.GID))
+		if !opts.noGlyphNames {
+			if n := names(g.GID); n != "" {
+				name = n
+			} else {
+				name = "gid" + name
+			}
+		}
+		cluster := g.Cluster
+		if byteOffset != nil && cluster < len(byteOffset) {
+			cluster = byteOffset[cluster]
+		}
+		if opts.outputFormat == "json" {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			if opts.noGlyphNames {
+				fmt.Fprintf(&sb, `{"g":%s`, name)
+			} else {
+				fmt.Fprintf(&sb, `{"g":%q`, name)
+			}
+			if !opts.noClusters {
+				fmt.Fprintf(&sb, `,"cl":%d`, cluster)
+			}
+			if !opts.noPositions {
+				fmt.Fprintf(&sb, `,"dx":%s,"dy":%s`, num(g.XOffset), num(g.YOffset))
+				if !opts.noAdvances {
+					fmt.Fprintf(&sb, `,"ax":%s,"ay":%s`, num(g.XAdvance), num(g.YAdvance))
+				}
+			}
+			if opts.showFlags && g.Flags != 0 {
+				fmt.Fprintf(&sb, `,"fl":%d`, g.Flags)
+			}
+			sb.WriteByte('}')
+			continue
+		}
+		if i > 0 {
+			sb.WriteByte('|')
+		}
+		sb.WriteString(name)
+		if !opts.noClusters {
+			fmt.Fprintf(&sb, "=%d", cluster)
+		}
+		if !opts.noPositions {
+			if g.XOffset != 0 || g.YOffset != 0 {
+				fmt.Fprintf(&sb, "@%s,%s", num(g.XOffset), num(g.YOffset))
+			}
+			if !opts.noAdvances {
+				fmt.Fprintf(&sb, "+%s", num(g.XAdvance))
+				if g.YAdvance != 0 {
+					fmt.Fprintf(&sb, ",%s", num(g.YAdvance))
+				}
+			}
+		}
+		if opts.showFlags && g.Flags != 0 {
+			fmt.Fprintf(&sb, "#%X", uint32(g.Flags))
+		}
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
+
+// num formats a position with at most two decimals. At the default font size,
+// positions are integral font units.
+func num(x float64) string {
+	return strconv.FormatFloat(math.Round(x*100)/100, 'f', -1, 64)
+}
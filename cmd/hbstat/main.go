@@ -0,0 +1,69 @@
+/*
+Command hbstat compares the Go and the C shaping backend statistically, from
+results written by hbbench in JSON format.
+
+	hbstat [-alpha 0.05] [-json] results.json...
+
+Results of identical scenarios from several files are merged. For every
+scenario measured with both backends, hbstat reports the median ns/op with its
+confidence interval, the Go/C ratio and the p-value of a Mann-Whitney U test.
+Ratios which are not significant at level alpha are printed as '~'. Ratios are
+summarized per font, script and corpus by their geometric mean.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/npillmayer/harfbuzzgoperf/bench"
+)
+
+func main() {
+	alpha := flag.Float64("alpha", 0.05, "significance level")
+	asJSON := flag.Bool("json", false, "output JSON instead of a table")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: hbstat [options] results.json...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var results []bench.Result
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fatal(err)
+		}
+		r, err := bench.ReadJSON(f)
+		f.Close()
+		if err != nil {
+			fatal(fmt.Errorf("%s: %v", name, err))
+		}
+		results = append(results, r...)
+	}
+	report := bench.CompareBackends(results, *alpha)
+	if len(report.Comparisons) == 0 {
+		fatal(fmt.Errorf("no scenarios measured with both backends"))
+	}
+	var err error
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = bench.WriteTable(os.Stdout, report)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "hbstat: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,8 @@
+//go:build hbperfdebug
+// +build hbperfdebug
+
+package harfbuzzgoperf
+
+// Debug is set by building with tag 'hbperfdebug'. In debug mode, the shaping
+// backends check their output with CheckRun.
+const Debug = true
@@ -0,0 +1,175 @@
+/*
+Package engine implements a concurrent shaping engine for both shaping backends.
+
+Neither backend's shaping objects may be shared freely between goroutines:
+HarfBuzz buffers are mutable, and fonts may cache per-font data. The engine
+therefore runs a fixed set of workers, each of which owns a shaper (including
+its buffer and a view of the font) created by a factory function. Runs of
+text are distributed across the workers and the results are collected in the
+order of the input. Shapers with a method Free, like those of the C backend,
+are freed when the engine is closed.
+
+An Engine is safe for concurrent use.
+*/
+package engine
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/schuko/tracing"
+)
+
+// tracer traces to tracing key 'hbperf.engine'.
+func tracer() tracing.Trace {
+	return tracing.Select("hbperf.engine")
+}
+
+// Factory creates a shaper for a worker. Shapers will be used by a single
+// goroutine only, but must not share mutable state with shapers created for
+// other workers.
+type Factory func(worker int) (harfbuzzgoperf.Shaper, error)
+
+// Engine is a pool of shaping workers.
+type Engine struct {
+	jobs    chan job
+	shapers []harfbuzzgoperf.Shaper
+	workers int
+	wg      sync.WaitGroup
+	mx      sync.RWMutex // guards closed
+	closed  bool
+}
+
+// Result is the result of shaping a single run of text.
+type Result struct {
+	Glyphs []harfbuzzgoperf.ShapedGlyph
+	Err    error
+}
+
+type job struct {
+	seg      harfbuzzgoperf.Segment
+	segments bool // shape with the properties of seg
+	out      *Result
+	done     *sync.WaitGroup
+}
+
+// ErrClosed is returned when using an engine after Close.
+var ErrClosed = errors.New("shaping engine is closed")
+
+// New creates an engine with a given number of workers. factory is called once
+// per worker.
+func New(workers int, factory Factory) (*Engine, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	shapers := make([]harfbuzzgoperf.Shaper, workers)
+	for i := range shapers {
+		s, err := factory(i)
+		if err != nil {
+			for _, s := range shapers[:i] {
+				if f, ok := s.(freer); ok {
+					f.Free()
+				}
+			}
+			return nil, err
+		}
+		shapers[i] = s
+	}
+	e := &Engine{
+		jobs:    make(chan job, workers),
+		shapers: shapers,
+		workers: workers,
+	}
+	e.wg.Add(workers)
+	for _, s := range shapers {
+		go e.work(s)
+	}
+	tracer().Debugf("started shaping engine with %d workers", workers)
+	return e, nil
+}
+
+func (e *Engine) work(shaper harfbuzzgoperf.Shaper) {
+	defer e.wg.Done()
+	segmenter, _ := shaper.(harfbuzzgoperf.SegmentShaper)
+	for j := range e.jobs {
+		var glyphs []harfbuzzgoperf.ShapedGlyph
+		var err error
+		if j.segments && segmenter != nil {
+			glyphs, err = segmenter.ShapeSegment(j.seg)
+		} else {
+			glyphs, err = shaper.Shape(j.seg.Text)
+		}
+		if err == nil {
+			// shapers may re-use their output slice
+			glyphs = append(make([]harfbuzzgoperf.ShapedGlyph, 0, len(glyphs)), glyphs...)
+		}
+		*j.out = Result{Glyphs: glyphs, Err: err}
+		j.done.Done()
+	}
+}
+
+// Workers returns the number of workers of the engine.
+func (e *Engine) Workers() int {
+	return e.workers
+}
+
+// ShapeAll shapes runs of text concurrently, with the configuration of the
+// workers' shapers. Results are returned in the order of the input runs.
+// Errors are reported per run.
+func (e *Engine) ShapeAll(runs [][]rune) ([]Result, error) {
+	segs := make([]harfbuzzgoperf.Segment, len(runs))
+	for i, text := range runs {
+		segs[i].Text = text
+	}
+	return e.shape(segs, false)
+}
+
+// ShapeSegments is like ShapeAll, but shapes every segment with its script and
+// direction. Workers' shapers which do not implement
+// harfbuzzgoperf.SegmentShaper shape segments with their configuration.
+func (e *Engine) ShapeSegments(segs []harfbuzzgoperf.Segment) ([]Result, error) {
+	return e.shape(segs, true)
+}
+
+func (e *Engine) shape(segs []harfbuzzgoperf.Segment, segments bool) ([]Result, error) {
+	e.mx.RLock()
+	defer e.mx.RUnlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	results := make([]Result, len(segs))
+	var done sync.WaitGroup
+	done.Add(len(segs))
+	for i, seg := range segs {
+		e.jobs <- job{seg: seg, segments: segments, out: &results[i], done: &done}
+	}
+	done.Wait()
+	return results, nil
+}
+
+// freer is implemented by shapers holding native resources.
+type freer interface {
+	Free()
+}
+
+// Close stops the workers of the engine, after pending runs have been shaped,
+// and frees their shapers.
+func (e *Engine) Close() {
+	e.mx.Lock()
+	closing := !e.closed
+	if closing {
+		e.closed = true
+		close(e.jobs)
+	}
+	e.mx.Unlock()
+	e.wg.Wait()
+	if closing {
+		for _, s := range e.shapers {
+			if f, ok := s.(freer); ok {
+				f.Free()
+			}
+		}
+		e.shapers = nil
+	}
+}
@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+	"github.com/npillmayer/schuko/tracing/gotestingadapter"
+)
+
+func TestEngineOrder(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.engine")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Go", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shaper := hb.NewShaper(params)
+	engine, err := New(4, func(int) (harfbuzzgoperf.Shaper, error) {
+		return shaper.NewView(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	results, err := engine.ShapeAll(harfbuzzgoperf.CorpusRunes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range harfbuzzgoperf.CorpusRunes {
+		expected, _ := shaper.Shape(text)
+		if results[i].Err != nil {
+			t.Fatal(results[i].Err)
+		}
+		if len(results[i].Glyphs) != len(expected) {
+			t.Errorf("run %d: expected %d glyphs, have %d", i, len(expected), len(results[i].Glyphs))
+		}
+		if err = harfbuzzgoperf.CheckRun(results[i].Glyphs, len(text), false, params.Font.NumGlyphs()); err != nil {
+			t.Errorf("run %d: %v", i, err)
+		}
+	}
+	engine.Close()
+	if _, err = engine.ShapeAll(harfbuzzgoperf.CorpusRunes); err != ErrClosed {
+		t.Errorf("expected engine to be closed")
+	}
+}
+
+// freeShaper counts calls to Free.
+type freeShaper struct {
+	freed *int32
+}
+
+func (s freeShaper) Shape(text []rune) ([]harfbuzzgoperf.ShapedGlyph, error) {
+	return nil, nil
+}
+
+func (s freeShaper) Free() {
+	atomic.AddInt32(s.freed, 1)
+}
+
+func TestEngineFreesShapers(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.engine")
+	defer teardown()
+	//
+	var freed int32
+	engine, err := New(3, func(int) (harfbuzzgoperf.Shaper, error) {
+		return freeShaper{freed: &freed}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Close()
+	engine.Close()
+	if freed != 3 {
+		t.Errorf("expected 3 shapers to be freed once, have %d calls to Free", freed)
+	}
+	freed = 0
+	_, err = New(3, func(i int) (harfbuzzgoperf.Shaper, error) {
+		if i == 2 {
+			return nil, errors.New("no shaper")
+		}
+		return freeShaper{freed: &freed}, nil
+	})
+	if err == nil || freed != 2 {
+		t.Errorf("expected shapers created before an error to be freed, have %d calls to Free (%v)", freed, err)
+	}
+}
+
+// --- Benchmarking ----------------------------------------------------------
+
+func BenchmarkEngine(b *testing.B) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Calibri.ttf", 12.0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	shaper := hb.NewShaper(params)
+	for workers := 1; workers <= runtime.GOMAXPROCS(0); workers *= 2 {
+		engine, err := New(workers, func(int) (harfbuzzgoperf.Shaper, error) {
+			return shaper.NewView(), nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := engine.ShapeAll(harfbuzzgoperf.CorpusRunes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		engine.Close()
+	}
+}
+
+// BenchmarkShapeParallel shapes the corpus with a shaper per goroutine.
+// Use flag -cpu to check scalability.
+func BenchmarkShapeParallel(b *testing.B) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Calibri.ttf", 12.0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	shaper := hb.NewShaper(params)
+	b.RunParallel(func(pb *testing.PB) {
+		s := shaper.NewView()
+		for pb.Next() {
+			for _, line := range harfbuzzgoperf.CorpusRunes {
+				if _, err := s.Shape(line); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}
+	})
+}
@@ -1,12 +1,11 @@
 package harfbuzzgoperf
 
 import (
-	"bytes"
 	"embed"
 	"path/filepath"
+	"sort"
 	"sync"
 
-	tt "github.com/benoitkugler/textlayout/fonts/truetype"
 	hb "github.com/benoitkugler/textlayout/harfbuzz"
 	"golang.org/x/image/font/gofont/goregular"
 )
@@ -14,60 +13,94 @@ import (
 //go:embed resources/*
 var resources embed.FS
 
+// HBFont is a font for the shaping backends. CFont is the native font of the C
+// backend; its backend may free it when the HBFont is garbage collected, so
+// CFont must not be used after the last use of its HBFont. Callers handing
+// CFont to C should use runtime.KeepAlive on the HBFont afterwards.
 type HBFont struct {
 	Binary []byte
 	GoFont *hb.Font
 	CFont  uintptr
+	Face   *Face   // shared face, if the font is an instance of a face
+	Size   float32 // point size of an instance, 0 otherwise
 }
 
 func LoadEmbeddedFonts() {
 	fonts, _ := resources.ReadDir("resources/fonts")
 	for _, font := range fonts {
+		if GlobalFontStore.FindFont(font.Name()) != nil {
+			continue
+		}
 		tracer().Debugf("found embedded font file %s", font.Name())
-		f := &HBFont{}
-		f.Binary, _ = resources.ReadFile(filepath.Join("resources", "fonts", font.Name()))
-		fr := bytes.NewReader(f.Binary)
-		hb_face, err := tt.Parse(fr, true)
+		binary, _ := resources.ReadFile(filepath.Join("resources", "fonts", font.Name()))
+		face, err := ParseFace(font.Name(), binary)
 		if err != nil {
 			tracer().Errorf("cannot parse font %s: %s", font.Name(), err)
 			continue
 		}
-		f.GoFont = hb.NewFont(hb_face)
-		GlobalFontStore.StoreFont(font.Name(), f)
+		GlobalFontStore.StoreFont(font.Name(), faceFont(face))
+	}
+	if GlobalFontStore.FindFont("Go") == nil {
+		face, _ := ParseFace("Go", goregular.TTF)
+		GlobalFontStore.StoreFont("Go", faceFont(face))
 	}
-	f := &HBFont{}
-	f.Binary = goregular.TTF
-	fr := bytes.NewReader(f.Binary)
-	hb_face, _ := tt.Parse(fr, true)
-	f.GoFont = hb.NewFont(hb_face)
-	GlobalFontStore.StoreFont("Go", f)
+}
+
+func faceFont(face *Face) *HBFont {
+	return &HBFont{Binary: face.Binary, GoFont: hb.NewFont(face.GoFace), Face: face}
 }
 
 // --- Font cache ------------------------------------------------------------
 
-// FontCache is a super-simple-minded dictionary for caching fonts. This is just
-// for facilitating the tests.
+// FontCache is a super-simple-minded dictionary for caching fonts by name. This is
+// just for facilitating the tests. Sized font instances are cached by an
+// InstanceCache.
 var GlobalFontStore = NewFontCache()
-var fontCacheMx = &sync.RWMutex{}
 
-type FontCache map[string]*HBFont
+type FontCache struct {
+	mx    sync.RWMutex
+	fonts map[string]*HBFont
+}
+
+func NewFontCache() *FontCache {
+	return &FontCache{fonts: make(map[string]*HBFont)}
+}
+
+func (cache *FontCache) FindFont(name string) *HBFont {
+	cache.mx.RLock()
+	defer cache.mx.RUnlock()
+	return cache.fonts[name]
+}
+
+// FindFace returns the face of a font stored under name, or nil.
+func (cache *FontCache) FindFace(name string) *Face {
+	if f := cache.FindFont(name); f != nil {
+		return f.Face
+	}
+	return nil
+}
 
-func NewFontCache() FontCache {
-	return FontCache(make(map[string]*HBFont))
+// Len returns the number of fonts in the cache.
+func (cache *FontCache) Len() int {
+	cache.mx.RLock()
+	defer cache.mx.RUnlock()
+	return len(cache.fonts)
 }
 
-func (cache FontCache) FindFont(name string) *HBFont {
-	fontCacheMx.RLock()
-	defer fontCacheMx.RUnlock()
-	if f, ok := cache[name]; !ok {
-		return nil
-	} else {
-		return f
+// Names returns the names of all fonts in the cache, sorted.
+func (cache *FontCache) Names() []string {
+	cache.mx.RLock()
+	defer cache.mx.RUnlock()
+	names := make([]string, 0, len(cache.fonts))
+	for name := range cache.fonts {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
-func (cache FontCache) StoreFont(name string, font *HBFont) {
-	fontCacheMx.Lock()
-	defer fontCacheMx.Unlock()
-	cache[name] = font
+func (cache *FontCache) StoreFont(name string, font *HBFont) {
+	cache.mx.Lock()
+	defer cache.mx.Unlock()
+	cache.fonts[name] = font
 }
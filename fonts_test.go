@@ -1,6 +1,9 @@
 package harfbuzzgoperf
 
 import (
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/npillmayer/schuko/tracing/gotestingadapter"
@@ -11,11 +14,256 @@ func TestEmbeddedFonts(t *testing.T) {
 	defer teardown()
 	//
 	LoadEmbeddedFonts()
-	if len(GlobalFontStore) != 3 {
-		t.Fatalf("expected 3 fonts to be pre-loaded, have %d", len(GlobalFontStore))
+	if GlobalFontStore.Len() != 3 {
+		t.Fatalf("expected 3 fonts to be pre-loaded, have %d", GlobalFontStore.Len())
 	}
 	f := GlobalFontStore.FindFont("Go")
 	if f == nil {
 		t.Fatal("expected to find font Go, could not")
 	}
 }
+
+func TestInstanceCache(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.base")
+	defer teardown()
+	//
+	LoadEmbeddedFonts()
+	face := GlobalFontStore.FindFace("Go")
+	if face == nil {
+		t.Fatal("expected font Go to have a face")
+	}
+	cache := NewInstanceCache(300)
+	created := 0
+	instance := func(size float32) *HBFont {
+		f, err := cache.Instance(InstanceKey{Backend: "go", Face: face, Size: size},
+			func() (*HBFont, int64, error) {
+				created++
+				return &HBFont{Face: face, Size: size}, 100, nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	f10 := instance(10)
+	instance(12)
+	instance(14)
+	if instance(10) != f10 || created != 3 {
+		t.Errorf("expected instance at 10pt to be cached")
+	}
+	instance(16) // evicts 12pt
+	instance(12)
+	stats := cache.Stats()
+	t.Logf("instance cache stats: %+v", stats)
+	if created != 5 || stats.Evictions != 2 || stats.Bytes != 300 {
+		t.Errorf("expected least recently used instances to be evicted, have %+v", stats)
+	}
+}
+
+func TestInstanceCacheConcurrentCreation(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.base")
+	defer teardown()
+	//
+	LoadEmbeddedFonts()
+	face := GlobalFontStore.FindFace("Go")
+	cache := NewInstanceCache(1 << 20)
+	var created int32
+	release := make(chan struct{})
+	slow := func() (*HBFont, int64, error) {
+		atomic.AddInt32(&created, 1)
+		<-release
+		return &HBFont{Face: face, Size: 10}, 100, nil
+	}
+	fonts := make([]*HBFont, 4)
+	var wg sync.WaitGroup
+	for i := range fonts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fonts[i], _ = cache.Instance(InstanceKey{Backend: "go", Face: face, Size: 10}, slow)
+		}(i)
+	}
+	// other instances are not blocked by the creation in flight
+	if _, err := cache.Instance(InstanceKey{Backend: "go", Face: face, Size: 12},
+		func() (*HBFont, int64, error) { return &HBFont{Face: face, Size: 12}, 100, nil }); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	wg.Wait()
+	if created != 1 {
+		t.Errorf("expected instance to be created once, has been created %d times", created)
+	}
+	for _, f := range fonts {
+		if f == nil || f != fonts[0] {
+			t.Fatalf("expected all requests to receive the same instance")
+		}
+	}
+}
+
+func TestCanonicalVariations(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.base")
+	defer teardown()
+	//
+	v, vars, err := CanonicalVariations(" wght=700, wdth=75.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "wdth=75.5,wght=700" || len(vars) != 2 {
+		t.Errorf("unexpected canonical variations %q", v)
+	}
+	if _, _, err = CanonicalVariations("wght"); err == nil {
+		t.Error("expected error for variation without value")
+	}
+}
+
+func TestMatchFace(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.base")
+	defer teardown()
+	//
+	LoadEmbeddedFonts()
+	for _, test := range []struct {
+		query  string
+		weight int
+	}{
+		{"Go", 400},
+		{"bold Go", 600},
+		{"900 Go", 600},
+		{"light italic Helvetica, 'go'", 400},
+		{"semi-bold condensed Go", 600},
+	} {
+		q, err := ParseFontQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		face, err := GlobalFontStore.MatchFace(q)
+		if err != nil {
+			t.Fatalf("query %q: %v", test.query, err)
+		}
+		if face.Family != "Go" || face.Weight != test.weight {
+			t.Errorf("query %q: expected Go at weight %d, have %s %+v", test.query, test.weight,
+				face.Name, face.FaceDescriptor)
+		}
+	}
+	q, _ := ParseFontQuery("Times, serif")
+	if _, err := GlobalFontStore.MatchFace(q); err != ErrNoMatch {
+		t.Errorf("expected no match for %v, have %v", q.Families, err)
+	}
+}
+
+func TestWeightPenalty(t *testing.T) {
+	weights := []int{100, 300, 400, 500, 600, 900}
+	for _, test := range []struct{ want, best int }{
+		{400, 400}, {450, 500}, {350, 300}, {550, 600}, {700, 900}, {50, 100},
+	} {
+		best := weights[0]
+		for _, w := range weights {
+			if weightPenalty(test.want, w) < weightPenalty(test.want, best) {
+				best = w
+			}
+		}
+		if best != test.best {
+			t.Errorf("weight %d: expected %d to match best, have %d", test.want, test.best, best)
+		}
+	}
+}
+
+func TestFontInfo(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.base")
+	defer teardown()
+	//
+	LoadEmbeddedFonts()
+	info, err := GlobalFontStore.FindFont("GoBold.ttf").Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Family != "Go" || info.Subfamily != "Bold" || info.UnitsPerEm != 2048 || info.NumGlyphs == 0 {
+		t.Errorf("unexpected font info %+v", info)
+	}
+	if diffs := info.Compare(info); len(diffs) != 0 {
+		t.Errorf("expected info to equal itself, have %v", diffs)
+	}
+	a := FontInfo{Layout: []LayoutTable{{Tag: "GSUB", Scripts: []LayoutScript{
+		{Tag: "latn", Languages: []LayoutLanguage{
+			{Tag: DefaultLanguage, Features: []LayoutFeature{{"liga", []int{1}}, {"ccmp", []int{0}}}},
+			{Tag: "TRK ", Features: []LayoutFeature{{"locl", []int{2}}}},
+		}},
+	}}}}
+	if f := a.Features("latn", DefaultLanguage); len(f) != 2 || f[0] != "ccmp" {
+		t.Errorf("expected sorted features for latn/dflt, have %v", f)
+	}
+	if l := a.Languages(); len(l) != 1 || l[0] != "TRK " {
+		t.Errorf("expected language TRK, have %v", l)
+	}
+	b := a
+	b.Layout = []LayoutTable{{Tag: "GSUB", Scripts: []LayoutScript{{Tag: "latn"}}}}
+	if diffs := a.Compare(b); len(diffs) != 1 {
+		t.Errorf("expected language systems to differ, have %v", diffs)
+	}
+	b.Layout = []LayoutTable{{Tag: "GSUB", Scripts: []LayoutScript{
+		{Tag: "latn", Languages: []LayoutLanguage{
+			{Tag: DefaultLanguage, Features: []LayoutFeature{{"ccmp", []int{0}}, {"liga", []int{3}}}},
+			{Tag: "TRK ", Features: []LayoutFeature{{"locl", []int{2}}}},
+		}},
+	}}}
+	if diffs := a.Compare(b); len(diffs) != 1 {
+		t.Errorf("expected lookups of liga to differ, have %v", diffs)
+	}
+}
+
+func TestScriptConversion(t *testing.T) {
+	s := DetectScript([]rune("1. سلام"))
+	if !IsRightToLeft(s) {
+		t.Errorf("expected Arabic to be detected as right-to-left, have %v", s)
+	}
+	script, err := ScriptFromHB(s)
+	if err != nil || script.String() != "Arab" || Script4HB(script) != s {
+		t.Errorf("expected script Arab, have %v (%v)", script, err)
+	}
+	if DetectScript([]rune("1, 2.")) != 0 {
+		t.Error("expected no script for digits and punctuation")
+	}
+}
+
+func TestCheckRun(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.base")
+	defer teardown()
+	//
+	run := []ShapedGlyph{
+		{GID: 1, Cluster: 0, XAdvance: 5},
+		{GID: 2, Cluster: 1, XAdvance: 5, Flags: UnsafeToBreak},
+		{GID: 3, Cluster: 1, XOffset: -2, Flags: UnsafeToBreak},
+		{GID: 4, Cluster: 3, XAdvance: 5},
+	}
+	if err := CheckRun(run, 4, false, 10); err != nil {
+		t.Errorf("expected run to be valid, have %v", err)
+	}
+	reversed := []ShapedGlyph{run[3], run[2], run[1], run[0]}
+	if err := CheckRun(reversed, 4, true, 10); err != nil {
+		t.Errorf("expected right-to-left run to be valid, have %v", err)
+	}
+	for dir, backward := range map[int32]bool{4: false, 5: true, 6: false, 7: true} {
+		if IsBackward(dir) != backward {
+			t.Errorf("expected IsBackward(%d) to be %v", dir, backward)
+		}
+	}
+	inf := math.Inf(1)
+	for i, invalid := range []struct {
+		glyphs []ShapedGlyph
+		rtl    bool
+	}{
+		{reversed, false}, // not monotonic
+		{run[1:], false},  // character 0 not covered
+		{[]ShapedGlyph{{GID: 1, Cluster: 4}}, false},
+		{[]ShapedGlyph{{GID: 10, Cluster: 0}}, false},
+		{[]ShapedGlyph{{GID: 1, Cluster: 0, XAdvance: inf}}, false},
+		{[]ShapedGlyph{{GID: 1, Cluster: 0, YOffset: math.NaN()}}, false},
+		{[]ShapedGlyph{{GID: 1, Cluster: 0}, {GID: 2, Cluster: 0, Flags: UnsafeToBreak}}, false},
+	} {
+		err := CheckRun(invalid.glyphs, 4, invalid.rtl, 10)
+		if _, ok := err.(*InvariantError); !ok {
+			t.Errorf("expected run %d to violate invariants, have %v", i, err)
+		} else {
+			t.Logf("run %d: %v", i, err)
+		}
+	}
+}
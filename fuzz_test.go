@@ -0,0 +1,49 @@
+//go:build go1.18
+// +build go1.18
+
+package harfbuzzgoperf
+
+import (
+	"path/filepath"
+	"testing"
+
+	hb "github.com/benoitkugler/textlayout/harfbuzz"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// FuzzParseFace feeds the font loader with arbitrary bytes, seeded with the
+// embedded fonts and truncated copies of them. Fonts which parse have to map
+// characters to glyphs and provide glyph metrics. They are not shaped:
+// textlayout caches shape plans per face for the lifetime of the process, which
+// would exhaust memory with a new face per input.
+func FuzzParseFace(f *testing.F) {
+	binaries := [][]byte{goregular.TTF}
+	fonts, _ := resources.ReadDir("resources/fonts")
+	for _, font := range fonts {
+		binary, _ := resources.ReadFile(filepath.Join("resources", "fonts", font.Name()))
+		binaries = append(binaries, binary)
+	}
+	for _, binary := range binaries {
+		f.Add(binary)
+		f.Add(binary[:len(binary)/2])
+		f.Add(binary[:1024])
+		f.Add(binary[:12]) // font header only
+	}
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, binary []byte) {
+		face, err := ParseFace("fuzz", binary)
+		if err != nil {
+			return
+		}
+		if face.Weight < 1 || face.Weight > 1000 {
+			t.Errorf("weight out of range: %d", face.Weight)
+		}
+		font := hb.NewFont(face.GoFace)
+		for _, r := range "Fuzz ﬁ" {
+			if gid, ok := face.GoFace.NominalGlyph(r); ok {
+				font.GlyphHAdvance(gid)
+				font.GlyphExtents(gid)
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package harfbuzzgoperf
+
+import "golang.org/x/text/language"
+
+// --- Backend-neutral shaping output ----------------------------------------
+
+// ShapedGlyph is a glyph as output by one of the shaping backends. Positions are
+// converted to points, and clusters always refer to rune indices of the input
+// text, regardless of the backend in use.
+type ShapedGlyph struct {
+	GID      uint32  // glyph ID, relative to the font
+	Cluster  int     // index of the first rune of the input text this glyph belongs to
+	XAdvance float64 // horizontal advance in pt
+	YAdvance float64 // vertical advance in pt
+	XOffset  float64 // horizontal offset in pt
+	YOffset  float64 // vertical offset in pt
+	Flags    GlyphFlags
+}
+
+// GlyphFlags are flags attached to glyphs by the shaper.
+type GlyphFlags uint32
+
+// Flags as defined by HarfBuzz. Please note that textlayout's port of HarfBuzz
+// does not produce UnsafeToConcat.
+const (
+	// UnsafeToBreak is set if breaking the text at the beginning of the cluster
+	// of the glyph needs both sides to be re-shaped.
+	UnsafeToBreak GlyphFlags = 0x01
+	// UnsafeToConcat is set if shaping the text on both sides of the beginning of
+	// the cluster of the glyph separately and concatenating the results might
+	// differ from shaping the text as a whole.
+	UnsafeToConcat GlyphFlags = 0x02
+)
+
+// Shaper is a shaping backend producing backend-neutral glyphs. Segment
+// properties, font and features are part of the shaper's configuration.
+type Shaper interface {
+	Shape(text []rune) ([]ShapedGlyph, error)
+}
+
+// ShapeKey identifies the configuration of a shaper. Shapers with equal keys
+// produce equal glyphs for equal input.
+type ShapeKey struct {
+	Backend   string  // "go" or "c"
+	Font      *HBFont // font
+	Instance  uintptr // native font instance, if any
+	PtSize    float32 // font size
+	Features  string  // features to apply, in a canonical string form
+	Direction int     // writing direction
+	Script    string  // 4-letter ISO 15924 script identifier
+	Language  string  // BCP 47 language tag
+	Shapers   string  // comma separated shaper list, if not the default
+}
+
+// Segment is a run of text of a single script and direction.
+type Segment struct {
+	Text        []rune
+	Script      language.Script // zero if unknown
+	RightToLeft bool
+}
+
+// SegmentShaper is a shaper able to shape segments with a script and direction
+// of their own, overriding the shaper's configuration.
+type SegmentShaper interface {
+	Shaper
+	ShapeSegment(seg Segment) ([]ShapedGlyph, error)
+}
+
+// KeyedShaper is a shaper able to report its configuration.
+type KeyedShaper interface {
+	Shaper
+	Key() ShapeKey
+}
+
+// RunWidth returns the sum of the horizontal advances of a sequence of glyphs.
+func RunWidth(glyphs []ShapedGlyph) float64 {
+	var w float64
+	for _, g := range glyphs {
+		w += g.XAdvance
+	}
+	return w
+}
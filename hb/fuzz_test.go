@@ -0,0 +1,75 @@
+//go:build go1.18
+// +build go1.18
+
+package hb
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
+	hb "github.com/benoitkugler/textlayout/harfbuzz"
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// fuzzTags are the feature tags shaped with while fuzzing.
+var fuzzTags = []string{"liga", "kern", "smcp", "onum", "frac", "salt"}
+
+// fuzzFeatures parses a comma separated list of features and keeps at most two
+// of them with a tag of fuzzTags and values 0 or 1. Every combination of
+// features compiles a shape plan, and textlayout caches shape plans for the
+// lifetime of the process.
+func fuzzFeatures(features string) []hb.Feature {
+	var ff []hb.Feature
+	for _, s := range strings.Split(features, ",") {
+		f, err := hb.ParseFeature(s)
+		if err != nil {
+			continue
+		}
+		for _, tag := range fuzzTags {
+			if f.Tag == tt.MustNewTag(tag) {
+				if f.Value > 1 {
+					f.Value = 1
+				}
+				ff = append(ff, f)
+			}
+		}
+		if len(ff) == 2 {
+			break
+		}
+	}
+	return ff
+}
+
+// FuzzShape shapes arbitrary text with arbitrary features, seeded with the
+// corpus.
+func FuzzShape(f *testing.F) {
+	for _, line := range harfbuzzgoperf.Corpus {
+		f.Add(line, "")
+	}
+	f.Add("ﬁnal ¼ office", "-liga,+frac")
+	f.Add("Wäffle", "liga=0,kern[2:4]")
+	f.Add("שלום", "salt=3")
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := GetHBParams("Go", 12.0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, text, features string) {
+		if !utf8.ValidString(text) {
+			return
+		}
+		p := *params
+		p.Features = fuzzFeatures(features)
+		runes := []rune(text)
+		buf, err := Shape(runes, nil, &p)
+		if err != nil {
+			return
+		}
+		backward := harfbuzzgoperf.IsBackward(int32(buf.Props.Direction))
+		if err = harfbuzzgoperf.CheckRun(Glyphs(buf, &p), len(runes), backward, p.Font.NumGlyphs()); err != nil {
+			t.Error(err)
+		}
+	})
+}
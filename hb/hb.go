@@ -24,17 +24,48 @@ type HBParams struct {
 	Features  []hb.Feature           // OpenType features to apply
 }
 
+// GetHBParams prepares parameters for shaping with a font at a given point size.
+// fontname is either the name of a font in the global font store, or a CSS-style
+// font query (see harfbuzzgoperf.ParseFontQuery), e.g. "bold Go".
 func GetHBParams(fontname string, ptsize float32) (*HBParams, error) {
 	p := &HBParams{}
 	p.Font = harfbuzzgoperf.GlobalFontStore.FindFont(fontname)
-	if p.Font == nil {
-		return nil, fmt.Errorf("cannot find font %q", fontname)
+	if p.Font == nil { // try to match fontname as a CSS-style font query
+		q, err := harfbuzzgoperf.ParseFontQuery(fontname)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find font %q", fontname)
+		}
+		face, err := harfbuzzgoperf.GlobalFontStore.MatchFace(q)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find font %q", fontname)
+		}
+		if p.Font, err = FontInstance(nil, face, ptsize, ""); err != nil {
+			return nil, err
+		}
 	}
 	p.PtSize = ptsize
 	tracer().Infof("preparing font %q at %.2fpt", fontname, ptsize)
 	return p, nil
 }
 
+// FontView returns a copy of params with a private HarfBuzz font object for the
+// same face. HarfBuzz font objects hold per-font data (layout accelerators),
+// whereas the parsed face is shared read-only. Shapers on different goroutines
+// should each use their own font view.
+func (p *HBParams) FontView() *HBParams {
+	view := *p
+	if p.Font == nil {
+		return &view
+	}
+	font := *p.Font
+	font.GoFont = hb.NewFont(p.Font.GoFont.Face())
+	font.GoFont.XScale, font.GoFont.YScale = p.Font.GoFont.XScale, p.Font.GoFont.YScale
+	font.GoFont.XPpem, font.GoFont.YPpem = p.Font.GoFont.XPpem, p.Font.GoFont.YPpem
+	font.GoFont.Ptem = p.Font.GoFont.Ptem
+	view.Font = &font
+	return &view
+}
+
 // Shape calls the HarfBuzz shaper.
 //
 // Shape shapes a sequence of code-points (runes), turning its Unicode characters to
@@ -46,7 +77,8 @@ func GetHBParams(fontname string, ptsize float32) (*HBParams, error) {
 // overlapping ranges the value of the feature with the higher index takes
 // precedence.
 //
-// params.Font must be set, otherwise no output is created.
+// params.Font must be set, otherwise no output is created. In debug mode (see
+// harfbuzzgoperf.Debug), the output is checked with harfbuzzgoperf.CheckRun.
 //
 func Shape(text []rune, buf *hb.Buffer, params *HBParams) (*hb.Buffer, error) {
 	if len(text) == 0 || params.Font == nil {
@@ -60,10 +92,143 @@ func Shape(text []rune, buf *hb.Buffer, params *HBParams) (*hb.Buffer, error) {
 		buf.Clear()
 	}
 	buf.AddRunes(text, 0, len(text))
+	buf.Props = segmentProps(text, params)
 	buf.Shape(params.Font.GoFont, params.Features)
 	// Prepare shaped output
 	if len(buf.Info) == 0 {
 		return buf, fmt.Errorf("nothing got shaped")
 	}
+	if harfbuzzgoperf.Debug {
+		return buf, checkRun(buf, len(text), params)
+	}
 	return buf, nil
 }
+
+// checkRun checks the shaping output in buf for a text of n characters with
+// harfbuzzgoperf.CheckRun.
+func checkRun(buf *hb.Buffer, n int, params *HBParams) error {
+	backward := harfbuzzgoperf.IsBackward(int32(buf.Props.Direction))
+	return harfbuzzgoperf.CheckRun(Glyphs(buf, params), n, backward, params.Font.NumGlyphs())
+}
+
+// segmentProps prepares the segment properties of a HarfBuzz buffer from params.
+// HarfBuzz won't guess unset properties by itself (a zero direction will result
+// in vertical text), so we fill in script and direction from the text, if
+// they are unset in params.
+func segmentProps(text []rune, params *HBParams) hb.SegmentProperties {
+	props := hb.SegmentProperties{Direction: params.Direction}
+	if params.Script != (language.Script{}) {
+		props.Script = harfbuzzgoperf.Script4HB(params.Script)
+	} else {
+		props.Script = harfbuzzgoperf.DetectScript(text)
+	}
+	if params.Language != language.Und {
+		props.Language = harfbuzzgoperf.Lang4HB(params.Language)
+	}
+	if props.Direction == 0 {
+		props.Direction = hb.LeftToRight
+		if harfbuzzgoperf.IsRightToLeft(props.Script) {
+			props.Direction = hb.RightToLeft
+		}
+	}
+	return props
+}
+
+// Glyphs converts the output of a shaper run to backend-neutral glyphs.
+// HarfBuzz positions are expressed in font units (the font's scale is left
+// at its default of units-per-em) and will be scaled to `params.PtSize`.
+func Glyphs(buf *hb.Buffer, params *HBParams) []harfbuzzgoperf.ShapedGlyph {
+	if buf == nil {
+		return nil
+	}
+	return AppendGlyphs(make([]harfbuzzgoperf.ShapedGlyph, 0, len(buf.Info)), buf, params)
+}
+
+// AppendGlyphs is like Glyphs, but appends the glyphs to dst, re-using its
+// storage.
+func AppendGlyphs(dst []harfbuzzgoperf.ShapedGlyph, buf *hb.Buffer, params *HBParams) []harfbuzzgoperf.ShapedGlyph {
+	if buf == nil || params.Font == nil {
+		return dst
+	}
+	scale := float64(params.PtSize) / float64(params.Font.GoFont.XScale)
+	for i, info := range buf.Info {
+		pos := buf.Pos[i]
+		dst = append(dst, harfbuzzgoperf.ShapedGlyph{
+			GID:      uint32(info.Glyph),
+			Cluster:  info.Cluster,
+			XAdvance: float64(pos.XAdvance) * scale,
+			YAdvance: float64(pos.YAdvance) * scale,
+			XOffset:  float64(pos.XOffset) * scale,
+			YOffset:  float64(pos.YOffset) * scale,
+			Flags:    harfbuzzgoperf.GlyphFlags(info.Mask & hb.GlyphUnsafeToBreak),
+		})
+	}
+	return dst
+}
+
+// Shaper is a shaper for backend-neutral glyphs, re-using its HarfBuzz buffer.
+// A Shaper is not safe for concurrent use.
+type Shaper struct {
+	Params *HBParams
+	buf    *hb.Buffer
+}
+
+// NewShaper creates a shaper for params.
+func NewShaper(params *HBParams) *Shaper {
+	return &Shaper{Params: params}
+}
+
+// Shape is part of interface harfbuzzgoperf.Shaper.
+func (s *Shaper) Shape(text []rune) ([]harfbuzzgoperf.ShapedGlyph, error) {
+	buf, err := Shape(text, s.buf, s.Params)
+	s.buf = buf
+	if err != nil {
+		return nil, err
+	}
+	return Glyphs(buf, s.Params), nil
+}
+
+// ShapeSegment is part of interface harfbuzzgoperf.SegmentShaper.
+func (s *Shaper) ShapeSegment(seg harfbuzzgoperf.Segment) ([]harfbuzzgoperf.ShapedGlyph, error) {
+	params := *s.Params
+	params.Script, params.Direction = seg.Script, hb.LeftToRight
+	if seg.RightToLeft {
+		params.Direction = hb.RightToLeft
+	}
+	buf, err := Shape(seg.Text, s.buf, &params)
+	s.buf = buf
+	if err != nil {
+		return nil, err
+	}
+	return Glyphs(buf, &params), nil
+}
+
+// Key is part of interface harfbuzzgoperf.KeyedShaper.
+func (s *Shaper) Key() harfbuzzgoperf.ShapeKey {
+	return shapeKey(s.Params)
+}
+
+func shapeKey(params *HBParams) harfbuzzgoperf.ShapeKey {
+	key := harfbuzzgoperf.ShapeKey{
+		Backend:   "go",
+		Font:      params.Font,
+		PtSize:    params.PtSize,
+		Direction: int(params.Direction),
+	}
+	if params.Script != (language.Script{}) {
+		key.Script = params.Script.String()
+	}
+	if params.Language != language.Und {
+		key.Language = params.Language.String()
+	}
+	if len(params.Features) > 0 {
+		key.Features = fmt.Sprint(params.Features)
+	}
+	return key
+}
+
+// NewView creates a shaper for use on another goroutine. It has a buffer of its
+// own and uses a view of the HarfBuzz font (see HBParams.FontView).
+func (s *Shaper) NewView() *Shaper {
+	return NewShaper(s.Params.FontView())
+}
@@ -26,6 +26,241 @@ func TestShapeSimple(t *testing.T) {
 	t.Logf("# of glyphs = %d", len(buf.Info))
 }
 
+func TestGlyphs(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.base")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := GetHBParams("Go", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := []rune("Wäffle")
+	buf, err := Shape(text, nil, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	glyphs := Glyphs(buf, params)
+	if len(glyphs) != 6 {
+		t.Fatalf("expected 6 glyphs, have %d", len(glyphs))
+	}
+	for i, g := range glyphs {
+		if g.Cluster != i {
+			t.Errorf("expected glyph #%d to have cluster %d, has %d", i, i, g.Cluster)
+		}
+		if g.XAdvance <= 0 || g.XAdvance > 12.0 {
+			t.Errorf("expected horizontal advance of glyph #%d to be within font size, is %.2f", i, g.XAdvance)
+		}
+	}
+}
+
+func TestInvariants(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.base")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	texts := append([][]rune{[]rune("שלום, עולם!"), []rune("ﬁnal ¼ office")}, harfbuzzgoperf.CorpusRunes...)
+	for _, fontname := range []string{"Go", "GoBold.ttf", "Calibri.ttf"} {
+		params, err := GetHBParams(fontname, 12.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf *hb.Buffer
+		for i, text := range texts {
+			if buf, err = Shape(text, buf, params); err != nil {
+				t.Fatal(err)
+			}
+			backward := harfbuzzgoperf.IsBackward(int32(buf.Props.Direction))
+			if err = harfbuzzgoperf.CheckRun(Glyphs(buf, params), len(text), backward, params.Font.NumGlyphs()); err != nil {
+				t.Errorf("%s, text #%d: %v", fontname, i, err)
+			}
+		}
+	}
+}
+
+func TestContextPool(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.base")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := GetHBParams("Go", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := harfbuzzgoperf.CorpusRunes[0]
+	buf, err := Shape(text, nil, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Glyphs(buf, params)
+	for i := 0; i < 3; i++ {
+		ctx := AcquireContext(params)
+		glyphs, err := ctx.Shape(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(glyphs) != len(expected) || glyphs[len(glyphs)-1] != expected[len(expected)-1] {
+			t.Errorf("expected pooled context to produce same output as plain shaping")
+		}
+		ctx.Release()
+	}
+}
+
+func TestLayoutTables(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.hb")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	font := harfbuzzgoperf.GlobalFontStore.FindFont("Go")
+	tables, err := LayoutTables(font)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := font.Info()
+	if diffs := harfbuzzgoperf.CompareLayout(tables, info.Layout); len(diffs) > 0 {
+		t.Errorf("expected layout tables to match font info, differ in %v", diffs)
+	}
+	if _, err = LayoutTables(&harfbuzzgoperf.HBFont{}); err == nil {
+		t.Error("expected error for font without Go font object")
+	}
+}
+
+func TestGetHBParamsQuery(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.hb")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := GetHBParams("bold Go", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Font.Face == nil || params.Font.Face.Name != "GoBold.ttf" {
+		t.Errorf("expected query to match GoBold.ttf, have %v", params.Font.Face)
+	}
+	if _, err = GetHBParams("Helvetica", 12.0); err == nil {
+		t.Error("expected error for missing font")
+	}
+}
+
+func TestFontInstance(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.hb")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	face := harfbuzzgoperf.GlobalFontStore.FindFace("Go")
+	cache := harfbuzzgoperf.NewInstanceCache(1 << 20)
+	f12, err := FontInstance(cache, face, 12, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f24, _ := FontInstance(cache, face, 24, "")
+	if again, _ := FontInstance(cache, face, 12, ""); again != f12 {
+		t.Error("expected instance to be cached")
+	}
+	if f12.GoFont.Face() != f24.GoFont.Face() {
+		t.Error("expected instances to share the face")
+	}
+	text := []rune("Instance")
+	g12, _ := NewShaper(InstanceParams(f12)).Shape(text)
+	g24, _ := NewShaper(InstanceParams(f24)).Shape(text)
+	if w12, w24 := harfbuzzgoperf.RunWidth(g12), harfbuzzgoperf.RunWidth(g24); w12 == 0 || w24 != 2*w12 {
+		t.Errorf("expected width to scale with size, have %.2f and %.2f", w12, w24)
+	}
+	fvar, err := FontInstance(cache, face, 12, "wght=700")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fvar == f12 || fvar.GoFont.Face() == f12.GoFont.Face() {
+		t.Error("expected instance with variations to have a face of its own")
+	}
+	if stats := cache.Stats(); stats.Instances != 3 || stats.Hits != 1 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+}
+
+func TestShapePlan(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.hb")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := GetHBParams("Go", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := []rune("Plan ahead")
+	plan, err := NewShapePlan(text, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Props.Direction != hb.LeftToRight {
+		t.Errorf("expected plan for left-to-right text, have direction %v", plan.Props.Direction)
+	}
+	planned, err := plan.Execute(text, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, _ := Shape(text, nil, params)
+	g1, g2 := Glyphs(planned, params), Glyphs(direct, params)
+	if len(g1) != len(g2) {
+		t.Fatalf("expected plan to shape like Shape, have %d and %d glyphs", len(g1), len(g2))
+	}
+	for i := range g1 {
+		if g1[i] != g2[i] {
+			t.Errorf("glyph %d differs: %+v vs. %+v", i, g1[i], g2[i])
+		}
+	}
+}
+
+func TestShapers(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.hb")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := GetHBParams("Calibri.ttf", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shaper := params.Shaper(); shaper != ShaperOT {
+		t.Errorf("expected OpenType shaper, have %q", shaper)
+	}
+	if same, _ := params.WithShapers([]string{"ot", "fallback"}); same != params {
+		t.Error("expected params to be unchanged for OpenType shaper")
+	}
+	fallback, err := params.WithShapers([]string{"fallback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shaper := fallback.Shaper(); shaper != ShaperFallback {
+		t.Errorf("expected fallback shaper, have %q", shaper)
+	}
+	text := []rune("office")
+	ot, _ := NewShaper(params).Shape(text)
+	fb, err := NewShaper(fallback).Shape(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fb) != len(text) {
+		t.Errorf("expected fallback shaper to map characters 1:1, have %d glyphs", len(fb))
+	}
+	t.Logf("ot: %d glyphs, fallback: %d glyphs", len(ot), len(fb))
+	back, err := fallback.WithShapers([]string{"ot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shaper := back.Shaper(); shaper != ShaperOT {
+		t.Errorf("expected OpenType shaper for fallback params, have %q", shaper)
+	}
+	if again, _ := NewShaper(back).Shape(text); len(again) != len(ot) {
+		t.Errorf("expected %d glyphs with OpenType shaper, have %d", len(ot), len(again))
+	}
+	if _, err = params.WithShapers([]string{"graphite2"}); err == nil {
+		t.Error("expected error for Graphite shaper")
+	}
+	if _, err = params.WithShapers([]string{"coretext"}); err == nil {
+		t.Error("expected error for unsupported shaper")
+	}
+}
+
 // --- Benchmarking ----------------------------------------------------------
 
 var buf *hb.Buffer
@@ -46,3 +281,53 @@ func BenchmarkHBShape(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkHBShapeReuse(b *testing.B) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	fontname := "Calibri.ttf"
+	params, err := GetHBParams(fontname, 12.0)
+	if err != nil {
+		b.Fatalf("cannot prepare font %q", fontname)
+	}
+	buf = hb.NewBuffer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range harfbuzzgoperf.CorpusRunes {
+			buf, err = Shape(line, buf, params)
+			if err != nil {
+				b.Fatal("expected shaping output to be non-nil")
+			}
+		}
+	}
+}
+
+var glyphs []harfbuzzgoperf.ShapedGlyph
+
+func BenchmarkHBGlyphs(b *testing.B) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	fontname := "Calibri.ttf"
+	params, err := GetHBParams(fontname, 12.0)
+	if err != nil {
+		b.Fatalf("cannot prepare font %q", fontname)
+	}
+	b.Run("no-reuse", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, line := range harfbuzzgoperf.CorpusRunes {
+				if buf, err = Shape(line, nil, params); err != nil {
+					b.Fatal(err)
+				}
+				glyphs = Glyphs(buf, params)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ctx := AcquireContext(params)
+			for _, line := range harfbuzzgoperf.CorpusRunes {
+				if glyphs, err = ctx.Shape(line); err != nil {
+					b.Fatal(err)
+				}
+			}
+			ctx.Release()
+		}
+	})
+}
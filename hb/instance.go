@@ -0,0 +1,61 @@
+package hb
+
+import (
+	"bytes"
+
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
+	hb "github.com/benoitkugler/textlayout/harfbuzz"
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// Estimated memory of a font instance, not counting the face. textlayout builds
+// layout accelerators per font object.
+const instanceOverhead = 64 << 10
+
+// FontInstance returns a font instance of face at a given point size, with
+// variations applied, from an instance cache. If cache is nil, the global
+// instance cache is used.
+//
+// Instances without variations share the face. textlayout stores variation
+// coordinates with the face, therefore instances with variations have to use a
+// face of their own. textlayout does not support synthetic slant.
+func FontInstance(cache *harfbuzzgoperf.InstanceCache, face *harfbuzzgoperf.Face, ptsize float32,
+	variations string) (*harfbuzzgoperf.HBFont, error) {
+	//
+	if cache == nil {
+		cache = harfbuzzgoperf.GlobalInstances
+	}
+	canonical, vars, err := harfbuzzgoperf.CanonicalVariations(variations)
+	if err != nil {
+		return nil, err
+	}
+	key := harfbuzzgoperf.InstanceKey{
+		Backend:    "go",
+		Face:       face,
+		Size:       ptsize,
+		Variations: canonical,
+	}
+	return cache.Instance(key, func() (*harfbuzzgoperf.HBFont, int64, error) {
+		goface, size := face.GoFace, int64(instanceOverhead)
+		if len(vars) > 0 {
+			if goface, err = tt.Parse(bytes.NewReader(face.Binary), true); err != nil {
+				return nil, 0, err
+			}
+			tt.SetVariations(goface, vars)
+			size += int64(len(face.Binary))
+		}
+		font := &harfbuzzgoperf.HBFont{
+			Binary: face.Binary,
+			GoFont: hb.NewFont(goface),
+			Face:   face,
+			Size:   ptsize,
+		}
+		font.GoFont.Ptem = ptsize
+		return font, size, nil
+	})
+}
+
+// InstanceParams returns shaping parameters for a font instance.
+func InstanceParams(font *harfbuzzgoperf.HBFont) *HBParams {
+	return &HBParams{Font: font, PtSize: font.Size}
+}
@@ -0,0 +1,21 @@
+package hb
+
+import (
+	"errors"
+
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// LayoutTables lists scripts, language systems and features (with lookup
+// indices) of the GSUB and GPOS tables of a font, as seen by textlayout.
+func LayoutTables(font *harfbuzzgoperf.HBFont) ([]harfbuzzgoperf.LayoutTable, error) {
+	if font == nil || font.GoFont == nil {
+		return nil, errors.New("no font to inspect")
+	}
+	face, ok := font.GoFont.Face().(*tt.Font)
+	if !ok {
+		return nil, errors.New("font is not an OpenType font")
+	}
+	return harfbuzzgoperf.ReadLayoutTables(face), nil
+}
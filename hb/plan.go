@@ -0,0 +1,63 @@
+package hb
+
+import (
+	"errors"
+
+	hb "github.com/benoitkugler/textlayout/harfbuzz"
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// ShapePlan fixes the font, segment properties and features for shaping.
+//
+// textlayout does not export its shape plans: it compiles a plan on first use
+// of a combination of face, segment properties and features, and caches it for
+// the lifetime of the process. A ShapePlan is a key into this cache, which is
+// compiled when the plan is created. Executing it looks the plan up again,
+// which is cheap.
+type ShapePlan struct {
+	Params *HBParams
+	Props  hb.SegmentProperties
+}
+
+// NewShapePlan returns a shape plan for params and the segment properties of
+// text, compiling it if it is not cached yet.
+func NewShapePlan(text []rune, params *HBParams) (*ShapePlan, error) {
+	if params.Font == nil {
+		return nil, errors.New("no font for shape plan")
+	}
+	p := &ShapePlan{Params: params, Props: segmentProps(text, params)}
+	p.Compile()
+	return p, nil
+}
+
+// Compile compiles the plan for the font of its params, if it is not cached
+// yet, by shaping an empty buffer. With a font of a face not used before,
+// Compile measures the cost of plan compilation.
+func (p *ShapePlan) Compile() {
+	buf := hb.NewBuffer()
+	buf.Props = p.Props
+	buf.Shape(p.Params.Font.GoFont, p.Params.Features)
+}
+
+// Execute shapes text with the plan, like Shape. In debug mode, the output is
+// checked like the output of Shape.
+func (p *ShapePlan) Execute(text []rune, buf *hb.Buffer) (*hb.Buffer, error) {
+	if len(text) == 0 {
+		return buf, errors.New("no input to shape")
+	}
+	if buf == nil {
+		buf = hb.NewBuffer()
+	} else {
+		buf.Clear()
+	}
+	buf.AddRunes(text, 0, len(text))
+	buf.Props = p.Props
+	buf.Shape(p.Params.Font.GoFont, p.Params.Features)
+	if len(buf.Info) == 0 {
+		return buf, errors.New("nothing got shaped")
+	}
+	if harfbuzzgoperf.Debug {
+		return buf, checkRun(buf, len(text), p.Params)
+	}
+	return buf, nil
+}
@@ -0,0 +1,59 @@
+package hb
+
+import (
+	"sync"
+
+	hb "github.com/benoitkugler/textlayout/harfbuzz"
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// --- Pooled shaping contexts -----------------------------------------------
+
+// Context is a pooled shaping context. It holds a HarfBuzz buffer and an output
+// slice of glyphs, both of which are re-used between calls to Shape and between
+// users of the pool.
+//
+// Contexts are acquired with AcquireContext and should be released after use.
+// A Context is not safe for concurrent use.
+type Context struct {
+	Params *HBParams
+	buf    *hb.Buffer
+	out    []harfbuzzgoperf.ShapedGlyph
+}
+
+var contextPool = sync.Pool{
+	New: func() interface{} {
+		return &Context{buf: hb.NewBuffer()}
+	},
+}
+
+// AcquireContext gets a shaping context for params from the pool.
+func AcquireContext(params *HBParams) *Context {
+	ctx := contextPool.Get().(*Context)
+	ctx.Params = params
+	return ctx
+}
+
+// Release puts ctx back into the pool. Neither ctx nor glyphs returned from
+// ctx.Shape may be used afterwards.
+func (ctx *Context) Release() {
+	ctx.Params = nil
+	ctx.out = ctx.out[:0]
+	contextPool.Put(ctx)
+}
+
+// Shape is part of interface harfbuzzgoperf.Shaper. The glyphs returned are
+// valid until the next call to Shape or Release.
+func (ctx *Context) Shape(text []rune) ([]harfbuzzgoperf.ShapedGlyph, error) {
+	buf, err := Shape(text, ctx.buf, ctx.Params)
+	if err != nil {
+		return nil, err
+	}
+	ctx.out = AppendGlyphs(ctx.out[:0], buf, ctx.Params)
+	return ctx.out, nil
+}
+
+// Key is part of interface harfbuzzgoperf.KeyedShaper.
+func (ctx *Context) Key() harfbuzzgoperf.ShapeKey {
+	return shapeKey(ctx.Params)
+}
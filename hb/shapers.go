@@ -0,0 +1,87 @@
+package hb
+
+import (
+	"fmt"
+
+	hb "github.com/benoitkugler/textlayout/harfbuzz"
+)
+
+// Names of shapers, as used by Harfbuzz.
+const (
+	ShaperGraphite = "graphite2"
+	ShaperOT       = "ot"
+	ShaperFallback = "fallback"
+)
+
+// fallbackFace hides the OpenType capabilities of a face from textlayout,
+// which selects its fallback shaper for fonts of faces without them.
+type fallbackFace struct {
+	hb.Face
+}
+
+// ShaperName returns the name of the shaper textlayout selects for a font:
+// Graphite for fonts with Graphite tables, OpenType for fonts with OpenType
+// capabilities and the fallback shaper otherwise.
+func ShaperName(font *hb.Font) string {
+	ot, ok := font.Face().(hb.FaceOpentype)
+	if !ok {
+		return ShaperFallback
+	}
+	if _, graphite := ot.IsGraphite(); graphite {
+		return ShaperGraphite
+	}
+	return ShaperOT
+}
+
+// Shaper returns the name of the shaper selected for params.Font.
+func (p *HBParams) Shaper() string {
+	if p.Font == nil {
+		return ""
+	}
+	return ShaperName(p.Font.GoFont)
+}
+
+// WithShapers returns a copy of params with a font selecting the first shaper
+// of a list which is able to shape with the font, like Harfbuzz' hb_shape_full.
+// textlayout does not allow to select shapers, but is able to use its
+// fallback shaper, which maps characters to nominal glyphs with their advances,
+// without any OpenType layout. "ot" is able to shape with all fonts except
+// Graphite fonts, "graphite2" only with those, including fonts of params
+// returned for the fallback shaper; other shapers are skipped. An empty list
+// leaves params unchanged.
+func (p *HBParams) WithShapers(shapers []string) (*HBParams, error) {
+	if len(shapers) == 0 || p.Font == nil {
+		return p, nil
+	}
+	current := p.Shaper()
+	face := p.Font.GoFont.Face()
+	original := current // shaper of the face without fallbackFace
+	if f, ok := face.(fallbackFace); ok {
+		face = f.Face
+		original = ShaperName(hb.NewFont(face))
+	}
+	for _, shaper := range shapers {
+		switch shaper {
+		case current:
+			return p, nil
+		case original:
+			return p.withFace(face), nil
+		case ShaperFallback:
+			return p.withFace(fallbackFace{face}), nil
+		}
+	}
+	return nil, fmt.Errorf("none of the shapers %v is able to shape with the font", shapers)
+}
+
+// withFace returns a copy of params with a font of face, scaled like the font
+// of params.
+func (p *HBParams) withFace(face hb.Face) *HBParams {
+	params := *p
+	font := *p.Font
+	font.GoFont = hb.NewFont(face)
+	font.GoFont.XScale, font.GoFont.YScale = p.Font.GoFont.XScale, p.Font.GoFont.YScale
+	font.GoFont.XPpem, font.GoFont.YPpem = p.Font.GoFont.XPpem, p.Font.GoFont.YPpem
+	font.GoFont.Ptem = p.Font.GoFont.Ptem
+	params.Font = &font
+	return &params
+}
@@ -0,0 +1,119 @@
+//go:build go1.18
+// +build go1.18
+
+package hbc_test
+
+import (
+	"math"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+	"github.com/npillmayer/harfbuzzgoperf/hbc"
+	"golang.org/x/text/language"
+)
+
+// fuzzFaceInputs is the number of inputs shaped with a Harfbuzz face while
+// fuzzing. Harfbuzz caches the shape plan of every combination of features for
+// the lifetime of a face, therefore faces are renewed.
+const fuzzFaceInputs = 256
+
+// FuzzHarfbuzzShape shapes arbitrary text with arbitrary features, seeded with
+// the corpus. Feature strings are parsed by Harfbuzz as they are.
+func FuzzHarfbuzzShape(f *testing.F) {
+	for _, line := range harfbuzzgoperf.Corpus {
+		f.Add(line, "")
+	}
+	f.Add("ﬁnal ¼ office", "-liga,+frac")
+	f.Add("Wäffle", "liga=0,kern[2:4]")
+	f.Add("שלום", "salt=3")
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	face := harfbuzzgoperf.GlobalFontStore.FindFace("Go")
+	if face == nil {
+		f.Fatal("expected to find font Go Sans")
+	}
+	var hbface uintptr
+	var font *harfbuzzgoperf.HBFont
+	inputs := 0
+	buf := hbc.AllocHBBuffer()
+	f.Fuzz(func(t *testing.T, text, features string) {
+		if !utf8.ValidString(text) {
+			return
+		}
+		harfbuzz := hbc.NewHarfbuzz(buf)
+		if harfbuzz.SetFeatures(features) != nil {
+			return
+		}
+		if inputs%fuzzFaceInputs == 0 {
+			if font != nil {
+				hbc.FreeFont(font)
+				hbc.FreeFace(hbface)
+			}
+			hbface = hbc.NewFace(face.Binary)
+			font = hbc.NewFont(hbface, face.Binary, 12.0)
+		}
+		inputs++
+		seq := harfbuzz.Shape(text, font.CFont)
+		n := utf8.RuneCountInString(text)
+		if err := harfbuzzgoperf.CheckRun(seq.Glyphs(text), n, false, face.GoFace.NumGlyphs); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// FuzzBackends shapes arbitrary text with both backends and reports the first
+// glyph the backends disagree about. Both are given the script and direction
+// the Go backend derives from the text.
+func FuzzBackends(f *testing.F) {
+	for _, line := range harfbuzzgoperf.Corpus {
+		f.Add(line)
+	}
+	f.Add("ﬁnal ¼ office")
+	f.Add("Wäffle")
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Go", 12.0)
+	if err != nil {
+		f.Fatal(err)
+	}
+	font := *params.Font
+	font.CFont = hbc.MakeHBFont(font.Binary, 12.0)
+	shaper := hbc.NewShaper(&font)
+	unknown := language.MustParseScript("Zzzz")
+	f.Fuzz(func(t *testing.T, text string) {
+		if !utf8.ValidString(text) {
+			return
+		}
+		runes := []rune(text)
+		buf, err := hb.Shape(runes, nil, params)
+		if err != nil {
+			return
+		}
+		goGlyphs := hb.Glyphs(buf, params)
+		shaper.Script, shaper.Direction = unknown, hbc.LeftToRight
+		if script := harfbuzzgoperf.DetectScript(runes); script != 0 {
+			if shaper.Script, err = harfbuzzgoperf.ScriptFromHB(script); err != nil {
+				return
+			}
+			if harfbuzzgoperf.IsRightToLeft(script) {
+				shaper.Direction = hbc.RightToLeft
+			}
+		}
+		cGlyphs, err := shaper.Shape(runes)
+		if err != nil {
+			t.Fatalf("C backend cannot shape %q: %v", text, err)
+		}
+		if len(goGlyphs) != len(cGlyphs) {
+			t.Fatalf("%q: Go backend shapes %d glyphs, C backend %d", text, len(goGlyphs), len(cGlyphs))
+		}
+		for i, g := range goGlyphs {
+			c := cGlyphs[i]
+			if g.GID != c.GID || g.Cluster != c.Cluster ||
+				math.Abs(g.XAdvance-c.XAdvance) > 0.01 || math.Abs(g.YAdvance-c.YAdvance) > 0.01 ||
+				math.Abs(g.XOffset-c.XOffset) > 0.01 || math.Abs(g.YOffset-c.YOffset) > 0.01 {
+				t.Errorf("%q: backends disagree about glyph #%d: Go %+v, C %+v", text, i, g, c)
+				return
+			}
+		}
+	})
+}
@@ -9,7 +9,7 @@ package hbc
 #include <hb.h>
 #include <hb-ot.h>
 
-char *get_codepoint_from_glyph_info(hb_font_t *,hb_glyph_info_t *, int);
+char *get_codepoint_from_glyph_info(hb_font_t *,hb_glyph_info_t *, int, char *, size_t);
 hb_glyph_info_t *get_glyph_info_at(hb_glyph_info_t *, int);
 hb_glyph_position_t *get_glyph_position_at(hb_glyph_position_t *, int);
 void hb_buffer_reset (hb_buffer_t *buffer);
@@ -17,9 +17,11 @@ void hb_buffer_reset (hb_buffer_t *buffer);
 import "C"
 import (
 	"fmt"
+	"runtime"
 	"strings"
 	"unsafe"
 
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
 	"github.com/npillmayer/harfbuzzgoperf"
 )
 
@@ -67,6 +69,15 @@ func (buf *HBBuffer) Reset() {
 	resetHBBuffer(buf.hbbuf)
 }
 
+// Free releases the memory Harfbuzz holds for the buffer. The buffer must not
+// be used afterwards.
+func (buf *HBBuffer) Free() {
+	if buf.hbbuf != 0 {
+		freeHBBuffer(buf.hbbuf)
+		buf.hbbuf = 0
+	}
+}
+
 // Allocate the central Harfbuzz data structure and return a (hidden)
 // pointer to it.
 func allocHBBuffer() uintptr {
@@ -114,13 +125,114 @@ func setHBBufferScript(hbbuf uintptr, script uint32) {
 // a given font. The result of a call to this function will be
 // attached to the buffer and may be received by a successive call
 // to 'getHBGlyphInfo()'.
-func harfbuzzShape(hbbuf uintptr, text string, hbfont uintptr) {
+// With a shaper list, hb_shape_full is called, and false is returned if none of
+// the shapers succeeded.
+func harfbuzzShape(hbbuf uintptr, text string, hbfont uintptr, features hbFeatures, shapers *hbShaperList) bool {
 	ptr := (*C.struct_hb_buffer_t)(unsafe.Pointer(hbbuf))
 	fptr := (*C.struct_hb_font_t)(unsafe.Pointer(hbfont))
 	cstr := C.CString(text)
 	defer C.free(unsafe.Pointer(cstr))
-	C.hb_buffer_add_utf8(ptr, cstr, -1, 0, -1)
-	C.hb_shape(fptr, ptr, nil, 0)
+	// with an explicit length, as text may contain NUL characters
+	C.hb_buffer_add_utf8(ptr, cstr, C.int(len(text)), 0, C.int(len(text)))
+	var feats *C.hb_feature_t
+	if len(features) > 0 {
+		feats = &features[0]
+	}
+	if shapers == nil {
+		C.hb_shape(fptr, ptr, feats, C.uint(len(features)))
+		return true
+	}
+	ok := C.hb_shape_full(fptr, ptr, feats, C.uint(len(features)), shapers.list) != 0
+	runtime.KeepAlive(shapers) // the finalizer of shapers frees the list
+	return ok
+}
+
+// hbShaperList is a NULL-terminated list of shaper names, allocated in C memory.
+type hbShaperList struct {
+	list  **C.char
+	names []string
+}
+
+// newHBShaperList returns a shaper list for hb_shape_full, or nil for an empty
+// list. The list is freed when garbage collected.
+func newHBShaperList(names []string) *hbShaperList {
+	if len(names) == 0 {
+		return nil
+	}
+	n := len(names) + 1
+	ptr := C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.char)(nil))))
+	list := (*[1 << 16]*C.char)(ptr)[:n:n]
+	for i, name := range names {
+		list[i] = C.CString(name)
+	}
+	list[n-1] = nil
+	l := &hbShaperList{list: (**C.char)(ptr), names: append([]string(nil), names...)}
+	runtime.SetFinalizer(l, func(l *hbShaperList) {
+		list := (*[1 << 16]*C.char)(unsafe.Pointer(l.list))[:n:n]
+		for _, name := range list[:n-1] {
+			C.free(unsafe.Pointer(name))
+		}
+		C.free(unsafe.Pointer(l.list))
+	})
+	return l
+}
+
+// ListShapers returns the shapers supported by the Harfbuzz library linked, in
+// the order Harfbuzz tries them, e.g. "ot" and "fallback".
+func ListShapers() []string {
+	var shapers []string
+	list := C.hb_shape_list_shapers()
+	for p := list; *p != nil; p = (**C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + unsafe.Sizeof(*p))) {
+		shapers = append(shapers, C.GoString(*p))
+	}
+	return shapers
+}
+
+// Set the language for a Harfbuzz buffer, given as a BCP 47 language tag.
+func setHBBufferLanguage(hbbuf uintptr, lang string) {
+	ptr := (*C.struct_hb_buffer_t)(unsafe.Pointer(hbbuf))
+	clang := C.CString(lang)
+	defer C.free(unsafe.Pointer(clang))
+	C.hb_buffer_set_language(ptr, C.hb_language_from_string(clang, -1))
+}
+
+// hbFeatures is a list of OpenType features to apply during shaping.
+type hbFeatures []C.hb_feature_t
+
+// parseHBFeatures parses a comma separated list of features in Harfbuzz
+// syntax, e.g. "liga=0,+kern,smcp[3:5]".
+func parseHBFeatures(features string) (hbFeatures, error) {
+	var hbfeatures hbFeatures
+	for _, f := range strings.Split(features, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		var feature C.hb_feature_t
+		cstr := C.CString(f)
+		ok := C.hb_feature_from_string(cstr, -1, &feature)
+		C.free(unsafe.Pointer(cstr))
+		if ok == 0 {
+			return nil, fmt.Errorf("invalid feature %q", f)
+		}
+		hbfeatures = append(hbfeatures, feature)
+	}
+	return hbfeatures, nil
+}
+
+// Version returns the version of the Harfbuzz library linked.
+func Version() string {
+	return C.GoString(C.hb_version_string())
+}
+
+// GlyphName returns the name of a glyph as provided by the font, or an empty
+// string.
+func GlyphName(hbfont uintptr, gid uint32) string {
+	fptr := (*C.struct_hb_font_t)(unsafe.Pointer(hbfont))
+	var name [64]C.char
+	if C.hb_font_get_glyph_name(fptr, C.hb_codepoint_t(gid), &name[0], C.uint(len(name))) == 0 {
+		return ""
+	}
+	return C.GoString(&name[0])
 }
 
 // Harfbuzz uses a different font structure, created from the same
@@ -137,6 +249,68 @@ func MakeHBFont(fontdata []byte, ptsize float32) uintptr {
 	return uintptr(unsafe.Pointer(f))
 }
 
+// makeHBFace creates a Harfbuzz face from a font binary. The face is intended to
+// be shared by all fonts created from the binary. Harfbuzz keeps its own copy
+// of the binary, which is released together with the face by freeHBFace.
+func makeHBFace(fontdata []byte) uintptr {
+	var data *C.char
+	if len(fontdata) > 0 {
+		data = (*C.char)(unsafe.Pointer(&fontdata[0]))
+	}
+	// Harfbuzz copies the binary before hb_blob_create returns
+	blob := C.hb_blob_create(data, (C.uint)(len(fontdata)), C.HB_MEMORY_MODE_DUPLICATE, nil, nil)
+	face := C.hb_face_create(blob, 0)
+	C.hb_blob_destroy(blob) // face holds a reference
+	return uintptr(unsafe.Pointer(face))
+}
+
+// freeHBFace releases a Harfbuzz face.
+func freeHBFace(hbface uintptr) {
+	C.hb_face_destroy((*C.struct_hb_face_t)(unsafe.Pointer(hbface)))
+}
+
+// makeHBFontInstance creates a Harfbuzz font for a shared face, scaled to ptsize
+// and with variations and synthetic slant applied.
+func makeHBFontInstance(hbface uintptr, ptsize float32, vars []tt.Variation, slant float32) uintptr {
+	face := (*C.struct_hb_face_t)(unsafe.Pointer(hbface))
+	f := C.hb_font_create(face)
+	C.hb_ot_font_set_funcs(f)
+	sz := (C.int(int(ptsize * 64.0)))
+	C.hb_font_set_scale(f, sz, sz)
+	if len(vars) > 0 {
+		hbvars := make([]C.hb_variation_t, len(vars))
+		for i, v := range vars {
+			hbvars[i].tag = C.hb_tag_t(v.Tag)
+			hbvars[i].value = C.float(v.Value)
+		}
+		C.hb_font_set_variations(f, &hbvars[0], C.uint(len(hbvars)))
+	}
+	if slant != 0 {
+		C.hb_font_set_synthetic_slant(f, C.float(slant))
+	}
+	return uintptr(unsafe.Pointer(f))
+}
+
+// freeHBFont releases a Harfbuzz font.
+func freeHBFont(hbfont uintptr) {
+	C.hb_font_destroy((*C.struct_hb_font_t)(unsafe.Pointer(hbfont)))
+}
+
+// MakeHBFontView creates a Harfbuzz sub-font of a font created by MakeHBFont.
+// The view shares face and settings with its parent, but may be used by a
+// different goroutine.
+func MakeHBFontView(hbfont uintptr) uintptr {
+	parent := (*C.struct_hb_font_t)(unsafe.Pointer(hbfont))
+	f := C.hb_font_create_sub_font(parent)
+	return uintptr(unsafe.Pointer(f))
+}
+
+// glyphCount returns the number of glyphs of the face of a Harfbuzz font.
+func glyphCount(hbfont uintptr) int {
+	face := C.hb_font_get_face((*C.struct_hb_font_t)(unsafe.Pointer(hbfont)))
+	return int(C.hb_face_get_glyph_count(face))
+}
+
 // Retrieve the glyph information from a previous shaper-run.
 func getHBGlyphInfo(hbbuf uintptr) *HBGlyphSequence {
 	ptr := (*C.struct_hb_buffer_t)(unsafe.Pointer(hbbuf))
@@ -184,6 +358,7 @@ func (seq *HBGlyphSequence) Font() *harfbuzzgoperf.HBFont {
 type HBGlyphInfo struct {
 	glyph    rune
 	cluster  int
+	flags    harfbuzzgoperf.GlyphFlags
 	xadvance float64
 	yadvance float64
 	x        float64
@@ -197,6 +372,7 @@ func (seq *HBGlyphSequence) GetGlyphInfoAt(i int) *HBGlyphInfo {
 	pos := C.get_glyph_position_at(seq.pos, C.int(i))
 	gi.glyph = rune(info.codepoint)
 	gi.cluster = int(info.cluster)
+	gi.flags = harfbuzzgoperf.GlyphFlags(C.hb_glyph_info_get_glyph_flags(info))
 	gi.xadvance = float64(pos.x_advance) / 64.0
 	gi.yadvance = float64(pos.y_advance) / 64.0
 	gi.x = float64(pos.x_offset) / 64.0
@@ -214,6 +390,11 @@ func (gi *HBGlyphInfo) Cluster() int {
 	return gi.cluster
 }
 
+// Flags returns the glyph flags (unsafe-to-break, unsafe-to-concat) set by Harfbuzz.
+func (gi *HBGlyphInfo) Flags() harfbuzzgoperf.GlyphFlags {
+	return gi.flags
+}
+
 // Implement the GlyphInfo interface
 func (gi *HBGlyphInfo) XAdvance() float64 {
 	return gi.xadvance
@@ -234,12 +415,45 @@ func (gi *HBGlyphInfo) YPosition() float64 {
 	return gi.y
 }
 
+// Glyphs converts a Harfbuzz-result to backend-neutral glyphs. Harfbuzz
+// reports clusters as byte offsets into the UTF-8 input, which will be
+// mapped to rune indices of `text`, the string the sequence has been shaped from.
+func (seq *HBGlyphSequence) Glyphs(text string) []harfbuzzgoperf.ShapedGlyph {
+	runeIndex := make([]int, len(text)+1) // clusters always start at a rune boundary
+	r := 0
+	for i := range text {
+		runeIndex[i] = r
+		r++
+	}
+	runeIndex[len(text)] = r
+	glyphs := make([]harfbuzzgoperf.ShapedGlyph, seq.length)
+	for i := 0; i < seq.length; i++ {
+		info := C.get_glyph_info_at(seq.info, C.int(i))
+		pos := C.get_glyph_position_at(seq.pos, C.int(i))
+		cluster := int(info.cluster)
+		if cluster > len(text) {
+			cluster = len(text)
+		}
+		glyphs[i] = harfbuzzgoperf.ShapedGlyph{
+			GID:      uint32(info.codepoint),
+			Cluster:  runeIndex[cluster],
+			XAdvance: float64(pos.x_advance) / 64.0,
+			YAdvance: float64(pos.y_advance) / 64.0,
+			XOffset:  float64(pos.x_offset) / 64.0,
+			YOffset:  float64(pos.y_offset) / 64.0,
+			Flags:    harfbuzzgoperf.GlyphFlags(C.hb_glyph_info_get_glyph_flags(info)),
+		}
+	}
+	return glyphs
+}
+
 // For debugging purposes: string representation of a glyph sequence,
 // displaying code-points/glyph-IDs.
 func (seq *HBGlyphSequence) String() string {
 	var sb strings.Builder
+	var cbuf [64]C.char
 	for i := 0; i < seq.length; i++ {
-		s := C.get_codepoint_from_glyph_info(nil, seq.info, C.int(i))
+		s := C.get_codepoint_from_glyph_info(nil, seq.info, C.int(i), &cbuf[0], C.size_t(len(cbuf)))
 		if i > 0 {
 			sb.WriteString("|")
 		}
@@ -253,8 +467,9 @@ func (seq *HBGlyphSequence) String() string {
 func hbGlyphString(hbfont uintptr, seq *HBGlyphSequence) string {
 	fptr := (*C.struct_hb_font_t)(unsafe.Pointer(hbfont))
 	var sb strings.Builder
+	var cbuf [64]C.char
 	for i := 0; i < seq.length; i++ {
-		s := C.get_codepoint_from_glyph_info(fptr, seq.info, C.int(i))
+		s := C.get_codepoint_from_glyph_info(fptr, seq.info, C.int(i), &cbuf[0], C.size_t(len(cbuf)))
 		if i > 0 {
 			sb.WriteString("|")
 		}
@@ -9,21 +9,20 @@ Support for low level interfacing to Harfbuzz structures.
 Will be called from "harfbuzz_bridge.go".
 */
 
-char strbuffer[1024];
-
 /* Return the code-point (glyph ID) from a glyph_info struct as a string.
- * Please note that the returned string is shared (not threadsafe whatsoever!),
- * as this is used mainly for debugging reasons.
+ * The string is written to a buffer provided by the caller, to be threadsafe.
+ * This is used mainly for debugging reasons.
  */
-char *get_codepoint_from_glyph_info(hb_font_t *hb_font, hb_glyph_info_t *info, int i) {
+char *get_codepoint_from_glyph_info(hb_font_t *hb_font, hb_glyph_info_t *info, int i,
+        char *strbuffer, size_t size) {
     hb_codepoint_t cp = info[i].codepoint;
     if (hb_font != NULL) {
         char glyphname[32];
         hb_font_get_glyph_name(hb_font, cp, glyphname, sizeof(glyphname));
-        sprintf(strbuffer, "%04X:%s", cp, glyphname);
+        snprintf(strbuffer, size, "%04X:%s", cp, glyphname);
     }
     else {
-        sprintf(strbuffer, "%04X", cp);
+        snprintf(strbuffer, size, "%04X", cp);
     }
     return strbuffer;
 }
@@ -2,6 +2,10 @@ package hbc
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
 	"unicode"
 
 	"github.com/npillmayer/harfbuzzgoperf"
@@ -27,6 +31,8 @@ type Harfbuzz struct {
 	buffer    uintptr         // central data structure for Harfbuzz
 	direction Direction       // L-to-R, R-to-L, T-to-B
 	script    language.Script // i.e., Latin, Arabic, Korean, ...
+	features  hbFeatures      // OpenType features to apply
+	shapers   *hbShaperList   // shapers to try, nil for the default
 }
 
 // Direction is the direction to typeset text in.
@@ -39,6 +45,12 @@ const (
 	BottomToTop           = 3
 )
 
+// IsBackward returns true for directions in which clusters of shaped runs
+// decrease, see harfbuzzgoperf.IsBackward.
+func (d Direction) IsBackward() bool {
+	return harfbuzzgoperf.IsBackward(dir2hbdir(d))
+}
+
 // Lang4HB returns a script as a HarfBuzz script.
 func Script4HB(s language.Script) uint32 {
 	b := []byte(s.String())
@@ -99,9 +111,29 @@ func (hb *Harfbuzz) SetDirection(dir Direction) {
 	setHBBufferDirection(hb.buffer, dir)
 }
 
-// SetLanguage is part of interface TextShaper.
-// Harfbuzz doesn't evaluate a language parameter; method is a NOP.
-func (hb *Harfbuzz) SetLanguage(string) {
+// SetLanguage is part of interface TextShaper. lang is a BCP 47 language tag;
+// an empty tag leaves the language unset.
+func (hb *Harfbuzz) SetLanguage(lang string) {
+	if lang != "" {
+		setHBBufferLanguage(hb.buffer, lang)
+	}
+}
+
+// SetFeatures sets the OpenType features to apply, as a comma separated list in
+// Harfbuzz syntax, e.g. "liga=0,+kern,smcp[3:5]".
+func (hb *Harfbuzz) SetFeatures(features string) error {
+	f, err := parseHBFeatures(features)
+	if err != nil {
+		return err
+	}
+	hb.features = f
+	return nil
+}
+
+// SetShapers sets the shapers to try in order, e.g. "ot" or "fallback" (see
+// ListShapers). An empty list selects Harfbuzz' default.
+func (hb *Harfbuzz) SetShapers(shapers []string) {
+	hb.shapers = newHBShaperList(shapers)
 }
 
 // Shape is part of the  TextShaper interface.
@@ -115,12 +147,173 @@ func (hb *Harfbuzz) Shape(text string, hbfont uintptr) *HBGlyphSequence {
 	if hb.buffer == 0 {
 		panic("no Harfbuzz buffer supplied")
 	}
-	harfbuzzShape(hb.buffer, text, hbfont)
+	if !harfbuzzShape(hb.buffer, text, hbfont, hb.features, hb.shapers) {
+		return &HBGlyphSequence{} // none of the shapers succeeded
+	}
 	seq := getHBGlyphInfo(hb.buffer)
 	return seq
 }
 
 func (hb *Harfbuzz) GlyphSequenceString(hbfont *harfbuzzgoperf.HBFont, seq *HBGlyphSequence) string {
 	s := hbGlyphString(hbfont.CFont, seq)
+	runtime.KeepAlive(hbfont)
 	return s
 }
+
+// Shaper is a shaper for backend-neutral glyphs, re-using its Harfbuzz buffer.
+// A Shaper is not safe for concurrent use.
+type Shaper struct {
+	Font      *harfbuzzgoperf.HBFont // Font.CFont must have been created with MakeHBFont or FontInstance
+	Direction Direction
+	Script    language.Script
+	Language  string   // BCP 47 language tag, may be empty
+	Shapers   []string // shapers to try in order, e.g. "fallback"; empty for the default
+	features  hbFeatures
+	fstring   string // features as set by SetFeatures
+	buf       *HBBuffer
+	shapers   *hbShaperList // of Shapers
+	view      bool          // Font is a view of the font, owned by the shaper
+}
+
+// NewShaper creates a shaper for a font, for left-to-right Latin script.
+func NewShaper(font *harfbuzzgoperf.HBFont) *Shaper {
+	return &Shaper{
+		Font:      font,
+		Direction: LeftToRight,
+		Script:    language.MustParseScript("Latn"),
+		buf:       AllocHBBuffer(),
+	}
+}
+
+// SetFeatures sets the OpenType features to apply, as a comma separated list in
+// Harfbuzz syntax, e.g. "liga=0,+kern".
+func (s *Shaper) SetFeatures(features string) error {
+	f, err := parseHBFeatures(features)
+	if err != nil {
+		return err
+	}
+	s.features, s.fstring = f, features
+	return nil
+}
+
+// Shape is part of interface harfbuzzgoperf.Shaper. In debug mode (see
+// harfbuzzgoperf.Debug), the output is checked with harfbuzzgoperf.CheckRun.
+func (s *Shaper) Shape(text []rune) ([]harfbuzzgoperf.ShapedGlyph, error) {
+	if len(text) == 0 || s.Font == nil || s.Font.CFont == 0 {
+		return nil, errors.New("no input to shape")
+	}
+	hb := NewHarfbuzz(s.buf)
+	hb.SetDirection(s.Direction)
+	hb.SetScript(s.Script)
+	hb.SetLanguage(s.Language)
+	hb.features = s.features
+	hb.shapers = s.shaperList()
+	str := string(text)
+	seq := hb.Shape(str, s.Font.CFont)
+	if seq.GlyphCount() == 0 {
+		if len(s.Shapers) > 0 {
+			return nil, fmt.Errorf("none of the shapers %v succeeded", s.Shapers)
+		}
+		return nil, errors.New("nothing got shaped")
+	}
+	glyphs := seq.Glyphs(str)
+	if harfbuzzgoperf.Debug {
+		err := harfbuzzgoperf.CheckRun(glyphs, len(text), s.Direction.IsBackward(), glyphCount(s.Font.CFont))
+		if err != nil {
+			return nil, err
+		}
+	}
+	runtime.KeepAlive(s.Font)
+	return glyphs, nil
+}
+
+// ShapeSegment is part of interface harfbuzzgoperf.SegmentShaper. Segments of
+// unknown script are shaped with the script of the shaper.
+func (s *Shaper) ShapeSegment(seg harfbuzzgoperf.Segment) ([]harfbuzzgoperf.ShapedGlyph, error) {
+	dir, script := s.Direction, s.Script
+	defer func() {
+		s.Direction, s.Script = dir, script
+	}()
+	s.Direction = LeftToRight
+	if seg.RightToLeft {
+		s.Direction = RightToLeft
+	}
+	if seg.Script != (language.Script{}) {
+		s.Script = seg.Script
+	}
+	return s.Shape(seg.Text)
+}
+
+// shaperList returns the shaper list for Shapers, which may have been changed
+// since the last call.
+func (s *Shaper) shaperList() *hbShaperList {
+	if len(s.Shapers) == 0 {
+		s.shapers = nil
+		return nil
+	}
+	if s.shapers == nil || strings.Join(s.shapers.names, ",") != strings.Join(s.Shapers, ",") {
+		s.shapers = newHBShaperList(s.Shapers)
+	}
+	return s.shapers
+}
+
+// SelectedShaper returns the name of the shaper Harfbuzz selects for the
+// shaper's font and settings, e.g. "ot", or "" if none of Shapers is able to
+// shape with the font.
+func (s *Shaper) SelectedShaper() (string, error) {
+	plan, err := NewShapePlan(s.Font, s.Direction, s.Script, s.Language, s.fstring, s.Shapers...)
+	if err != nil {
+		return "", err
+	}
+	defer plan.Free()
+	return plan.Shaper(), nil
+}
+
+// Key is part of interface harfbuzzgoperf.KeyedShaper. The point size of
+// Harfbuzz fonts is set by MakeHBFont or FontInstance, and the font instance will
+// be part of the key.
+func (s *Shaper) Key() harfbuzzgoperf.ShapeKey {
+	return harfbuzzgoperf.ShapeKey{
+		Backend:   "c",
+		Font:      s.Font,
+		Instance:  s.Font.CFont,
+		PtSize:    s.Font.Size,
+		Features:  s.fstring,
+		Direction: int(s.Direction),
+		Script:    s.Script.String(),
+		Language:  s.Language,
+		Shapers:   strings.Join(s.Shapers, ","),
+	}
+}
+
+// NewView creates a shaper for use on another goroutine. It has a buffer of its
+// own and uses a view of the Harfbuzz font (see MakeHBFontView), both of which
+// are released by Free.
+func (s *Shaper) NewView() *Shaper {
+	font := *s.Font
+	font.CFont = MakeHBFontView(s.Font.CFont)
+	runtime.KeepAlive(s.Font)
+	return &Shaper{
+		Font:      &font,
+		Direction: s.Direction,
+		Script:    s.Script,
+		Language:  s.Language,
+		Shapers:   s.Shapers,
+		features:  s.features,
+		fstring:   s.fstring,
+		buf:       AllocHBBuffer(),
+		view:      true,
+	}
+}
+
+// Free releases the Harfbuzz buffer of the shaper and, for shapers created by
+// NewView, its view of the font. The shaper must not be used afterwards.
+func (s *Shaper) Free() {
+	if s.buf != nil {
+		s.buf.Free()
+	}
+	if s.view && s.Font.CFont != 0 {
+		freeHBFont(s.Font.CFont)
+		s.Font.CFont = 0
+	}
+}
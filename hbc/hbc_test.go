@@ -1,10 +1,23 @@
 package hbc_test
 
 import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	gohb "github.com/benoitkugler/textlayout/harfbuzz"
 	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/engine"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
 	"github.com/npillmayer/harfbuzzgoperf/hbc"
+	"github.com/npillmayer/harfbuzzgoperf/linebreak"
+	"github.com/npillmayer/harfbuzzgoperf/wordcache"
+	"golang.org/x/text/language"
 )
 
 func TestHarfbuzzShape(t *testing.T) {
@@ -55,20 +68,364 @@ func TestHarfbuzzShapeResult(t *testing.T) {
 	}
 }
 
-// --- Benchmarking ----------------------------------------------------------
+func TestSplitRun(t *testing.T) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	face := harfbuzzgoperf.GlobalFontStore.FindFace("Calibri.ttf")
+	if face == nil {
+		t.Fatal("expected to find font Calibri")
+	}
+	font, err := hbc.FontInstance(nil, face, 12.0, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shaper := hbc.NewShaper(font)
+	texts := append([][]rune{[]rune("AVATAR Tour, fjord Wave")}, harfbuzzgoperf.CorpusRunes[:5]...)
+	for _, text := range texts {
+		glyphs, err := shaper.Shape(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// additionally flag glyphs as unsafe, to force partial reshaping
+		flagged := append([]harfbuzzgoperf.ShapedGlyph(nil), glyphs...)
+		for i := range flagged {
+			if i%3 != 0 {
+				flagged[i].Flags |= harfbuzzgoperf.UnsafeToBreak
+			}
+		}
+		for _, run := range [][]harfbuzzgoperf.ShapedGlyph{glyphs, flagged} {
+			for pos := 1; pos < len(text); pos++ {
+				left, right, err := linebreak.SplitRun(text, run, pos, shaper)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectedLeft, _ := shaper.Shape(text[:pos])
+				expectedRight, _ := shaper.Shape(text[pos:])
+				for i := range expectedRight {
+					expectedRight[i].Cluster += pos
+				}
+				if !sameGlyphs(left, expectedLeft) {
+					t.Errorf("split at %d: left side differs from full reshape", pos)
+				}
+				if !sameGlyphs(right, expectedRight) {
+					t.Errorf("split at %d: right side differs from full reshape", pos)
+				}
+			}
+		}
+	}
+}
 
-var Cnt int
+// sameGlyphs compares glyphs and positions, but not flags, which depend on the
+// context the glyphs have been shaped in.
+func sameGlyphs(a, b []harfbuzzgoperf.ShapedGlyph) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		x.Flags, y.Flags = 0, 0
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
 
-func BenchmarkHBShape(b *testing.B) {
-	var seq *hbc.HBGlyphSequence
+func TestShaperOptions(t *testing.T) {
 	harfbuzzgoperf.LoadEmbeddedFonts()
-	fontname := "Calibri.ttf"
-	//fontname := "Go"
-	font := harfbuzzgoperf.GlobalFontStore.FindFont(fontname)
+	font := harfbuzzgoperf.GlobalFontStore.FindFont("Go")
+	font.CFont = hbc.MakeHBFont(font.Binary, 12.0)
+	shaper := hbc.NewShaper(font)
+	shaper.Language = "tr"
+	if err := shaper.SetFeatures("-kern, liga=0"); err != nil {
+		t.Fatal(err)
+	}
+	glyphs, err := shaper.Shape([]rune("AVAfi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(glyphs) != 5 {
+		t.Errorf("expected 5 glyphs without ligatures, have %d", len(glyphs))
+	}
+	if key := shaper.Key(); key.Language != "tr" || key.Features != "-kern, liga=0" {
+		t.Errorf("expected language and features to be part of the key, have %+v", key)
+	}
+	if err = shaper.SetFeatures("kern["); err == nil {
+		t.Error("expected error for invalid feature")
+	}
+	if name := hbc.GlyphName(font.CFont, glyphs[0].GID); name != "A" {
+		t.Errorf("expected glyph name A, have %q", name)
+	}
+}
+
+func TestInvariants(t *testing.T) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	hebrew := []rune("שלום, עולם!")
+	texts := append([][]rune{hebrew, []rune("ﬁnal ¼ office")}, harfbuzzgoperf.CorpusRunes...)
+	for _, fontname := range []string{"Go", "GoBold.ttf", "Calibri.ttf"} {
+		font, err := hbc.FontInstance(nil, harfbuzzgoperf.GlobalFontStore.FindFace(fontname), 12.0, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shaper := hbc.NewShaper(font)
+		for i, text := range texts {
+			script := harfbuzzgoperf.DetectScript(text)
+			if shaper.Script, err = harfbuzzgoperf.ScriptFromHB(script); err != nil {
+				t.Fatal(err)
+			}
+			shaper.Direction = hbc.LeftToRight
+			if harfbuzzgoperf.IsRightToLeft(script) {
+				shaper.Direction = hbc.RightToLeft
+			}
+			glyphs, err := shaper.Shape(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = harfbuzzgoperf.CheckRun(glyphs, len(text), shaper.Direction.IsBackward(), font.NumGlyphs())
+			if err != nil {
+				t.Errorf("%s, text #%d: %v", fontname, i, err)
+			}
+		}
+	}
+}
+
+func TestFontInstance(t *testing.T) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	face := harfbuzzgoperf.GlobalFontStore.FindFace("Go")
+	cache := harfbuzzgoperf.NewInstanceCache(1 << 20)
+	f12, err := hbc.FontInstance(cache, face, 12, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f24, _ := hbc.FontInstance(cache, face, 24, "", 0)
+	if again, _ := hbc.FontInstance(cache, face, 12, "", 0); again != f12 {
+		t.Error("expected instance to be cached")
+	}
+	text := []rune("Instance")
+	g12, _ := hbc.NewShaper(f12).Shape(text)
+	g24, _ := hbc.NewShaper(f24).Shape(text)
+	if w12, w24 := harfbuzzgoperf.RunWidth(g12), harfbuzzgoperf.RunWidth(g24); w12 == 0 || math.Abs(w24-2*w12) > 0.1 {
+		t.Errorf("expected width to scale with size, have %.2f and %.2f", w12, w24)
+	}
+	if _, err = hbc.FontInstance(cache, face, 12, "wght=700", 0.2); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Instances != 3 || stats.Hits != 1 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+}
+
+func TestNativeHeapInUse(t *testing.T) {
+	before, ok := hbc.NativeHeapInUse()
+	if !ok {
+		t.Skip("native heap usage not available")
+	}
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	binary := harfbuzzgoperf.GlobalFontStore.FindFace("Go").Binary
+	face := hbc.NewFace(binary)
+	font := hbc.NewFont(face, binary, 12)
+	if after, _ := hbc.NativeHeapInUse(); after-before < int64(len(binary)) {
+		t.Errorf("expected native heap to grow by at least the font binary, grew by %d", after-before)
+	}
+	hbc.FreeFont(font)
+	hbc.FreeFace(face)
+}
+
+func TestMeasureBridge(t *testing.T) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	face := harfbuzzgoperf.GlobalFontStore.FindFace("Go")
+	if face == nil {
+		t.Fatal("expected to find font Go Sans")
+	}
+	font, err := hbc.FontInstance(nil, face, 12.0, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	measure := func(run func(n int)) float64 {
+		start := time.Now()
+		run(1000)
+		return float64(time.Since(start).Nanoseconds()) / 1000
+	}
+	bd := hbc.MeasureBridge(font, harfbuzzgoperf.CorpusRunes[0], measure)
+	t.Logf("full %.0f ns, bridge %.0f ns, harfbuzz %.0f ns, %d transitions", bd.Full, bd.Bridge,
+		bd.Harfbuzz, bd.Transitions)
+	if bd.Glyphs == 0 || bd.Full < 0 {
+		t.Fatalf("expected glyphs and shaping time, have %d glyphs in %.0f ns", bd.Glyphs, bd.Full)
+	}
+	if len(bd.Costs) != 10 {
+		t.Errorf("expected costs of 10 primitives, have %d", len(bd.Costs))
+	}
+	for _, c := range bd.Costs {
+		t.Logf("%-16s %8.1f ns × %d", c.Name, c.NsPerCall, c.Calls)
+		if c.NsPerCall < 0 || c.NsPerRun < 0 {
+			t.Errorf("expected non-negative cost of %s, is %.1f ns", c.Name, c.NsPerCall)
+		}
+	}
+	if bd.Bridge < 0 || bd.Harfbuzz < 0 || bd.Bridge+bd.Harfbuzz > bd.Full+1e-6 {
+		t.Errorf("expected bridge and Harfbuzz to split the shaping time, are %.0f and %.0f of %.0f ns",
+			bd.Bridge, bd.Harfbuzz, bd.Full)
+	}
+}
+
+func TestShapePlan(t *testing.T) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	font := harfbuzzgoperf.GlobalFontStore.FindFont("Go")
+	if font == nil {
+		t.Fatal("expected to find font Go Sans")
+	}
+	font.CFont = hbc.MakeHBFont(font.Binary, 12.0)
+	latin := language.MustParseScript("Latn")
+	plan, err := hbc.NewShapePlan(font, hbc.LeftToRight, latin, "en", "-liga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plan.Free()
+	if shaper := plan.Shaper(); shaper != "ot" {
+		t.Errorf("expected OpenType shaper, have %q", shaper)
+	}
+	buf := hbc.AllocHBBuffer()
+	defer buf.Free()
+	seq, err := plan.Execute(buf, "Waffle", font)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq.GlyphCount() != 6 {
+		t.Errorf("expected 6 glyphs without ligatures, have %d", seq.GlyphCount())
+	}
+	compiled, err := hbc.CompileShapePlan(font, hbc.LeftToRight, latin, "en", "-liga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled.Free()
+	if _, err = compiled.Execute(buf, "Waffle", font); err == nil {
+		t.Error("expected error for freed plan")
+	}
+	bold, err := hbc.FontInstance(nil, harfbuzzgoperf.GlobalFontStore.FindFace("GoBold.ttf"), 12.0, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = plan.Execute(buf, "Waffle", bold); err == nil {
+		t.Error("expected error for font of another face")
+	}
+	if _, err = hbc.NewShapePlan(font, hbc.LeftToRight, latin, "", "liga["); err == nil {
+		t.Error("expected error for invalid feature")
+	}
+}
+
+func TestShapers(t *testing.T) {
+	shapers := hbc.ListShapers()
+	t.Logf("Harfbuzz shapers: %v", shapers)
+	if len(shapers) == 0 || shapers[len(shapers)-1] != "fallback" {
+		t.Errorf("expected fallback shaper to be last, have %v", shapers)
+	}
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	font := harfbuzzgoperf.GlobalFontStore.FindFont("Calibri.ttf")
 	if font == nil {
-		b.Fatalf("cannot prepare font %q", fontname)
+		t.Fatal("expected to find font Calibri")
 	}
 	font.CFont = hbc.MakeHBFont(font.Binary, 12.0)
+	shaper := hbc.NewShaper(font)
+	if name, _ := shaper.SelectedShaper(); name != "ot" {
+		t.Errorf("expected OpenType shaper by default, have %q", name)
+	}
+	shaper.Shapers = []string{"fallback"}
+	if name, _ := shaper.SelectedShaper(); name != "fallback" {
+		t.Errorf("expected fallback shaper, have %q", name)
+	}
+	text := []rune("office")
+	glyphs, err := shaper.Shape(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(glyphs) != len(text) {
+		t.Errorf("expected fallback shaper to map characters 1:1, have %d glyphs", len(glyphs))
+	}
+	if key := shaper.Key(); key.Shapers != "fallback" {
+		t.Errorf("expected shapers to be part of the key, have %+v", key)
+	}
+	shaper.Shapers = []string{"no-such-shaper"}
+	if _, err = shaper.Shape(text); err == nil {
+		t.Error("expected error if no shaper succeeds")
+	}
+}
+
+func TestInspect(t *testing.T) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	for _, name := range []string{"Go", "GoBold.ttf", "Calibri.ttf"} {
+		font := harfbuzzgoperf.GlobalFontStore.FindFont(name)
+		info, err := font.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cinfo := hbc.Inspect(font.Face)
+		if diffs := info.Compare(cinfo); len(diffs) > 0 {
+			t.Errorf("font %s: textlayout and Harfbuzz differ: %v", name, diffs)
+		}
+		if cinfo.Family != info.Family {
+			t.Errorf("font %s: expected family %q, Harfbuzz has %q", name, info.Family, cinfo.Family)
+		}
+	}
+}
+
+// TestLayoutTables asserts that both backends report the same scripts, language
+// systems and features for every loaded font. Fonts in a directory set with
+// environment variable HBPERF_FONTDIR are checked, too.
+func TestLayoutTables(t *testing.T) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	if dir := os.Getenv("HBPERF_FONTDIR"); dir != "" {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.[ot]tf"))
+		for _, path := range paths {
+			binary, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			face, err := harfbuzzgoperf.ParseFace(filepath.Base(path), binary)
+			if err != nil {
+				t.Logf("skipping %s: %v", path, err)
+				continue
+			}
+			harfbuzzgoperf.GlobalFontStore.StoreFont(face.Name, &harfbuzzgoperf.HBFont{
+				Binary: binary,
+				GoFont: gohb.NewFont(face.GoFace),
+				Face:   face,
+			})
+		}
+	}
+	for _, name := range harfbuzzgoperf.GlobalFontStore.Names() {
+		font := harfbuzzgoperf.GlobalFontStore.FindFont(name)
+		gotables, err := hb.LayoutTables(font)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctables := hbc.LayoutTables(font.Face)
+		if diffs := harfbuzzgoperf.CompareLayout(gotables, ctables); len(diffs) > 0 {
+			t.Errorf("font %s: layout tables differ:\n\t%s", name, strings.Join(diffs, "\n\t"))
+		}
+	}
+}
+
+// --- Benchmarking ----------------------------------------------------------
+
+// benchmarkFont returns the font benchmarks shape with, Calibri at 12pt. It is
+// an instance of the global instance cache, which keeps it alive while
+// benchmarks hand its Harfbuzz font to the bridge.
+func benchmarkFont(b *testing.B) *harfbuzzgoperf.HBFont {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	face := harfbuzzgoperf.GlobalFontStore.FindFace("Calibri.ttf")
+	if face == nil {
+		b.Fatal("expected to find font Calibri")
+	}
+	font, err := hbc.FontInstance(nil, face, 12.0, "", 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return font
+}
+
+var Cnt int
+
+func BenchmarkHBShape(b *testing.B) {
+	var seq *hbc.HBGlyphSequence
+	font := benchmarkFont(b)
 	buf := hbc.AllocHBBuffer()
 	var hb *hbc.Harfbuzz
 	for i := 0; i < b.N; i++ {
@@ -81,3 +438,141 @@ func BenchmarkHBShape(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkHBShapeNoReuse(b *testing.B) {
+	var seq *hbc.HBGlyphSequence
+	font := benchmarkFont(b)
+	var hb *hbc.Harfbuzz
+	for i := 0; i < b.N; i++ {
+		for _, line := range harfbuzzgoperf.Corpus {
+			buf := hbc.AllocHBBuffer()
+			if hb = hbc.NewHarfbuzz(buf); hb == nil {
+				b.Fatal("failed to create Harfbuzz instance")
+			}
+			seq = hb.Shape(line, font.CFont)
+			Cnt = seq.GlyphCount()
+			buf.Free()
+		}
+	}
+}
+
+// BenchmarkBridge benchmarks the primitives of the C bridge for a corpus
+// paragraph, see hbc.BridgePrimitives.
+func BenchmarkBridge(b *testing.B) {
+	font := benchmarkFont(b)
+	prims, free := hbc.BridgePrimitives(font, harfbuzzgoperf.CorpusRunes[0])
+	defer free()
+	for _, p := range prims {
+		run := p.Run
+		b.Run(p.Name, func(b *testing.B) {
+			run(b.N)
+		})
+	}
+}
+
+var Lines []linebreak.Line
+
+func BenchmarkHBShapeAndBreak(b *testing.B) {
+	font := benchmarkFont(b)
+	buf := hbc.AllocHBBuffer()
+	var hb *hbc.Harfbuzz
+	for i := 0; i < b.N; i++ {
+		for j, line := range harfbuzzgoperf.Corpus {
+			if hb = hbc.NewHarfbuzz(buf); hb == nil {
+				b.Fatal("failed to create Harfbuzz instance")
+			}
+			seq := hb.Shape(line, font.CFont)
+			Lines = linebreak.BreakParagraph(harfbuzzgoperf.CorpusRunes[j], seq.Glyphs(line), 300)
+		}
+	}
+}
+
+var Breakpoints []linebreak.Breakpoint
+
+func BenchmarkHBShapeAndKnuthPlass(b *testing.B) {
+	font := benchmarkFont(b)
+	buf := hbc.AllocHBBuffer()
+	var hb *hbc.Harfbuzz
+	var err error
+	for i := 0; i < b.N; i++ {
+		for j, line := range harfbuzzgoperf.Corpus {
+			if hb = hbc.NewHarfbuzz(buf); hb == nil {
+				b.Fatal("failed to create Harfbuzz instance")
+			}
+			seq := hb.Shape(line, font.CFont)
+			Breakpoints, err = linebreak.KnuthPlassParagraph(harfbuzzgoperf.CorpusRunes[j], seq.Glyphs(line), 300, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+var Glyphs []harfbuzzgoperf.ShapedGlyph
+
+func BenchmarkHBWordCache(b *testing.B) {
+	font := benchmarkFont(b)
+	var err error
+	b.Run("uncached", func(b *testing.B) {
+		shaper := hbc.NewShaper(font)
+		for i := 0; i < b.N; i++ {
+			for _, line := range harfbuzzgoperf.CorpusRunes {
+				if Glyphs, err = shaper.Shape(line); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		store := wordcache.NewStore(1 << 20)
+		shaper := wordcache.New(hbc.NewShaper(font), store)
+		for i := 0; i < b.N; i++ {
+			for _, line := range harfbuzzgoperf.CorpusRunes {
+				if Glyphs, err = shaper.Shape(line); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(100*store.Stats().HitRate(), "hit%")
+	})
+}
+
+func BenchmarkHBEngine(b *testing.B) {
+	font := benchmarkFont(b)
+	shaper := hbc.NewShaper(font)
+	for workers := 1; workers <= runtime.GOMAXPROCS(0); workers *= 2 {
+		e, err := engine.New(workers, func(int) (harfbuzzgoperf.Shaper, error) {
+			return shaper.NewView(), nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := e.ShapeAll(harfbuzzgoperf.CorpusRunes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		e.Close()
+	}
+}
+
+// BenchmarkHBShapeParallel shapes the corpus with a shaper per goroutine.
+// Use flag -cpu to check scalability.
+func BenchmarkHBShapeParallel(b *testing.B) {
+	font := benchmarkFont(b)
+	shaper := hbc.NewShaper(font)
+	b.RunParallel(func(pb *testing.PB) {
+		s := shaper.NewView()
+		defer s.Free()
+		for pb.Next() {
+			for _, line := range harfbuzzgoperf.CorpusRunes {
+				if _, err := s.Shape(line); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}
+	})
+}
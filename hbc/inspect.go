@@ -0,0 +1,160 @@
+package hbc
+
+/*
+#include <stdlib.h>
+#include <hb.h>
+#include <hb-ot.h>
+*/
+import "C"
+import (
+	"unsafe"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// Inspect returns information about a face, as read by Harfbuzz. It is intended
+// for cross-checking harfbuzzgoperf.HBFont.Info, therefore only properties
+// read from font tables (not derived by textlayout) are set.
+func Inspect(face *harfbuzzgoperf.Face) harfbuzzgoperf.FontInfo {
+	hbface := (*C.struct_hb_face_t)(unsafe.Pointer(face.NativeFace(makeHBFace)))
+	info := harfbuzzgoperf.FontInfo{
+		UnitsPerEm: int(C.hb_face_get_upem(hbface)),
+		NumGlyphs:  int(C.hb_face_get_glyph_count(hbface)),
+	}
+	info.Layout = LayoutTables(face)
+	info.Family = otName(hbface, C.HB_OT_NAME_ID_FONT_FAMILY)
+	info.Subfamily = otName(hbface, C.HB_OT_NAME_ID_FONT_SUBFAMILY)
+	if n := C.hb_ot_var_get_axis_count(hbface); n > 0 {
+		axes := make([]C.hb_ot_var_axis_info_t, n)
+		C.hb_ot_var_get_axis_infos(hbface, 0, &n, &axes[0])
+		for _, a := range axes[:n] {
+			info.Axes = append(info.Axes, harfbuzzgoperf.Axis{
+				Tag:     tagString(a.tag),
+				Min:     float32(a.min_value),
+				Default: float32(a.default_value),
+				Max:     float32(a.max_value),
+			})
+		}
+	}
+	ninst := int(C.hb_ot_var_get_named_instance_count(hbface))
+	for i := 0; i < ninst; i++ {
+		n := C.uint(len(info.Axes))
+		coords := make([]float32, n+1) // +1: never pass a pointer to an empty slice
+		C.hb_ot_var_named_instance_get_design_coords(hbface, C.uint(i), &n, (*C.float)(&coords[0]))
+		nameID := C.hb_ot_var_named_instance_get_subfamily_name_id(hbface, C.uint(i))
+		info.Instances = append(info.Instances, harfbuzzgoperf.NamedInstance{
+			Name:   otName(hbface, nameID),
+			Coords: coords[:n],
+		})
+	}
+	return info
+}
+
+// LayoutTables lists scripts, language systems and features (with lookup
+// indices) of the GSUB and GPOS tables of a face, as seen by Harfbuzz.
+func LayoutTables(face *harfbuzzgoperf.Face) []harfbuzzgoperf.LayoutTable {
+	hbface := (*C.struct_hb_face_t)(unsafe.Pointer(face.NativeFace(makeHBFace)))
+	var tables []harfbuzzgoperf.LayoutTable
+	for _, tag := range []C.hb_tag_t{C.HB_OT_TAG_GSUB, C.HB_OT_TAG_GPOS} {
+		scripts := layoutTags(func(start C.uint, n *C.uint, tags *C.hb_tag_t) C.uint {
+			return C.hb_ot_layout_table_get_script_tags(hbface, tag, start, n, tags)
+		})
+		if len(scripts) == 0 {
+			continue
+		}
+		features := layoutTags(func(start C.uint, n *C.uint, tags *C.hb_tag_t) C.uint {
+			return C.hb_ot_layout_table_get_feature_tags(hbface, tag, start, n, tags)
+		})
+		table := harfbuzzgoperf.LayoutTable{Tag: tagString(tag)}
+		for i, stag := range scripts {
+			script := harfbuzzgoperf.LayoutScript{Tag: tagString(stag)}
+			dflt := layoutLanguage(hbface, tag, C.uint(i), C.HB_OT_LAYOUT_DEFAULT_LANGUAGE_INDEX, features)
+			if len(dflt.Features) > 0 {
+				dflt.Tag = harfbuzzgoperf.DefaultLanguage
+				script.Languages = append(script.Languages, dflt)
+			}
+			langs := layoutTags(func(start C.uint, n *C.uint, tags *C.hb_tag_t) C.uint {
+				return C.hb_ot_layout_script_get_language_tags(hbface, tag, C.uint(i), start, n, tags)
+			})
+			for j, ltag := range langs {
+				lang := layoutLanguage(hbface, tag, C.uint(i), C.uint(j), features)
+				lang.Tag = tagString(ltag)
+				script.Languages = append(script.Languages, lang)
+			}
+			table.Scripts = append(table.Scripts, script)
+		}
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// layoutLanguage lists the features of a language system, the required feature
+// first.
+func layoutLanguage(hbface *C.struct_hb_face_t, table C.hb_tag_t, script, lang C.uint,
+	features []C.hb_tag_t) harfbuzzgoperf.LayoutLanguage {
+	//
+	var l harfbuzzgoperf.LayoutLanguage
+	var indices []C.uint
+	var required C.uint
+	if C.hb_ot_layout_language_get_required_feature(hbface, table, script, lang, &required, nil) != 0 {
+		indices = append(indices, required)
+	}
+	indices = append(indices, layoutIndices(func(start C.uint, n *C.uint, out *C.uint) C.uint {
+		return C.hb_ot_layout_language_get_feature_indexes(hbface, table, script, lang, start, n, out)
+	})...)
+	for _, fi := range indices {
+		if int(fi) >= len(features) {
+			continue
+		}
+		f := harfbuzzgoperf.LayoutFeature{Tag: tagString(features[fi])}
+		for _, li := range layoutIndices(func(start C.uint, n *C.uint, out *C.uint) C.uint {
+			return C.hb_ot_layout_feature_get_lookups(hbface, table, fi, start, n, out)
+		}) {
+			f.Lookups = append(f.Lookups, int(li))
+		}
+		l.Features = append(l.Features, f)
+	}
+	return l
+}
+
+// layoutTags calls a Harfbuzz function which fills an array of tags, first to
+// query the number of tags, then to fetch all of them.
+func layoutTags(get func(start C.uint, n *C.uint, tags *C.hb_tag_t) C.uint) []C.hb_tag_t {
+	var n C.uint
+	total := get(0, &n, nil)
+	if total == 0 {
+		return nil
+	}
+	tags := make([]C.hb_tag_t, total)
+	n = total
+	get(0, &n, &tags[0])
+	return tags[:n]
+}
+
+// layoutIndices is like layoutTags, for arrays of indices.
+func layoutIndices(get func(start C.uint, n *C.uint, out *C.uint) C.uint) []C.uint {
+	var n C.uint
+	total := get(0, &n, nil)
+	if total == 0 {
+		return nil
+	}
+	indices := make([]C.uint, total)
+	n = total
+	get(0, &n, &indices[0])
+	return indices[:n]
+}
+
+// otName returns an English name entry of a face.
+func otName(hbface *C.struct_hb_face_t, id C.hb_ot_name_id_t) string {
+	lang := C.CString("en")
+	defer C.free(unsafe.Pointer(lang))
+	var buf [256]C.char
+	size := C.uint(len(buf))
+	C.hb_ot_name_get_utf8(hbface, id, C.hb_language_from_string(lang, -1), &size, &buf[0])
+	return C.GoString(&buf[0])
+}
+
+// tagString converts an OpenType tag to a string.
+func tagString(tag C.hb_tag_t) string {
+	return string([]byte{byte(tag >> 24), byte(tag >> 16), byte(tag >> 8), byte(tag)})
+}
@@ -0,0 +1,81 @@
+package hbc
+
+import (
+	"runtime"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// Estimated memory of a Harfbuzz font, not counting the face. Harfbuzz keeps its
+// layout accelerators with the face.
+const instanceOverhead = 1 << 10
+
+// FontInstance returns a Harfbuzz font instance of face at a given point size,
+// with variations and synthetic slant applied, from an instance cache. If cache
+// is nil, the global instance cache is used.
+//
+// All instances of a face share a single Harfbuzz face. The Harfbuzz font of an
+// instance is freed when the instance is garbage collected, i.e. after it has
+// been evicted from the cache and is no longer in use.
+// Synthetic slant requires Harfbuzz 3.3 or later.
+func FontInstance(cache *harfbuzzgoperf.InstanceCache, face *harfbuzzgoperf.Face, ptsize float32,
+	variations string, slant float32) (*harfbuzzgoperf.HBFont, error) {
+	//
+	if cache == nil {
+		cache = harfbuzzgoperf.GlobalInstances
+	}
+	canonical, vars, err := harfbuzzgoperf.CanonicalVariations(variations)
+	if err != nil {
+		return nil, err
+	}
+	key := harfbuzzgoperf.InstanceKey{
+		Backend:    "c",
+		Face:       face,
+		Size:       ptsize,
+		Variations: canonical,
+		Slant:      slant,
+	}
+	return cache.Instance(key, func() (*harfbuzzgoperf.HBFont, int64, error) {
+		hbface := face.NativeFace(makeHBFace)
+		font := &harfbuzzgoperf.HBFont{
+			Binary: face.Binary,
+			CFont:  makeHBFontInstance(hbface, ptsize, vars, slant),
+			Face:   face,
+			Size:   ptsize,
+		}
+		runtime.SetFinalizer(font, func(f *harfbuzzgoperf.HBFont) {
+			freeHBFont(f.CFont)
+		})
+		return font, instanceOverhead, nil
+	})
+}
+
+// NewFace creates a Harfbuzz face from a font binary, bypassing the shared face
+// of FontInstance. Harfbuzz loads tables of a face lazily, on first use. The
+// face has to be released with FreeFace. NewFace is intended for measuring the
+// cost of starting with a font from scratch.
+func NewFace(binary []byte) uintptr {
+	return makeHBFace(binary)
+}
+
+// FreeFace releases a face created by NewFace.
+func FreeFace(hbface uintptr) {
+	freeHBFace(hbface)
+}
+
+// NewFont creates a Harfbuzz font at a given point size for a face created by
+// NewFace, bypassing the instance cache. The font has to be released with
+// FreeFont before its face.
+func NewFont(hbface uintptr, binary []byte, ptsize float32) *harfbuzzgoperf.HBFont {
+	return &harfbuzzgoperf.HBFont{
+		Binary: binary,
+		CFont:  makeHBFontInstance(hbface, ptsize, nil, 0),
+		Size:   ptsize,
+	}
+}
+
+// FreeFont releases a font created by NewFont.
+func FreeFont(font *harfbuzzgoperf.HBFont) {
+	freeHBFont(font.CFont)
+	font.CFont = 0
+}
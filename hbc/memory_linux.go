@@ -0,0 +1,37 @@
+package hbc
+
+/*
+#include <malloc.h>
+
+// native_heap_in_use returns the bytes allocated by malloc, or -1 if the C
+// library does not report them. mallinfo2 is available from glibc 2.33 on;
+// the fields of its predecessor mallinfo are ints and wrap at 4 GB.
+static long long native_heap_in_use(void) {
+#if defined(__GLIBC__) && (__GLIBC__ > 2 || (__GLIBC__ == 2 && __GLIBC_MINOR__ >= 33))
+	struct mallinfo2 mi = mallinfo2();
+	return (long long)mi.uordblks + (long long)mi.hblkhd;
+#elif defined(__GLIBC__)
+	struct mallinfo mi = mallinfo();
+	return (long long)(unsigned int)mi.uordblks + (long long)(unsigned int)mi.hblkhd;
+#else
+	return -1;
+#endif
+}
+*/
+import "C"
+
+// NativeHeapInUse returns the number of bytes currently allocated by malloc,
+// i.e. by Harfbuzz and the C bridge, as reported by glibc's mallinfo2, or
+// mallinfo before glibc 2.33. The second return value is false if native heap
+// usage is not available, e.g. with C libraries other than glibc.
+//
+// Memory allocated through mmap for large blocks is included. mallinfo2 reports
+// on the main arena only, missing allocations of threads which glibc assigned
+// to other arenas; run with MALLOC_ARENA_MAX=1 for exact numbers.
+func NativeHeapInUse() (int64, bool) {
+	n := int64(C.native_heap_in_use())
+	if n < 0 {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package hbc
+
+// NativeHeapInUse returns the number of bytes currently allocated by malloc.
+// It is available on Linux only; on other platforms the second return value is
+// false.
+func NativeHeapInUse() (int64, bool) {
+	return 0, false
+}
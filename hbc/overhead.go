@@ -0,0 +1,185 @@
+package hbc
+
+/*
+#include <stdlib.h>
+#include <hb.h>
+*/
+import "C"
+import (
+	"math"
+	"runtime"
+	"unsafe"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"golang.org/x/text/language"
+)
+
+// BridgePrimitive is a primitive operation of the C bridge, isolated for
+// micro-benchmarks.
+type BridgePrimitive struct {
+	Name  string
+	Calls int         // calls per shaping of the text; 0 for primitives for information only
+	Base  string      // name of a primitive included in Run, to be subtracted
+	Run   func(n int) // runs the primitive n times
+}
+
+// bridgeSink keeps the compiler from optimizing away conversions.
+var bridgeSink string
+
+// BridgePrimitives returns the primitives of shaping text with a font, in the
+// order Shaper.Shape uses them. Shaper.Shape sets direction and script twice,
+// once in NewHarfbuzz and once for the shaper's settings.
+//
+//	cgo-call          a cgo call doing nothing but returning the buffer length
+//	runes-to-string   converting the input to a Go string
+//	buffer-reset      hb_buffer_reset
+//	set-direction     hb_buffer_set_direction
+//	set-script        hb_buffer_set_script
+//	add-utf8          C.CString, hb_buffer_add_utf8 and free (base: buffer-reset)
+//	shape-empty       hb_shape on an empty buffer, returning immediately
+//	shape-one-char    shaping a single character, including buffer set-up
+//	glyph-info        retrieving glyph infos and positions
+//	glyphs            converting glyph infos and positions to Go glyphs
+//
+// Text is shaped left-to-right as Latin script, the defaults of NewShaper. free
+// releases the Harfbuzz buffers used by the primitives.
+func BridgePrimitives(font *harfbuzzgoperf.HBFont, text []rune) (prims []BridgePrimitive, free func()) {
+	str := string(text)
+	script := Script4HB(language.MustParseScript("Latn"))
+	buf := AllocHBBuffer()
+	ptr := (*C.struct_hb_buffer_t)(unsafe.Pointer(buf.hbbuf))
+	shaped := AllocHBBuffer()
+	NewHarfbuzz(shaped)
+	harfbuzzShape(shaped.hbbuf, str, font.CFont, nil, nil)
+	seq := getHBGlyphInfo(shaped.hbbuf)
+	empty := AllocHBBuffer()
+	fptr := (*C.struct_hb_font_t)(unsafe.Pointer(font.CFont))
+	eptr := (*C.struct_hb_buffer_t)(unsafe.Pointer(empty.hbbuf))
+	prims = []BridgePrimitive{
+		{"cgo-call", 0, "", func(n int) {
+			for i := 0; i < n; i++ {
+				C.hb_buffer_get_length(ptr)
+			}
+		}},
+		{"runes-to-string", 1, "", func(n int) {
+			for i := 0; i < n; i++ {
+				bridgeSink = string(text)
+			}
+		}},
+		{"buffer-reset", 1, "", func(n int) {
+			for i := 0; i < n; i++ {
+				resetHBBuffer(buf.hbbuf)
+			}
+		}},
+		{"set-direction", 2, "", func(n int) {
+			for i := 0; i < n; i++ {
+				setHBBufferDirection(buf.hbbuf, LeftToRight)
+			}
+		}},
+		{"set-script", 2, "", func(n int) {
+			for i := 0; i < n; i++ {
+				setHBBufferScript(buf.hbbuf, script)
+			}
+		}},
+		{"add-utf8", 1, "buffer-reset", func(n int) {
+			for i := 0; i < n; i++ {
+				resetHBBuffer(buf.hbbuf)
+				cstr := C.CString(str)
+				C.hb_buffer_add_utf8(ptr, cstr, C.int(len(str)), 0, C.int(len(str)))
+				C.free(unsafe.Pointer(cstr))
+			}
+		}},
+		{"shape-empty", 0, "", func(n int) {
+			for i := 0; i < n; i++ {
+				C.hb_shape(fptr, eptr, nil, 0)
+			}
+		}},
+		{"shape-one-char", 0, "", func(n int) {
+			for i := 0; i < n; i++ {
+				resetHBBuffer(buf.hbbuf)
+				setHBBufferDirection(buf.hbbuf, LeftToRight)
+				setHBBufferScript(buf.hbbuf, script)
+				harfbuzzShape(buf.hbbuf, "a", font.CFont, nil, nil)
+			}
+		}},
+		{"glyph-info", 1, "", func(n int) {
+			for i := 0; i < n; i++ {
+				seq = getHBGlyphInfo(shaped.hbbuf)
+			}
+		}},
+		{"glyphs", 1, "", func(n int) {
+			for i := 0; i < n; i++ {
+				seq.Glyphs(str)
+			}
+		}},
+	}
+	free = func() {
+		buf.Free()
+		shaped.Free()
+		empty.Free()
+		runtime.KeepAlive(font) // fptr is used by the primitives
+	}
+	return prims, free
+}
+
+// BridgeCost is the cost of a bridge primitive when shaping a text.
+type BridgeCost struct {
+	Name      string  `json:"name"`
+	NsPerCall float64 `json:"ns_call"`  // without the cost of its base
+	Calls     int     `json:"calls"`    // per shaping
+	NsPerRun  float64 `json:"ns_run"`   // per shaping
+	Fraction  float64 `json:"fraction"` // of the full shaping time
+}
+
+// BridgeBreakdown splits the time of shaping a text with Shaper.Shape into the
+// time spent in Harfbuzz and in the C bridge.
+type BridgeBreakdown struct {
+	Font        string       `json:"font"`
+	Chars       int          `json:"chars"`
+	Glyphs      int          `json:"glyphs"`
+	Full        float64      `json:"full"`        // ns of Shaper.Shape
+	Costs       []BridgeCost `json:"costs"`       // of all primitives, including informational ones
+	Bridge      float64      `json:"bridge"`      // ns spent in the bridge per shaping
+	Harfbuzz    float64      `json:"harfbuzz"`    // Full - Bridge
+	Transitions int          `json:"transitions"` // cgo calls per shaping
+	Cgo         float64      `json:"cgo"`         // ns of transitions per shaping
+}
+
+// MeasureBridge measures the bridge primitives for shaping text with a font,
+// and the full shaping time, and breaks the latter down. measure runs a
+// function for n iterations, as often as needed, and returns ns per iteration;
+// usually it wraps testing.Benchmark. As measurements are noisy, costs are
+// clamped at 0 and the bridge at the full shaping time.
+func MeasureBridge(font *harfbuzzgoperf.HBFont, text []rune, measure func(run func(n int)) float64) BridgeBreakdown {
+	var bd BridgeBreakdown
+	shaper := NewShaper(font)
+	glyphs, _ := shaper.Shape(text)
+	bd.Chars, bd.Glyphs = len(text), len(glyphs)
+	bd.Full = measure(func(n int) {
+		for i := 0; i < n; i++ {
+			shaper.Shape(text)
+		}
+	})
+	prims, free := BridgePrimitives(font, text)
+	defer free()
+	ns := make(map[string]float64)
+	for _, p := range prims {
+		ns[p.Name] = measure(p.Run)
+	}
+	for _, p := range prims {
+		c := BridgeCost{Name: p.Name, NsPerCall: math.Max(ns[p.Name]-ns[p.Base], 0), Calls: p.Calls}
+		c.NsPerRun = c.NsPerCall * float64(c.Calls)
+		if bd.Full > 0 {
+			c.Fraction = c.NsPerRun / bd.Full
+		}
+		bd.Bridge += c.NsPerRun
+		bd.Costs = append(bd.Costs, c)
+	}
+	bd.Bridge = math.Min(bd.Bridge, bd.Full)
+	bd.Harfbuzz = bd.Full - bd.Bridge
+	// reset, 2 × direction, 2 × script, CString (malloc), add_utf8, hb_shape,
+	// free, 3 calls for glyph infos, and 3 calls per glyph
+	bd.Transitions = 12 + 3*bd.Glyphs
+	bd.Cgo = float64(bd.Transitions) * ns["cgo-call"]
+	return bd
+}
@@ -0,0 +1,147 @@
+package hbc
+
+/*
+#include <stdlib.h>
+#include <hb.h>
+*/
+import "C"
+import (
+	"errors"
+	"runtime"
+	"unsafe"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"golang.org/x/text/language"
+)
+
+// ShapePlan is a compiled Harfbuzz shape plan: the lookups and shaper selected
+// for a face, segment properties and features. Shaping with an explicit plan
+// skips the plan lookup of hb_shape. A plan may be used with any font of its
+// face.
+type ShapePlan struct {
+	Direction Direction
+	Script    language.Script
+	Language  string // BCP 47 language tag, may be empty
+	plan      uintptr
+	face      uintptr // identifies the face, not referenced
+	features  hbFeatures
+}
+
+// NewShapePlan returns a shape plan for a font, segment properties and features
+// (in Harfbuzz syntax, e.g. "liga=0,+kern"), from the plan cache of the font's
+// face (hb_shape_plan_create_cached). Plans are compiled on first use of a
+// combination and live as long as the face. If shapers are given, the first of
+// them able to shape with the font is selected (see ListShapers).
+func NewShapePlan(font *harfbuzzgoperf.HBFont, dir Direction, script language.Script, lang string,
+	features string, shapers ...string) (*ShapePlan, error) {
+	return newShapePlan(font, dir, script, lang, features, shapers, true)
+}
+
+// CompileShapePlan compiles a new shape plan, bypassing the plan cache
+// (hb_shape_plan_create). It is intended for measuring the cost of plan
+// compilation.
+func CompileShapePlan(font *harfbuzzgoperf.HBFont, dir Direction, script language.Script, lang string,
+	features string, shapers ...string) (*ShapePlan, error) {
+	return newShapePlan(font, dir, script, lang, features, shapers, false)
+}
+
+func newShapePlan(font *harfbuzzgoperf.HBFont, dir Direction, script language.Script, lang string,
+	features string, shapers []string, cached bool) (*ShapePlan, error) {
+	//
+	if font == nil || font.CFont == 0 {
+		return nil, errors.New("no Harfbuzz font for shape plan")
+	}
+	f, err := parseHBFeatures(features)
+	if err != nil {
+		return nil, err
+	}
+	p := &ShapePlan{Direction: dir, Script: script, Language: lang, features: f}
+	var props C.hb_segment_properties_t
+	props.direction = C.hb_direction_t(dir2hbdir(dir))
+	props.script = C.hb_script_t(Script4HB(script))
+	if lang != "" {
+		clang := C.CString(lang)
+		props.language = C.hb_language_from_string(clang, -1)
+		C.free(unsafe.Pointer(clang))
+	}
+	hbface := C.hb_font_get_face((*C.struct_hb_font_t)(unsafe.Pointer(font.CFont)))
+	var fptr *C.hb_feature_t
+	if len(f) > 0 {
+		fptr = &f[0]
+	}
+	var list **C.char
+	shaperList := newHBShaperList(shapers)
+	if shaperList != nil {
+		list = shaperList.list
+	}
+	var plan *C.struct_hb_shape_plan_t
+	if cached {
+		plan = C.hb_shape_plan_create_cached(hbface, &props, fptr, C.uint(len(f)), list)
+	} else {
+		plan = C.hb_shape_plan_create(hbface, &props, fptr, C.uint(len(f)), list)
+	}
+	runtime.KeepAlive(shaperList)
+	runtime.KeepAlive(font)
+	p.plan = uintptr(unsafe.Pointer(plan))
+	p.face = uintptr(unsafe.Pointer(hbface))
+	runtime.SetFinalizer(p, (*ShapePlan).Free)
+	return p, nil
+}
+
+// Shaper returns the name of the shaper selected by the plan, e.g. "ot", or ""
+// if none of the shapers requested is able to shape with the font.
+func (p *ShapePlan) Shaper() string {
+	if p.plan == 0 {
+		return ""
+	}
+	shaper := C.GoString(C.hb_shape_plan_get_shaper((*C.struct_hb_shape_plan_t)(unsafe.Pointer(p.plan))))
+	runtime.KeepAlive(p)
+	return shaper
+}
+
+// Execute shapes text with a font of the plan's face, using buf. The glyph
+// sequence returned is valid until buf is re-used. Fonts of other faces are
+// rejected with an error.
+func (p *ShapePlan) Execute(buf *HBBuffer, text string, font *harfbuzzgoperf.HBFont) (*HBGlyphSequence, error) {
+	if p.plan == 0 {
+		return nil, errors.New("shape plan has been freed")
+	}
+	if font == nil || font.CFont == 0 {
+		return nil, errors.New("no Harfbuzz font for shape plan")
+	}
+	hbfont := (*C.struct_hb_font_t)(unsafe.Pointer(font.CFont))
+	if uintptr(unsafe.Pointer(C.hb_font_get_face(hbfont))) != p.face {
+		return nil, errors.New("font is not of the shape plan's face")
+	}
+	buf.Reset()
+	setHBBufferDirection(buf.hbbuf, p.Direction)
+	setHBBufferScript(buf.hbbuf, Script4HB(p.Script))
+	if p.Language != "" {
+		setHBBufferLanguage(buf.hbbuf, p.Language)
+	}
+	ptr := (*C.struct_hb_buffer_t)(unsafe.Pointer(buf.hbbuf))
+	cstr := C.CString(text)
+	C.hb_buffer_add_utf8(ptr, cstr, C.int(len(text)), 0, C.int(len(text)))
+	C.free(unsafe.Pointer(cstr))
+	var fptr *C.hb_feature_t
+	if len(p.features) > 0 {
+		fptr = &p.features[0]
+	}
+	ok := C.hb_shape_plan_execute((*C.struct_hb_shape_plan_t)(unsafe.Pointer(p.plan)),
+		hbfont, ptr, fptr, C.uint(len(p.features)))
+	runtime.KeepAlive(p) // the finalizer of p destroys the plan
+	runtime.KeepAlive(font)
+	runtime.KeepAlive(buf)
+	if ok == 0 {
+		return nil, errors.New("shape plan execution failed")
+	}
+	return getHBGlyphInfo(buf.hbbuf), nil
+}
+
+// Free releases the plan. Plans are released when garbage collected as well.
+func (p *ShapePlan) Free() {
+	if p.plan != 0 {
+		C.hb_shape_plan_destroy((*C.struct_hb_shape_plan_t)(unsafe.Pointer(p.plan)))
+		p.plan = 0
+	}
+}
@@ -0,0 +1,289 @@
+package harfbuzzgoperf
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
+)
+
+// --- Font inspection -------------------------------------------------------
+
+// FontInfo describes what a font supports.
+type FontInfo struct {
+	FaceDescriptor                 // family and style names, weight, style, stretch
+	UnitsPerEm     int             // design units per em
+	NumGlyphs      int             // number of glyphs
+	Layout         []LayoutTable   // GSUB and GPOS tables, if present
+	Axes           []Axis          // variation axes
+	Instances      []NamedInstance // named instances of a variable font
+}
+
+// LayoutTable lists the scripts, language systems and features of an OpenType
+// layout table (GSUB or GPOS).
+type LayoutTable struct {
+	Tag     string // "GSUB" or "GPOS"
+	Scripts []LayoutScript
+}
+
+// LayoutScript is a script of a layout table.
+type LayoutScript struct {
+	Tag       string           // OpenType script tag, e.g. "latn"
+	Languages []LayoutLanguage // the default language system has tag "dflt"
+}
+
+// LayoutLanguage is a language system of a script.
+type LayoutLanguage struct {
+	Tag      string          // OpenType language system tag, e.g. "TRK "
+	Features []LayoutFeature // a required feature comes first
+}
+
+// LayoutFeature is a feature of a language system.
+type LayoutFeature struct {
+	Tag     string // feature tag, e.g. "liga"
+	Lookups []int  // indices into the lookup list of the layout table
+}
+
+// Axis is a variation axis, with values in design units.
+type Axis struct {
+	Tag               string
+	Min, Default, Max float32
+}
+
+// NamedInstance is a named instance of a variable font.
+type NamedInstance struct {
+	Name   string    // subfamily name
+	Coords []float32 // design coordinates, one per axis
+}
+
+// Scripts returns the script tags of all layout tables.
+func (info FontInfo) Scripts() []string {
+	set := make(map[string]bool)
+	for _, t := range info.Layout {
+		for _, s := range t.Scripts {
+			set[s.Tag] = true
+		}
+	}
+	return sortedKeys(set)
+}
+
+// Languages returns the language system tags of all layout tables, excluding "dflt".
+func (info FontInfo) Languages() []string {
+	set := make(map[string]bool)
+	for _, t := range info.Layout {
+		for _, s := range t.Scripts {
+			for _, l := range s.Languages {
+				if l.Tag != DefaultLanguage {
+					set[l.Tag] = true
+				}
+			}
+		}
+	}
+	return sortedKeys(set)
+}
+
+// Features returns the feature tags for a script and language system, for all
+// layout tables.
+func (info FontInfo) Features(script, lang string) []string {
+	set := make(map[string]bool)
+	for _, t := range info.Layout {
+		for _, s := range t.Scripts {
+			for _, l := range s.Languages {
+				if s.Tag == script && l.Tag == lang {
+					for _, f := range l.Features {
+						set[f.Tag] = true
+					}
+				}
+			}
+		}
+	}
+	return sortedKeys(set)
+}
+
+// sortedKeys returns the elements of a set of strings, sorted.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DefaultLanguage is the tag of the default language system of a script.
+const DefaultLanguage = "dflt"
+
+// Info returns information about the font, as read by textlayout.
+func (f *HBFont) Info() (FontInfo, error) {
+	var face *tt.Font
+	if f.Face != nil {
+		face = f.Face.GoFace
+	} else if f.GoFont != nil {
+		face, _ = f.GoFont.Face().(*tt.Font)
+	}
+	if face == nil {
+		var err error
+		if face, err = tt.Parse(bytes.NewReader(f.Binary), true); err != nil {
+			return FontInfo{}, err
+		}
+	}
+	info := FontInfo{
+		FaceDescriptor: describeFace(face),
+		UnitsPerEm:     int(face.Upem()),
+		NumGlyphs:      face.NumGlyphs,
+		Layout:         ReadLayoutTables(face),
+	}
+	fvar := face.Variations()
+	for _, a := range fvar.Axis {
+		info.Axes = append(info.Axes, Axis{Tag: a.Tag.String(), Min: a.Minimum, Default: a.Default, Max: a.Maximum})
+	}
+	for _, inst := range fvar.Instances {
+		info.Instances = append(info.Instances, NamedInstance{
+			Name:   fontName(face, inst.Subfamily),
+			Coords: inst.Coords,
+		})
+	}
+	return info, nil
+}
+
+// ReadLayoutTables lists scripts, language systems and features of the GSUB and
+// GPOS tables of a face, as parsed by textlayout. Absent tables are omitted.
+func ReadLayoutTables(face *tt.Font) []LayoutTable {
+	var tables []LayoutTable
+	lt := face.LayoutTables()
+	if len(lt.GSUB.Scripts) > 0 {
+		tables = append(tables, layoutTable("GSUB", lt.GSUB.TableLayout))
+	}
+	if len(lt.GPOS.Scripts) > 0 {
+		tables = append(tables, layoutTable("GPOS", lt.GPOS.TableLayout))
+	}
+	return tables
+}
+
+func layoutTable(tag string, t tt.TableLayout) LayoutTable {
+	table := LayoutTable{Tag: tag}
+	for _, s := range t.Scripts {
+		script := LayoutScript{Tag: s.Tag.String()}
+		if s.DefaultLanguage != nil {
+			script.Languages = append(script.Languages, layoutLanguage(DefaultLanguage, *s.DefaultLanguage, t))
+		}
+		for _, l := range s.Languages {
+			script.Languages = append(script.Languages, layoutLanguage(l.Tag.String(), l, t))
+		}
+		table.Scripts = append(table.Scripts, script)
+	}
+	return table
+}
+
+func layoutLanguage(tag string, l tt.LangSys, t tt.TableLayout) LayoutLanguage {
+	lang := LayoutLanguage{Tag: tag}
+	indices := l.Features
+	if l.RequiredFeatureIndex != 0xFFFF {
+		indices = append([]uint16{l.RequiredFeatureIndex}, indices...)
+	}
+	for _, i := range indices {
+		if int(i) < len(t.Features) {
+			f := LayoutFeature{Tag: t.Features[i].Tag.String()}
+			for _, l := range t.Features[i].LookupIndices {
+				f.Lookups = append(f.Lookups, int(l))
+			}
+			lang.Features = append(lang.Features, f)
+		}
+	}
+	return lang
+}
+
+// Compare returns a list of differences between two font infos, e.g. as read by
+// different backends. Layout tables are compared only if both infos have them,
+// see CompareLayout.
+func (info FontInfo) Compare(other FontInfo) []string {
+	var diffs []string
+	differ := func(what string, a, b interface{}) {
+		if fmt.Sprint(a) != fmt.Sprint(b) {
+			diffs = append(diffs, fmt.Sprintf("%s: %v ≠ %v", what, a, b))
+		}
+	}
+	differ("units per em", info.UnitsPerEm, other.UnitsPerEm)
+	differ("glyphs", info.NumGlyphs, other.NumGlyphs)
+	differ("axes", info.Axes, other.Axes)
+	differ("instances", len(info.Instances), len(other.Instances))
+	for i := 0; i < len(info.Instances) && i < len(other.Instances); i++ {
+		differ(fmt.Sprintf("instance #%d", i), info.Instances[i].Coords, other.Instances[i].Coords)
+	}
+	if info.Layout != nil && other.Layout != nil {
+		diffs = append(diffs, CompareLayout(info.Layout, other.Layout)...)
+	}
+	return diffs
+}
+
+// CompareLayout returns a list of differences between two sets of layout tables:
+// for every table, the sets of scripts and language systems, and per language
+// system the set of features and their lookups. Language systems without
+// features are ignored.
+func CompareLayout(a, b []LayoutTable) []string {
+	var diffs []string
+	differ := func(what string, x, y interface{}) {
+		if fmt.Sprint(x) != fmt.Sprint(y) {
+			diffs = append(diffs, fmt.Sprintf("%s: %v ≠ %v", what, x, y))
+		}
+	}
+	ma, mb := layoutMap(a), layoutMap(b)
+	differ("tables", tableTags(ma), tableTags(mb))
+	for _, table := range tableTags(ma) {
+		la, lb := ma[table], mb[table]
+		differ(table+" scripts and language systems", langSystems(la), langSystems(lb))
+		for _, ls := range langSystems(la) {
+			if features, ok := lb[ls]; ok {
+				differ(table+" features of "+ls, la[ls], features)
+			}
+		}
+	}
+	return diffs
+}
+
+// tableTags returns the table tags of a layout map, sorted.
+func tableTags(m map[string]map[string][]string) []string {
+	tags := make([]string, 0, len(m))
+	for tag := range m {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// langSystems returns the script and language system tags of a table of a
+// layout map, sorted.
+func langSystems(m map[string][]string) []string {
+	tags := make([]string, 0, len(m))
+	for tag := range m {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// layoutMap maps table tags to script and language system tags to a sorted list
+// of feature descriptions. Scripts are entered with an empty language system.
+func layoutMap(tables []LayoutTable) map[string]map[string][]string {
+	m := make(map[string]map[string][]string)
+	for _, t := range tables {
+		langs := make(map[string][]string)
+		for _, s := range t.Scripts {
+			langs[s.Tag] = nil
+			for _, l := range s.Languages {
+				if len(l.Features) == 0 {
+					continue
+				}
+				var features []string
+				for _, f := range l.Features {
+					features = append(features, fmt.Sprintf("%s%v", f.Tag, f.Lookups))
+				}
+				sort.Strings(features)
+				langs[s.Tag+"/"+l.Tag] = features
+			}
+		}
+		m[t.Tag] = langs
+	}
+	return m
+}
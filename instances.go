@@ -0,0 +1,208 @@
+package harfbuzzgoperf
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
+	hb "github.com/benoitkugler/textlayout/harfbuzz"
+)
+
+// --- Font faces ------------------------------------------------------------
+
+// Face is a parsed font face. A face is shared by all instances (sizes, variations)
+// of a font, in both backends.
+type Face struct {
+	FaceDescriptor // properties for font matching
+	Name           string
+	Binary         []byte
+	GoFace         *tt.Font // parsed by textlayout
+	cface          uintptr  // native face of the C backend, created on demand
+	once           sync.Once
+}
+
+// ParseFace parses a font binary into a face, reading its descriptor from the
+// 'name' and 'OS/2' tables. Font binaries may be untrusted: textlayout panics
+// on some malformed tables, which is reported as an error.
+func ParseFace(name string, binary []byte) (face *Face, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			face, err = nil, fmt.Errorf("cannot parse font %q: %v", name, r)
+		}
+	}()
+	f, err := tt.Parse(bytes.NewReader(binary), true)
+	if err != nil {
+		return nil, err
+	}
+	return &Face{FaceDescriptor: describeFace(f), Name: name, Binary: binary, GoFace: f}, nil
+}
+
+// NativeFace returns the face's native representation for the C backend,
+// calling create exactly once.
+func (f *Face) NativeFace(create func([]byte) uintptr) uintptr {
+	f.once.Do(func() {
+		f.cface = create(f.Binary)
+	})
+	return f.cface
+}
+
+// CanonicalVariations parses a list of font variations (e.g. "wght=700,wdth=75")
+// and returns them in a canonical string form, sorted by axis tag.
+func CanonicalVariations(variations string) (string, []tt.Variation, error) {
+	if strings.TrimSpace(variations) == "" {
+		return "", nil, nil
+	}
+	var vars []tt.Variation
+	for _, v := range strings.Split(variations, ",") {
+		vari, err := hb.ParseVariation(strings.TrimSpace(v))
+		if err != nil {
+			return "", nil, err
+		}
+		vars = append(vars, vari)
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Tag < vars[j].Tag })
+	s := make([]string, len(vars))
+	for i, v := range vars {
+		s[i] = v.Tag.String() + "=" + strconv.FormatFloat(float64(v.Value), 'g', -1, 32)
+	}
+	return strings.Join(s, ","), vars, nil
+}
+
+// --- Font instance cache ---------------------------------------------------
+
+// InstanceKey identifies a font instance of a face.
+type InstanceKey struct {
+	Backend    string  // "go" or "c"
+	Face       *Face   // shared face
+	Size       float32 // point size
+	Variations string  // variations in canonical form, see CanonicalVariations
+	Slant      float32 // synthetic slant, as a ratio of x to y
+}
+
+// InstanceCache caches font instances, evicting the least recently used ones
+// if the estimated memory of all instances exceeds a limit. Evicted instances are
+// dropped from the cache only; backends free their native resources when an
+// instance is garbage collected.
+//
+// An InstanceCache is safe for concurrent use.
+type InstanceCache struct {
+	mx        sync.Mutex
+	maxBytes  int64
+	bytes     int64
+	lru       *list.List // of *instanceEntry, most recently used first
+	instances map[InstanceKey]*list.Element
+	pending   map[InstanceKey]*pendingInstance // instances being created
+	stats     InstanceStats
+}
+
+// InstanceStats reports usage statistics of an instance cache.
+type InstanceStats struct {
+	Hits, Misses, Evictions int64
+	Instances               int   // number of cached instances
+	Bytes                   int64 // estimated memory used by cached instances
+}
+
+type instanceEntry struct {
+	key  InstanceKey
+	font *HBFont
+	size int64
+}
+
+// pendingInstance is an instance being created. done is closed after creation.
+type pendingInstance struct {
+	done chan struct{}
+	font *HBFont
+	err  error
+}
+
+// NewInstanceCache creates a cache for font instances, using at most maxBytes
+// of memory (estimated).
+func NewInstanceCache(maxBytes int64) *InstanceCache {
+	return &InstanceCache{
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		instances: make(map[InstanceKey]*list.Element),
+		pending:   make(map[InstanceKey]*pendingInstance),
+	}
+}
+
+// GlobalInstances is the default cache for font instances.
+var GlobalInstances = NewInstanceCache(256 << 20)
+
+// Instance returns the font instance for key. If the instance is not cached, it
+// will be created by calling create, which returns the font together with an
+// estimate of its memory size. create is called without holding the cache's
+// lock; concurrent requests for an instance being created wait for it.
+func (c *InstanceCache) Instance(key InstanceKey, create func() (*HBFont, int64, error)) (*HBFont, error) {
+	c.mx.Lock()
+	if el, ok := c.instances[key]; ok {
+		c.lru.MoveToFront(el)
+		c.stats.Hits++
+		c.mx.Unlock()
+		return el.Value.(*instanceEntry).font, nil
+	}
+	if p, ok := c.pending[key]; ok {
+		c.stats.Hits++
+		c.mx.Unlock()
+		<-p.done
+		return p.font, p.err
+	}
+	c.stats.Misses++
+	p := &pendingInstance{done: make(chan struct{})}
+	c.pending[key] = p
+	c.mx.Unlock()
+	var size int64
+	defer func() { // wakes up waiting requests, even if create panics
+		c.mx.Lock()
+		delete(c.pending, key)
+		if p.err == nil && p.font != nil {
+			c.insert(key, p.font, size)
+		} else if p.err == nil {
+			p.err = fmt.Errorf("cannot create %s font instance of %s", key.Backend, key.Face.Name)
+		}
+		c.mx.Unlock()
+		close(p.done)
+	}()
+	p.font, size, p.err = create()
+	return p.font, p.err
+}
+
+// insert adds an instance to the cache and evicts least recently used ones.
+// c.mx must be held.
+func (c *InstanceCache) insert(key InstanceKey, font *HBFont, size int64) {
+	tracer().Debugf("new %s font instance of %s at %.2fpt (~%d bytes)", key.Backend, key.Face.Name, key.Size, size)
+	c.instances[key] = c.lru.PushFront(&instanceEntry{key: key, font: font, size: size})
+	c.bytes += size
+	for c.bytes > c.maxBytes && c.lru.Len() > 1 {
+		el := c.lru.Back()
+		e := el.Value.(*instanceEntry)
+		c.lru.Remove(el)
+		delete(c.instances, e.key)
+		c.bytes -= e.size
+		c.stats.Evictions++
+	}
+}
+
+// Stats returns usage statistics of the cache.
+func (c *InstanceCache) Stats() InstanceStats {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	stats := c.stats
+	stats.Instances = len(c.instances)
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// Purge drops all instances from the cache.
+func (c *InstanceCache) Purge() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.lru.Init()
+	c.instances = make(map[InstanceKey]*list.Element)
+	c.bytes = 0
+}
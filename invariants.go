@@ -0,0 +1,103 @@
+package harfbuzzgoperf
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
+)
+
+// --- Invariants of shaping output ------------------------------------------
+
+// InvariantError lists the violations of shaping invariants found in a run of
+// glyphs.
+type InvariantError struct {
+	Violations []string
+}
+
+func (e *InvariantError) Error() string {
+	return "shaped run violates invariants: " + strings.Join(e.Violations, "; ")
+}
+
+// maxViolations is the number of violations reported per run.
+const maxViolations = 10
+
+// CheckRun checks the structural invariants of a run of glyphs shaped from a
+// text of n characters:
+//
+//   - clusters are monotonic in the direction of the run (decreasing for
+//     backward runs, see IsBackward)
+//   - every character is covered by a cluster, i.e., clusters start at 0 and
+//     are less than n
+//   - glyph IDs are less than the number of glyphs of the font, if numGlyphs > 0
+//   - advances and offsets are finite
+//   - glyph flags are equal for all glyphs of a cluster
+//
+// CheckRun returns an *InvariantError if any of them is violated.
+func CheckRun(glyphs []ShapedGlyph, n int, rtl bool, numGlyphs int) error {
+	var violations []string
+	report := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, args...))
+	}
+	minCluster := n
+	for i, g := range glyphs {
+		if g.Cluster < 0 || g.Cluster >= n {
+			report("cluster %d of glyph #%d out of range of %d characters", g.Cluster, i, n)
+		} else if g.Cluster < minCluster {
+			minCluster = g.Cluster
+		}
+		if numGlyphs > 0 && int(g.GID) >= numGlyphs {
+			report("glyph ID %d of glyph #%d out of range of %d glyphs", g.GID, i, numGlyphs)
+		}
+		if !finite(g.XAdvance) || !finite(g.YAdvance) || !finite(g.XOffset) || !finite(g.YOffset) {
+			report("glyph #%d has non-finite position (%g,%g)+(%g,%g)", i,
+				g.XAdvance, g.YAdvance, g.XOffset, g.YOffset)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := glyphs[i-1]
+		if (!rtl && g.Cluster < prev.Cluster) || (rtl && g.Cluster > prev.Cluster) {
+			report("cluster %d of glyph #%d follows cluster %d", g.Cluster, i, prev.Cluster)
+		} else if g.Cluster == prev.Cluster && g.Flags != prev.Flags {
+			report("flags %#x of glyph #%d differ from flags %#x within cluster %d", g.Flags, i,
+				prev.Flags, g.Cluster)
+		}
+	}
+	if len(glyphs) > 0 && minCluster > 0 && minCluster < n {
+		report("characters [0…%d) are not covered by a cluster", minCluster)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	if len(violations) > maxViolations {
+		violations = append(violations[:maxViolations], fmt.Sprintf("%d more", len(violations)-maxViolations))
+	}
+	return &InvariantError{Violations: violations}
+}
+
+// IsBackward returns true for directions in which clusters of shaped runs
+// decrease, i.e. right-to-left and bottom-to-top. dir is a direction as
+// encoded by Harfbuzz (HB_DIRECTION_*), which textlayout shares.
+func IsBackward(dir int32) bool {
+	return dir&^2 == 5
+}
+
+func finite(x float64) bool {
+	return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
+
+// NumGlyphs returns the number of glyphs of the font, as read by textlayout,
+// or 0 if the font has not been parsed by textlayout.
+func (f *HBFont) NumGlyphs() int {
+	if f.Face != nil && f.Face.GoFace != nil {
+		return f.Face.GoFace.NumGlyphs
+	}
+	if f.GoFont != nil {
+		if face, ok := f.GoFont.Face().(*tt.Font); ok {
+			return face.NumGlyphs
+		}
+	}
+	return 0
+}
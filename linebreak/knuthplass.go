@@ -0,0 +1,365 @@
+package linebreak
+
+import (
+	"errors"
+	"math"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// --- Paragraph items -------------------------------------------------------
+
+// ItemType is the type of an element of a Knuth-Plass paragraph.
+type ItemType int
+
+// Knuth and Plass model a paragraph as a sequence of boxes, glue and penalties.
+const (
+	BoxItem     ItemType = iota // unbreakable material
+	GlueItem                    // stretchable and shrinkable white space
+	PenaltyItem                 // potential break point with a cost
+)
+
+// Penalties at or beyond these values forbid or force a line break.
+const (
+	InfPenalty    = 10000.0
+	ForcedPenalty = -InfPenalty
+)
+
+// Item is an element of a Knuth-Plass paragraph.
+type Item struct {
+	Type     ItemType
+	Width    float64 // natural width in pt
+	Stretch  float64 // stretchability of glue
+	Shrink   float64 // shrinkability of glue
+	Penalty  float64 // cost of breaking at a penalty
+	Flagged  bool    // penalty is a flagged break (e.g., after a hyphen)
+	TextEnd  int     // text position a line broken at this item ends at
+	GlyphEnd int     // glyph position a line broken at this item ends at
+}
+
+// KPParams holds the parameters of a Knuth-Plass paragraph breaker.
+type KPParams struct {
+	Tolerance        float64 // maximum adjustment ratio of a line
+	EmergencyStretch float64 // maximum adjustment ratio for a second pass, if the first one fails
+	StretchRatio     float64 // stretchability of spaces, relative to their width
+	ShrinkRatio      float64 // shrinkability of spaces, relative to their width
+	LinePenalty      float64 // demerits added for every line
+	HyphenPenalty    float64 // penalty for breaking after an explicit hyphen, a flagged break
+	FlaggedDemerits  float64 // demerits for two consecutive flagged breaks
+	FitnessDemerits  float64 // demerits for visually incompatible consecutive lines
+}
+
+// DefaultKPParams returns parameters as recommended by Knuth for TeX.
+func DefaultKPParams() *KPParams {
+	return &KPParams{
+		Tolerance:        1.26, // badness 200
+		EmergencyStretch: 10,
+		StretchRatio:     0.5,
+		ShrinkRatio:      0.333,
+		LinePenalty:      10,
+		HyphenPenalty:    50,
+		FlaggedDemerits:  3000,
+		FitnessDemerits:  100,
+	}
+}
+
+// Items converts segments of a shaped paragraph into boxes, glue and penalties.
+// Trailing white space of a segment becomes glue, non-white break opportunities
+// become penalties, flagged ones after hyphens, and mandatory breaks and the
+// end of the paragraph are preceded by infinitely stretchable glue and a forced
+// break.
+func Items(segs []Segment, params *KPParams) []Item {
+	items := make([]Item, 0, 2*len(segs)+2)
+	for i, seg := range segs {
+		box := Item{Type: BoxItem, Width: seg.Width - seg.Trailing, TextEnd: seg.TextEnd, GlyphEnd: seg.GlyphEnd}
+		items = append(items, box)
+		switch {
+		case seg.Mandatory || i == len(segs)-1:
+			items = append(items,
+				Item{Type: PenaltyItem, Penalty: InfPenalty, TextEnd: seg.TextEnd, GlyphEnd: seg.GlyphEnd},
+				Item{Type: GlueItem, Stretch: math.Inf(1), TextEnd: seg.TextEnd, GlyphEnd: seg.GlyphEnd},
+				Item{Type: PenaltyItem, Penalty: ForcedPenalty, TextEnd: seg.TextEnd, GlyphEnd: seg.GlyphEnd})
+		case seg.Trailing > 0:
+			items = append(items, Item{
+				Type:     GlueItem,
+				Width:    seg.Trailing,
+				Stretch:  seg.Trailing * params.StretchRatio,
+				Shrink:   seg.Trailing * params.ShrinkRatio,
+				TextEnd:  seg.TextEnd,
+				GlyphEnd: seg.GlyphEnd,
+			})
+		case seg.Hyphen:
+			items = append(items, Item{
+				Type:     PenaltyItem,
+				Penalty:  params.HyphenPenalty,
+				Flagged:  true,
+				TextEnd:  seg.TextEnd,
+				GlyphEnd: seg.GlyphEnd,
+			})
+		default:
+			items = append(items, Item{Type: PenaltyItem, TextEnd: seg.TextEnd, GlyphEnd: seg.GlyphEnd})
+		}
+	}
+	return items
+}
+
+// --- Total-fit line breaking -----------------------------------------------
+
+// Breakpoint is a line break as chosen by the Knuth-Plass algorithm.
+type Breakpoint struct {
+	Item     int     // index of the item the line is broken at
+	Line     Line    // the line ending at this break
+	Ratio    float64 // adjustment ratio of the line
+	Badness  float64 // badness of the line
+	Demerits float64 // total demerits of the paragraph up to this break
+}
+
+// ErrNoBreakpoints is returned if a paragraph does not end with a forced break.
+var ErrNoBreakpoints = errors.New("paragraph has no final forced break")
+
+// kpSums are running totals of the widths, stretchability and shrinkability of
+// items. Infinite stretchability is counted in fil, separate from the finite
+// one, as TeX does with its orders of infinity: infinities would not cancel
+// out in the difference of totals.
+type kpSums struct {
+	width, stretch, fil, shrink float64
+}
+
+func (s *kpSums) add(glue Item) {
+	s.width += glue.Width
+	if math.IsInf(glue.Stretch, 1) {
+		s.fil++
+	} else {
+		s.stretch += glue.Stretch
+	}
+	s.shrink += glue.Shrink
+}
+
+type kpNode struct {
+	item           int
+	line           int
+	fitness        int
+	totals         kpSums // totals after the break
+	ratio, badness float64
+	demerits       float64
+	prev           *kpNode
+}
+
+// KnuthPlass breaks a paragraph of items into lines of a given width, minimizing
+// the total demerits of the paragraph. If no feasible set of breaks within
+// the tolerance exists, a second pass with `params.EmergencyStretch` as
+// tolerance is run. If this fails as well, lines will be forced to overflow.
+func KnuthPlass(items []Item, width float64, params *KPParams) ([]Breakpoint, error) {
+	if len(items) == 0 || items[len(items)-1].Type != PenaltyItem ||
+		items[len(items)-1].Penalty > ForcedPenalty {
+		return nil, ErrNoBreakpoints
+	}
+	if params == nil {
+		params = DefaultKPParams()
+	}
+	active, forced := kpPass(items, width, params.Tolerance, params)
+	if forced && params.EmergencyStretch > params.Tolerance {
+		tracer().Debugf("Knuth-Plass: no feasible breaks, starting second pass")
+		active, _ = kpPass(items, width, params.EmergencyStretch, params)
+	}
+	var best *kpNode
+	for _, a := range active {
+		if a.item == len(items)-1 && (best == nil || a.demerits < best.demerits) {
+			best = a
+		}
+	}
+	if best == nil {
+		return nil, ErrNoBreakpoints
+	}
+	breaks := make([]Breakpoint, best.line)
+	for n := best; n.prev != nil; n = n.prev {
+		bp := Breakpoint{Item: n.item, Ratio: n.ratio, Badness: n.badness, Demerits: n.demerits}
+		if n.prev.item >= 0 {
+			bp.Line.TextStart, bp.Line.GlyphStart = items[n.prev.item].TextEnd, items[n.prev.item].GlyphEnd
+		}
+		bp.Line.TextEnd, bp.Line.GlyphEnd = items[n.item].TextEnd, items[n.item].GlyphEnd
+		bp.Line.Width = kpLineWidth(items, n.prev.item+1, n.item)
+		breaks[n.line-1] = bp
+	}
+	return breaks, nil
+}
+
+// kpPass runs the Knuth-Plass algorithm for a given tolerance and returns the
+// final active nodes. It reports if breaks had to be forced.
+func kpPass(items []Item, width, tolerance float64, params *KPParams) ([]*kpNode, bool) {
+	active := []*kpNode{{item: -1, fitness: 1}}
+	var sums kpSums
+	forced, f := false, false
+	for b, item := range items {
+		switch item.Type {
+		case BoxItem:
+			sums.width += item.Width
+			continue
+		case GlueItem:
+			legal := b > 0 && items[b-1].Type == BoxItem
+			if legal {
+				active, f = kpTryBreak(items, b, active, width, tolerance, sums, params)
+				forced = forced || f
+			}
+			sums.add(item)
+		case PenaltyItem:
+			if item.Penalty < InfPenalty {
+				active, f = kpTryBreak(items, b, active, width, tolerance, sums, params)
+				forced = forced || f
+			}
+		}
+	}
+	return active, forced
+}
+
+// kpTryBreak checks item b as a potential break for every active node, deactivating
+// nodes which are too far behind and adding the best new node for every
+// fitness class.
+func kpTryBreak(items []Item, b int, active []*kpNode, width, tolerance float64, sums kpSums,
+	params *KPParams) ([]*kpNode, bool) {
+	//
+	var candidates [4]*kpNode
+	var lastDeactivated *kpNode
+	penalty, flagged := 0.0, false
+	if items[b].Type == PenaltyItem {
+		penalty, flagged = items[b].Penalty, items[b].Flagged
+	}
+	keep := active[:0]
+	for _, a := range active {
+		L := sums.width - a.totals.width
+		if items[b].Type == PenaltyItem {
+			L += items[b].Width
+		}
+		r := 0.0
+		if L < width {
+			if sums.fil > a.totals.fil {
+				r = 0 // infinite stretchability fills the line
+			} else if y := sums.stretch - a.totals.stretch; y > 0 {
+				r = (width - L) / y
+			} else {
+				r = math.Inf(1)
+			}
+		} else if L > width {
+			if z := sums.shrink - a.totals.shrink; z > 0 {
+				r = (width - L) / z
+			} else {
+				r = math.Inf(-1)
+			}
+		}
+		if r < -1 || penalty <= ForcedPenalty {
+			lastDeactivated = a
+		} else {
+			keep = append(keep, a)
+		}
+		if r < -1 || r > tolerance {
+			continue
+		}
+		n := kpNewNode(items, b, a, r, penalty, flagged, params)
+		if c := candidates[n.fitness]; c == nil || n.demerits < c.demerits {
+			candidates[n.fitness] = n
+		}
+	}
+	found := false
+	for _, c := range candidates {
+		if c != nil {
+			found = true
+			keep = append(keep, c)
+		}
+	}
+	forced := !found && len(keep) == 0 && lastDeactivated != nil
+	if forced {
+		// rescue: nothing fits, so force an overfull or underfull line
+		tracer().Debugf("Knuth-Plass: forcing break at item %d of %d", b, len(items))
+		keep = append(keep, kpNewNode(items, b, lastDeactivated, -1, penalty, flagged, params))
+	}
+	for _, n := range keep {
+		if n.item == b {
+			n.totals = kpTotalsAfter(items, b, sums)
+		}
+	}
+	return keep, forced
+}
+
+func kpNewNode(items []Item, b int, a *kpNode, r, penalty float64, flagged bool, params *KPParams) *kpNode {
+	badness := 100 * math.Pow(math.Abs(r), 3)
+	if math.IsInf(r, 0) {
+		badness = InfPenalty
+	}
+	d := math.Pow(params.LinePenalty+badness, 2)
+	if penalty >= 0 {
+		d += penalty * penalty
+	} else if penalty > ForcedPenalty {
+		d -= penalty * penalty
+	}
+	if flagged && a.item >= 0 && items[a.item].Type == PenaltyItem && items[a.item].Flagged {
+		d += params.FlaggedDemerits
+	}
+	fitness := 1
+	switch {
+	case r < -0.5:
+		fitness = 0
+	case r <= 0.5:
+		fitness = 1
+	case r <= 1:
+		fitness = 2
+	default:
+		fitness = 3
+	}
+	if fitness-a.fitness > 1 || a.fitness-fitness > 1 {
+		d += params.FitnessDemerits
+	}
+	return &kpNode{
+		item:     b,
+		line:     a.line + 1,
+		fitness:  fitness,
+		ratio:    r,
+		badness:  badness,
+		demerits: a.demerits + d,
+		prev:     a,
+	}
+}
+
+// kpTotalsAfter computes the totals from which a line starting after a break at b
+// will be measured. Glue and non-forced penalties following a break are
+// discarded.
+func kpTotalsAfter(items []Item, b int, sums kpSums) kpSums {
+	for i := b; i < len(items); i++ {
+		item := items[i]
+		if item.Type == BoxItem || (item.Type == PenaltyItem && item.Penalty <= ForcedPenalty && i > b) {
+			break
+		}
+		if item.Type == GlueItem {
+			sums.add(item)
+		}
+	}
+	return sums
+}
+
+// kpLineWidth returns the natural width of items [from…to), where `to`
+// is the break item. Discardable items at the start of the line are skipped.
+func kpLineWidth(items []Item, from, to int) float64 {
+	for from < to && items[from].Type != BoxItem {
+		from++
+	}
+	var w float64
+	for i := from; i < to; i++ {
+		if items[i].Type != PenaltyItem {
+			w += items[i].Width
+		}
+	}
+	if items[to].Type == PenaltyItem {
+		w += items[to].Width
+	}
+	return w
+}
+
+// KnuthPlassParagraph breaks a shaped paragraph into lines of a given width,
+// using the Knuth-Plass total-fit algorithm.
+func KnuthPlassParagraph(text []rune, glyphs []harfbuzzgoperf.ShapedGlyph, width float64,
+	params *KPParams) ([]Breakpoint, error) {
+	//
+	if params == nil {
+		params = DefaultKPParams()
+	}
+	return KnuthPlass(Items(Segments(text, glyphs), params), width, params)
+}
@@ -0,0 +1,145 @@
+/*
+Package linebreak breaks shaped paragraphs into lines.
+
+Break opportunities are found in the source text following UAX #14 (Unicode
+Line Breaking Algorithm) and are mapped onto shaped glyphs via the glyphs'
+clusters. Lines are then fitted greedily to a given width, using the glyph
+advances from either shaping backend.
+
+Glyphs are expected to be in logical order, with clusters increasing
+monotonically, i.e., as output for left-to-right text.
+*/
+package linebreak
+
+import (
+	"unicode"
+
+	"github.com/benoitkugler/textlayout/pango"
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/schuko/tracing"
+)
+
+// tracer traces to tracing key 'hbperf.linebreak'.
+func tracer() tracing.Trace {
+	return tracing.Select("hbperf.linebreak")
+}
+
+// Opportunity is a position in the text where a line may be broken.
+type Opportunity struct {
+	Position  int  // rune index; the line break is in front of this rune
+	Mandatory bool // a line break is required at this position
+}
+
+// Opportunities finds the UAX #14 line break opportunities of a paragraph of text.
+// The start of the text is never reported, the end of the text always is,
+// as a mandatory break.
+func Opportunities(text []rune) []Opportunity {
+	attrs := pango.ComputeCharacterAttributes(text, -1)
+	var opps []Opportunity
+	for i := 1; i < len(text); i++ {
+		if attrs[i].IsLineBreak() {
+			opps = append(opps, Opportunity{
+				Position:  i,
+				Mandatory: attrs[i].IsMandatoryBreak(),
+			})
+		}
+	}
+	return append(opps, Opportunity{Position: len(text), Mandatory: true})
+}
+
+// Segment is an unbreakable piece of a shaped paragraph, ranging from one break
+// opportunity to the next.
+type Segment struct {
+	TextStart, TextEnd   int     // range of runes
+	GlyphStart, GlyphEnd int     // range of glyphs
+	Width                float64 // sum of the glyph advances, in pt
+	Trailing             float64 // width of trailing white space, in pt
+	Mandatory            bool    // segment has to end a line
+	Hyphen               bool    // segment ends with an explicit hyphen
+}
+
+// Segments maps the line break opportunities of text onto its shaped glyphs.
+// Opportunities falling inside a cluster (e.g., within a ligature) cannot be
+// represented on glyph level and will be dropped.
+func Segments(text []rune, glyphs []harfbuzzgoperf.ShapedGlyph) []Segment {
+	opps := Opportunities(text)
+	segs := make([]Segment, 0, len(opps))
+	seg := Segment{}
+	g := 0
+	for _, opp := range opps {
+		for g < len(glyphs) && glyphs[g].Cluster < opp.Position {
+			seg.Width += glyphs[g].XAdvance
+			if unicode.IsSpace(text[glyphs[g].Cluster]) {
+				seg.Trailing += glyphs[g].XAdvance
+			} else {
+				seg.Trailing = 0
+			}
+			g++
+		}
+		if g < len(glyphs) && glyphs[g].Cluster > opp.Position {
+			tracer().Debugf("break opportunity at %d is inside a cluster", opp.Position)
+			continue
+		}
+		seg.TextEnd, seg.GlyphEnd = opp.Position, g
+		seg.Mandatory = opp.Mandatory
+		seg.Hyphen = isHyphen(text[opp.Position-1])
+		segs = append(segs, seg)
+		seg = Segment{TextStart: opp.Position, GlyphStart: g}
+	}
+	return segs
+}
+
+// isHyphen returns true for characters which are hyphens, after which a line
+// break is flagged.
+func isHyphen(r rune) bool {
+	switch r {
+	case '-', '\u2010', '\u2012', '\u2013': // hyphen-minus, hyphen, figure dash, en dash
+		return true
+	}
+	return false
+}
+
+// Line is a line of a broken paragraph.
+type Line struct {
+	TextStart, TextEnd   int     // range of runes
+	GlyphStart, GlyphEnd int     // range of glyphs
+	Width                float64 // natural width without trailing white space, in pt
+}
+
+// Greedy fits segments into lines of a given width, first-fit. Segments wider
+// than width will overflow their line.
+func Greedy(segs []Segment, width float64) []Line {
+	var lines []Line
+	var line Line
+	var w, trailing float64
+	empty := true
+	for _, seg := range segs {
+		if !empty && w+seg.Width-seg.Trailing > width {
+			line.Width = w - trailing
+			lines = append(lines, line)
+			empty = true
+		}
+		if empty {
+			line = Line{TextStart: seg.TextStart, GlyphStart: seg.GlyphStart}
+			w, empty = 0, false
+		}
+		line.TextEnd, line.GlyphEnd = seg.TextEnd, seg.GlyphEnd
+		w += seg.Width
+		trailing = seg.Trailing
+		if seg.Mandatory {
+			line.Width = w - trailing
+			lines = append(lines, line)
+			empty = true
+		}
+	}
+	if !empty {
+		line.Width = w - trailing
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// BreakParagraph breaks a shaped paragraph into lines of a given width.
+func BreakParagraph(text []rune, glyphs []harfbuzzgoperf.ShapedGlyph, width float64) []Line {
+	return Greedy(Segments(text, glyphs), width)
+}
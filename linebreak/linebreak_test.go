@@ -0,0 +1,267 @@
+package linebreak
+
+import (
+	"testing"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+	"github.com/npillmayer/schuko/tracing/gotestingadapter"
+)
+
+func TestOpportunities(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.linebreak")
+	defer teardown()
+	//
+	opps := Opportunities([]rune("The quick brown-fox"))
+	// break opportunities after spaces and after the hyphen
+	expected := []int{4, 10, 16, 19}
+	if len(opps) != len(expected) {
+		t.Fatalf("expected %d break opportunities, have %d: %v", len(expected), len(opps), opps)
+	}
+	for i, opp := range opps {
+		if opp.Position != expected[i] {
+			t.Errorf("expected break opportunity #%d at %d, is at %d", i, expected[i], opp.Position)
+		}
+	}
+	if !opps[len(opps)-1].Mandatory {
+		t.Error("expected end of text to be a mandatory break")
+	}
+}
+
+func TestGreedy(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.linebreak")
+	defer teardown()
+	//
+	text := []rune("aa bb cc dd")
+	glyphs := make([]harfbuzzgoperf.ShapedGlyph, len(text))
+	for i := range text {
+		glyphs[i] = harfbuzzgoperf.ShapedGlyph{Cluster: i, XAdvance: 1}
+	}
+	lines := BreakParagraph(text, glyphs, 5)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, have %d: %v", len(lines), lines)
+	}
+	if lines[0].TextEnd != 6 || lines[0].Width != 5 {
+		t.Errorf("expected first line to end at 6 with width 5, is %v", lines[0])
+	}
+	if lines[1].GlyphStart != 6 || lines[1].GlyphEnd != 11 {
+		t.Errorf("expected second line to cover glyphs 6…11, is %v", lines[1])
+	}
+}
+
+func TestBreakCorpus(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.linebreak")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Go", 10.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range harfbuzzgoperf.CorpusRunes {
+		buf, err := hb.Shape(text, nil, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		glyphs := hb.Glyphs(buf, params)
+		if err = harfbuzzgoperf.CheckRun(glyphs, len(text), false, params.Font.NumGlyphs()); err != nil {
+			t.Error(err)
+		}
+		lines := BreakParagraph(text, glyphs, 300)
+		if len(lines) < 2 {
+			t.Errorf("expected paragraph to be broken into lines, have %d", len(lines))
+		}
+		for i, line := range lines {
+			if i > 0 && line.TextStart != lines[i-1].TextEnd {
+				t.Errorf("expected lines to be contiguous")
+			}
+			if line.Width > 300 {
+				t.Errorf("line %d overflows: %.2f", i, line.Width)
+			}
+		}
+		if lines[len(lines)-1].GlyphEnd != len(glyphs) {
+			t.Errorf("expected lines to cover all glyphs")
+		}
+	}
+}
+
+// --- Benchmarking ----------------------------------------------------------
+
+var lines []Line
+
+func BenchmarkShapeAndBreak(b *testing.B) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	fontname := "Calibri.ttf"
+	params, err := hb.GetHBParams(fontname, 12.0)
+	if err != nil {
+		b.Fatalf("cannot prepare font %q", fontname)
+	}
+	for i := 0; i < b.N; i++ {
+		for _, line := range harfbuzzgoperf.CorpusRunes {
+			buf, err := hb.Shape(line, nil, params)
+			if err != nil {
+				b.Fatal("expected shaping output to be non-nil")
+			}
+			lines = BreakParagraph(line, hb.Glyphs(buf, params), 300)
+		}
+	}
+}
+
+func TestKnuthPlass(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.linebreak")
+	defer teardown()
+	//
+	text := []rune("aaa bb cc ddd ee f gggg hh")
+	glyphs := make([]harfbuzzgoperf.ShapedGlyph, len(text))
+	for i := range text {
+		glyphs[i] = harfbuzzgoperf.ShapedGlyph{Cluster: i, XAdvance: 1}
+	}
+	params := DefaultKPParams()
+	params.Tolerance = 2
+	breaks, err := KnuthPlassParagraph(text, glyphs, 10, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breaks) != 3 {
+		t.Fatalf("expected 3 lines, have %d: %v", len(breaks), breaks)
+	}
+	for i, bp := range breaks {
+		t.Logf("line %d: %v, r=%.2f, b=%.2f, d=%.2f", i, bp.Line, bp.Ratio, bp.Badness, bp.Demerits)
+		if i < len(breaks)-1 && (bp.Ratio < -1 || bp.Ratio > params.Tolerance) {
+			t.Errorf("line %d is not within tolerance: r=%.2f", i, bp.Ratio)
+		}
+		if i > 0 && bp.Demerits < breaks[i-1].Demerits {
+			t.Errorf("expected demerits to accumulate")
+		}
+	}
+	if breaks[2].Line.TextEnd != len(text) {
+		t.Errorf("expected last line to end paragraph")
+	}
+}
+
+func TestKnuthPlassMandatoryBreak(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.linebreak")
+	defer teardown()
+	//
+	text := []rune("aa bb cc dd\nee ff gg hh ii jj")
+	glyphs := make([]harfbuzzgoperf.ShapedGlyph, len(text))
+	for i := range text {
+		glyphs[i] = harfbuzzgoperf.ShapedGlyph{Cluster: i, XAdvance: 1}
+	}
+	breaks, err := KnuthPlassParagraph(text, glyphs, 9, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, bp := range breaks {
+		t.Logf("line %d: %v, r=%.2f, b=%.2f, d=%.2f", i, bp.Line, bp.Ratio, bp.Badness, bp.Demerits)
+		if bp.Line.Width > 9 {
+			t.Errorf("line %d overflows after the mandatory break: %v", i, bp.Line)
+		}
+	}
+	atBreak := false
+	for _, bp := range breaks {
+		atBreak = atBreak || bp.Line.TextEnd == 12
+	}
+	if !atBreak {
+		t.Errorf("expected a line to end at the mandatory break, have %v", breaks)
+	}
+}
+
+func TestKnuthPlassHyphen(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.linebreak")
+	defer teardown()
+	//
+	text := []rune("The quick brown-fox")
+	glyphs := make([]harfbuzzgoperf.ShapedGlyph, len(text))
+	for i := range text {
+		glyphs[i] = harfbuzzgoperf.ShapedGlyph{Cluster: i, XAdvance: 1}
+	}
+	params := DefaultKPParams()
+	flagged := 0
+	for _, item := range Items(Segments(text, glyphs), params) {
+		if item.Flagged {
+			flagged++
+			if item.Type != PenaltyItem || item.Penalty != params.HyphenPenalty || item.TextEnd != 16 {
+				t.Errorf("expected hyphen penalty after the hyphen, have %+v", item)
+			}
+		}
+	}
+	if flagged != 1 {
+		t.Errorf("expected 1 flagged penalty, have %d", flagged)
+	}
+}
+
+func TestKnuthPlassCorpus(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.linebreak")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Go", 10.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range harfbuzzgoperf.CorpusRunes {
+		buf, err := hb.Shape(text, nil, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		glyphs := hb.Glyphs(buf, params)
+		breaks, err := KnuthPlassParagraph(text, glyphs, 300, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		greedy := BreakParagraph(text, glyphs, 300)
+		if len(breaks) > len(greedy)+1 {
+			t.Errorf("expected total-fit to need about as many lines as first-fit (%d), has %d",
+				len(greedy), len(breaks))
+		}
+		if breaks[len(breaks)-1].Line.GlyphEnd != len(glyphs) {
+			t.Errorf("expected lines to cover all glyphs")
+		}
+	}
+}
+
+var breakpoints []Breakpoint
+
+func BenchmarkShapeAndKnuthPlass(b *testing.B) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	fontname := "Calibri.ttf"
+	params, err := hb.GetHBParams(fontname, 12.0)
+	if err != nil {
+		b.Fatalf("cannot prepare font %q", fontname)
+	}
+	for i := 0; i < b.N; i++ {
+		for _, line := range harfbuzzgoperf.CorpusRunes {
+			buf, err := hb.Shape(line, nil, params)
+			if err != nil {
+				b.Fatal("expected shaping output to be non-nil")
+			}
+			if breakpoints, err = KnuthPlassParagraph(line, hb.Glyphs(buf, params), 300, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkKnuthPlass(b *testing.B) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	fontname := "Calibri.ttf"
+	params, err := hb.GetHBParams(fontname, 12.0)
+	if err != nil {
+		b.Fatalf("cannot prepare font %q", fontname)
+	}
+	kp := DefaultKPParams()
+	paragraphs := make([][]Item, len(harfbuzzgoperf.CorpusRunes))
+	for i, line := range harfbuzzgoperf.CorpusRunes {
+		buf, _ := hb.Shape(line, nil, params)
+		paragraphs[i] = Items(Segments(line, hb.Glyphs(buf, params)), kp)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, items := range paragraphs {
+			if breakpoints, err = KnuthPlass(items, 300, kp); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package linebreak
+
+import (
+	"github.com/npillmayer/harfbuzzgoperf"
+)
+
+// SplitRun breaks a shaped run of text at text position pos, returning the glyphs
+// for text[:pos] and text[pos:]. Breaking a run of glyphs may change the
+// shaping result around the break (e.g., kerning, ligatures, contextual forms),
+// so the parts need to be reshaped. SplitRun will re-use the original glyphs
+// wherever the shaper flagged it as safe (see harfbuzzgoperf.UnsafeToBreak) and will
+// reshape only the minimal range of text surrounding the break.
+//
+// glyphs are expected to be the result of shaping text with shaper, in logical order.
+// Clusters of the results refer to positions in text.
+func SplitRun(text []rune, glyphs []harfbuzzgoperf.ShapedGlyph, pos int,
+	shaper harfbuzzgoperf.Shaper) (left, right []harfbuzzgoperf.ShapedGlyph, err error) {
+	//
+	if pos <= 0 {
+		return nil, glyphs, nil
+	} else if pos >= len(text) {
+		return glyphs, nil, nil
+	}
+	g := 0
+	for g < len(glyphs) && glyphs[g].Cluster < pos {
+		g++
+	}
+	if g < len(glyphs) && glyphs[g].Cluster == pos && isSafeBreak(glyphs, g) {
+		left = append([]harfbuzzgoperf.ShapedGlyph(nil), glyphs[:g]...)
+		right = append([]harfbuzzgoperf.ShapedGlyph(nil), glyphs[g:]...)
+		return left, right, nil
+	}
+	k := g - 1 // find the nearest safe break before pos
+	for k > 0 && !isSafeBreak(glyphs, k) {
+		k--
+	}
+	if k < 0 {
+		k = 0
+	}
+	m := g // find the nearest safe break after pos
+	for m < len(glyphs) && (glyphs[m].Cluster <= pos || !isSafeBreak(glyphs, m)) {
+		m++
+	}
+	start, end := 0, len(text)
+	if k > 0 {
+		start = glyphs[k].Cluster
+	}
+	if m < len(glyphs) {
+		end = glyphs[m].Cluster
+	}
+	tracer().Debugf("break at %d: reshaping text [%d…%d) and [%d…%d)", pos, start, pos, pos, end)
+	reshaped, err := shaper.Shape(text[start:pos])
+	if err != nil {
+		return nil, nil, err
+	}
+	left = append(left, glyphs[:k]...)
+	left = appendShifted(left, reshaped, start)
+	if reshaped, err = shaper.Shape(text[pos:end]); err != nil {
+		return nil, nil, err
+	}
+	right = appendShifted(right, reshaped, pos)
+	right = append(right, glyphs[m:]...)
+	return left, right, nil
+}
+
+// isSafeBreak returns true if glyph i starts a cluster and breaking the run in
+// front of it is known to be safe.
+func isSafeBreak(glyphs []harfbuzzgoperf.ShapedGlyph, i int) bool {
+	if i > 0 && glyphs[i-1].Cluster == glyphs[i].Cluster {
+		return false
+	}
+	return glyphs[i].Flags&(harfbuzzgoperf.UnsafeToBreak|harfbuzzgoperf.UnsafeToConcat) == 0
+}
+
+func appendShifted(glyphs, shifted []harfbuzzgoperf.ShapedGlyph, offset int) []harfbuzzgoperf.ShapedGlyph {
+	for _, g := range shifted {
+		g.Cluster += offset
+		glyphs = append(glyphs, g)
+	}
+	return glyphs
+}
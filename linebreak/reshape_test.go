@@ -0,0 +1,103 @@
+package linebreak
+
+import (
+	"testing"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+	"github.com/npillmayer/schuko/tracing/gotestingadapter"
+)
+
+func TestSplitRunMatchesReshape(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.linebreak")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Go", 10.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shaper := hb.NewShaper(params)
+	texts := append([][]rune{[]rune("AVATAR Tour, fjord Wave")}, harfbuzzgoperf.CorpusRunes[:5]...)
+	for _, text := range texts {
+		glyphs, err := shaper.Shape(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// additionally flag glyphs as unsafe, to force partial reshaping
+		flagged := append([]harfbuzzgoperf.ShapedGlyph(nil), glyphs...)
+		for i := range flagged {
+			if i%3 != 0 {
+				flagged[i].Flags |= harfbuzzgoperf.UnsafeToBreak
+			}
+		}
+		for _, run := range [][]harfbuzzgoperf.ShapedGlyph{glyphs, flagged} {
+			for pos := 1; pos < len(text); pos++ {
+				left, right, err := SplitRun(text, run, pos, shaper)
+				if err != nil {
+					t.Fatal(err)
+				}
+				joined := append(append([]harfbuzzgoperf.ShapedGlyph(nil), left...), right...)
+				if err = harfbuzzgoperf.CheckRun(joined, len(text), false, params.Font.NumGlyphs()); err != nil {
+					t.Errorf("split at %d: %v", pos, err)
+				}
+				expectedLeft, _ := shaper.Shape(text[:pos])
+				expectedRight, _ := shaper.Shape(text[pos:])
+				expectedRight = appendShifted(nil, expectedRight, pos)
+				if !sameGlyphs(left, expectedLeft) {
+					t.Errorf("split at %d: left side differs from full reshape", pos)
+				}
+				if !sameGlyphs(right, expectedRight) {
+					t.Errorf("split at %d: right side differs from full reshape", pos)
+				}
+			}
+		}
+	}
+}
+
+// sameGlyphs compares glyphs and positions, but not flags, which depend on the
+// context the glyphs have been shaped in.
+func sameGlyphs(a, b []harfbuzzgoperf.ShapedGlyph) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		x.Flags, y.Flags = 0, 0
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// --- Benchmarking ----------------------------------------------------------
+
+func BenchmarkSplitRun(b *testing.B) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Calibri.ttf", 12.0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	shaper := hb.NewShaper(params)
+	text := harfbuzzgoperf.CorpusRunes[0]
+	glyphs, _ := shaper.Shape(text)
+	pos := len(text) / 2
+	for pos < len(text) && text[pos] != ' ' {
+		pos++
+	}
+	pos++
+	b.Run("split", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, err := SplitRun(text, glyphs, pos, shaper); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("full-reshape", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			shaper.Shape(text[:pos])
+			shaper.Shape(text[pos:])
+		}
+	})
+}
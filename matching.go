@@ -0,0 +1,263 @@
+package harfbuzzgoperf
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	tt "github.com/benoitkugler/textlayout/fonts/truetype"
+)
+
+// --- Face descriptors ------------------------------------------------------
+
+// FontStyle is the slope of a face, as in CSS 'font-style'.
+type FontStyle int
+
+const (
+	StyleNormal FontStyle = iota
+	StyleItalic
+	StyleOblique
+)
+
+func (s FontStyle) String() string {
+	switch s {
+	case StyleItalic:
+		return "italic"
+	case StyleOblique:
+		return "oblique"
+	}
+	return "normal"
+}
+
+// FaceDescriptor describes a face by the properties used for font matching.
+type FaceDescriptor struct {
+	Family    string    // typographic family name
+	Subfamily string    // typographic subfamily (style) name
+	Weight    int       // 100 (thin) … 900 (black), 400 is regular
+	Style     FontStyle // normal, italic or oblique
+	Stretch   float64   // width in percent of normal width, 50 … 200
+}
+
+// widthClasses maps OS/2 usWidthClass to CSS font-stretch percentages.
+var widthClasses = [...]float64{100, 50, 62.5, 75, 87.5, 100, 112.5, 125, 150, 200}
+
+// describeFace reads a descriptor from the 'name' and 'OS/2' tables of a face.
+func describeFace(f *tt.Font) FaceDescriptor {
+	d := FaceDescriptor{Weight: 400, Stretch: 100}
+	d.Family = fontName(f, tt.NamePreferredFamily, tt.NameFontFamily)
+	d.Subfamily = fontName(f, tt.NamePreferredSubfamily, tt.NameFontSubfamily)
+	if os2, err := f.OS2Table(); err == nil {
+		if os2.USWeightClass >= 1 && os2.USWeightClass <= 1000 {
+			d.Weight = int(os2.USWeightClass)
+		}
+		if int(os2.USWidthClass) < len(widthClasses) {
+			d.Stretch = widthClasses[os2.USWidthClass]
+		}
+		if os2.FsSelection&0x200 != 0 { // bit 9: oblique
+			d.Style = StyleOblique
+		} else if os2.FsSelection&0x01 != 0 { // bit 0: italic
+			d.Style = StyleItalic
+		}
+	} else if f.Head.MacStyle&0x02 != 0 {
+		d.Style = StyleItalic
+	}
+	return d
+}
+
+// fontName returns the first name found for one of ids.
+func fontName(f *tt.Font, ids ...tt.NameID) string {
+	for _, id := range ids {
+		if e := f.Names.SelectEntry(id); e != nil {
+			if s := strings.TrimSpace(e.String()); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// --- Font matching ---------------------------------------------------------
+
+// FontQuery is a request for a face, following CSS font properties.
+type FontQuery struct {
+	Families []string  // family names, in order of preference
+	Weight   int       // 1 … 1000, 0 means 400
+	Style    FontStyle // requested slope
+	Stretch  float64   // in percent, 0 means 100
+}
+
+// ErrNoMatch is returned if no face matches any of the families of a query.
+var ErrNoMatch = errors.New("no font matches query")
+
+var weightKeywords = map[string]int{
+	"thin": 100, "extra-light": 200, "light": 300, "normal": 400, "regular": 400,
+	"medium": 500, "semi-bold": 600, "bold": 700, "extra-bold": 800, "black": 900,
+}
+
+var stretchKeywords = map[string]float64{
+	"ultra-condensed": 50, "extra-condensed": 62.5, "condensed": 75, "semi-condensed": 87.5,
+	"semi-expanded": 112.5, "expanded": 125, "extra-expanded": 150, "ultra-expanded": 200,
+}
+
+// ParseFontQuery parses a query in the form of the CSS 'font' shorthand, without
+// size, e.g. "bold italic condensed Calibri, 'Go'". Weight, style and stretch
+// keywords precede a comma separated list of families.
+func ParseFontQuery(s string) (FontQuery, error) {
+	q := FontQuery{Weight: 400, Stretch: 100}
+	s = strings.TrimSpace(s)
+	for s != "" {
+		word := s
+		if i := strings.IndexAny(s, " \t"); i >= 0 {
+			word = s[:i]
+		}
+		w := strings.ToLower(word)
+		if n, err := strconv.Atoi(w); err == nil && n >= 1 && n <= 1000 {
+			q.Weight = n
+		} else if n, ok := weightKeywords[w]; ok {
+			q.Weight = n
+		} else if n, ok := stretchKeywords[w]; ok {
+			q.Stretch = n
+		} else if w == "italic" {
+			q.Style = StyleItalic
+		} else if w == "oblique" {
+			q.Style = StyleOblique
+		} else {
+			break
+		}
+		s = strings.TrimSpace(s[len(word):])
+	}
+	for _, family := range strings.Split(s, ",") {
+		family = strings.Trim(strings.TrimSpace(family), `"'`)
+		if family != "" {
+			q.Families = append(q.Families, family)
+		}
+	}
+	if len(q.Families) == 0 {
+		return q, errors.New("font query without family")
+	}
+	return q, nil
+}
+
+// MatchFace returns the face best matching a query, following the font matching
+// algorithm of CSS Fonts Level 4: the first family of the query with any faces
+// is selected, then faces are narrowed down by stretch, style and weight, in
+// that order.
+func (cache *FontCache) MatchFace(q FontQuery) (*Face, error) {
+	faces := cache.faces()
+	for _, family := range q.Families {
+		var candidates []*Face
+		for _, face := range faces {
+			if strings.EqualFold(face.Family, family) {
+				candidates = append(candidates, face)
+			}
+		}
+		if len(candidates) > 0 {
+			return matchFace(candidates, q), nil
+		}
+	}
+	return nil, ErrNoMatch
+}
+
+// faces returns all distinct faces of the fonts in the cache.
+func (cache *FontCache) faces() []*Face {
+	cache.mx.RLock()
+	defer cache.mx.RUnlock()
+	seen := make(map[*Face]bool)
+	var faces []*Face
+	for _, f := range cache.fonts {
+		if f.Face != nil && !seen[f.Face] {
+			seen[f.Face] = true
+			faces = append(faces, f.Face)
+		}
+	}
+	return faces
+}
+
+func matchFace(candidates []*Face, q FontQuery) *Face {
+	weight, stretch := q.Weight, q.Stretch
+	if weight == 0 {
+		weight = 400
+	}
+	if stretch == 0 {
+		stretch = 100
+	}
+	candidates = narrow(candidates, func(f *Face) float64 { return stretchPenalty(stretch, f.Stretch) })
+	candidates = narrow(candidates, func(f *Face) float64 { return stylePenalty(q.Style, f.Style) })
+	candidates = narrow(candidates, func(f *Face) float64 { return weightPenalty(weight, f.Weight) })
+	best := candidates[0]
+	for _, f := range candidates[1:] { // ties: be deterministic
+		if f.Name < best.Name {
+			best = f
+		}
+	}
+	return best
+}
+
+// narrow keeps the faces with the lowest penalty.
+func narrow(faces []*Face, penalty func(*Face) float64) []*Face {
+	var best []*Face
+	min := 0.0
+	for _, f := range faces {
+		if p := penalty(f); len(best) == 0 || p < min {
+			best, min = []*Face{f}, p
+		} else if p == min {
+			best = append(best, f)
+		}
+	}
+	return best
+}
+
+// stretchPenalty orders widths: for condensed requests, narrower widths are
+// tried first, for expanded requests, wider ones.
+func stretchPenalty(want, have float64) float64 {
+	if want <= 100 {
+		if have <= want {
+			return want - have
+		}
+		return 1000 + have - want
+	}
+	if have >= want {
+		return have - want
+	}
+	return 1000 + want - have
+}
+
+// stylePenalty orders styles: italic falls back to oblique and vice versa,
+// normal falls back to oblique before italic.
+func stylePenalty(want, have FontStyle) float64 {
+	if want == have {
+		return 0
+	}
+	switch {
+	case want == StyleItalic && have == StyleOblique,
+		want == StyleOblique && have == StyleItalic,
+		want == StyleNormal && have == StyleOblique:
+		return 1
+	}
+	return 2
+}
+
+// weightPenalty orders weights: for 400–500, heavier weights up to 500 are tried
+// first, then lighter ones, then heavier ones. Lighter requests prefer lighter
+// weights, bolder requests prefer bolder weights.
+func weightPenalty(want, have int) float64 {
+	d := float64(have - want)
+	switch {
+	case want >= 400 && want <= 500:
+		if have >= want && have <= 500 {
+			return d
+		} else if have < want {
+			return 1000 - d
+		}
+		return 2000 + d
+	case want < 400:
+		if have <= want {
+			return -d
+		}
+		return 1000 + d
+	}
+	if have >= want {
+		return d
+	}
+	return 1000 - d
+}
@@ -0,0 +1,273 @@
+/*
+Package pipeline implements a streaming shaping pipeline.
+
+Text is read as UTF-8 from an io.Reader and segmented into paragraphs, which
+are separated by blank lines. Line breaks within a paragraph are treated as
+spaces. Paragraphs are split into runs of a single script and shaped
+concurrently by a shaping engine. Results are emitted in the order of the
+input, either to a callback or over a channel.
+
+Runs are shaped with their script and direction, if the engine's shapers
+implement harfbuzzgoperf.SegmentShaper.
+
+Memory is bounded by the batch size and the maximum length of paragraphs: at
+most two batches of paragraphs—one being read and one being shaped or
+emitted—are held by the pipeline at any time, and input is read in pieces of
+less than the maximum length of a paragraph, however long its lines are.
+Stream hands over paragraphs unbuffered.
+*/
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	hblang "github.com/benoitkugler/textlayout/language"
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/engine"
+	"github.com/npillmayer/schuko/tracing"
+)
+
+// tracer traces to tracing key 'hbperf.pipeline'.
+func tracer() tracing.Trace {
+	return tracing.Select("hbperf.pipeline")
+}
+
+// Paragraph is a shaped paragraph of the input text.
+type Paragraph struct {
+	Index int    // sequence number of the paragraph, starting at 0
+	Text  []rune // text of the paragraph, with line breaks replaced by spaces
+	Runs  []Run  // runs of the paragraph, in logical order
+}
+
+// Run is a shaped run of text of a single script.
+type Run struct {
+	Start, End int // range of runes within the paragraph
+	Script     hblang.Script
+	Glyphs     []harfbuzzgoperf.ShapedGlyph // clusters relative to the start of the run
+}
+
+// segment returns the run as a segment of text, with the script and direction
+// of the run.
+func (run Run) segment(text []rune) harfbuzzgoperf.Segment {
+	seg := harfbuzzgoperf.Segment{
+		Text:        text[run.Start:run.End],
+		RightToLeft: harfbuzzgoperf.IsRightToLeft(run.Script),
+	}
+	if run.Script != 0 {
+		seg.Script, _ = harfbuzzgoperf.ScriptFromHB(run.Script)
+	}
+	return seg
+}
+
+// Options control the pipeline.
+type Options struct {
+	BatchSize    int // number of paragraphs to shape concurrently
+	MaxParagraph int // maximum length of a paragraph in bytes; longer ones are split at lines, long lines at characters
+}
+
+// DefaultOptions returns options suitable for book-length text.
+func DefaultOptions() Options {
+	return Options{
+		BatchSize:    64,
+		MaxParagraph: 64 * 1024,
+	}
+}
+
+// ErrStopped may be returned by a callback to stop the pipeline without error.
+var ErrStopped = errors.New("pipeline stopped")
+
+// Shape reads text from r, shapes it with eng and calls emit for every paragraph,
+// in order. Shape returns the first error encountered, either from reading, shaping
+// or emitting.
+func Shape(r io.Reader, eng *engine.Engine, opts Options, emit func(*Paragraph) error) error {
+	if opts.BatchSize < 1 {
+		opts.BatchSize = DefaultOptions().BatchSize
+	}
+	if opts.MaxParagraph < 1 {
+		opts.MaxParagraph = DefaultOptions().MaxParagraph
+	}
+	batches := make(chan []*Paragraph)
+	readErr := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(batches)
+		readErr <- readParagraphs(r, opts, batches, stop)
+	}()
+	for batch := range batches {
+		var segs []harfbuzzgoperf.Segment
+		for _, p := range batch {
+			for _, run := range p.Runs {
+				segs = append(segs, run.segment(p.Text))
+			}
+		}
+		results, err := eng.ShapeSegments(segs)
+		if err != nil {
+			return err
+		}
+		i := 0
+		for _, p := range batch {
+			for j := range p.Runs {
+				if results[i].Err != nil {
+					return results[i].Err
+				}
+				p.Runs[j].Glyphs = results[i].Glyphs
+				i++
+			}
+			if err = emit(p); err == ErrStopped {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return <-readErr
+}
+
+// Stream is like Shape, but emits paragraphs over a channel. The error channel
+// will receive the result of the pipeline after the paragraph channel has been
+// closed. Receivers must drain the paragraph channel.
+func Stream(r io.Reader, eng *engine.Engine, opts Options) (<-chan *Paragraph, <-chan error) {
+	paragraphs := make(chan *Paragraph)
+	errc := make(chan error, 1)
+	go func() {
+		err := Shape(r, eng, opts, func(p *Paragraph) error {
+			paragraphs <- p
+			return nil
+		})
+		close(paragraphs)
+		errc <- err
+	}()
+	return paragraphs, errc
+}
+
+// lineReader reads lines in pieces of less than a maximum length, split at
+// characters, so that lines of any length are read in bounded memory.
+type lineReader struct {
+	br    *bufio.Reader
+	piece []byte
+	carry []byte // incomplete character at the end of the previous piece
+}
+
+func newLineReader(r io.Reader, max int) *lineReader {
+	return &lineReader{br: bufio.NewReaderSize(r, max-utf8.UTFMax)}
+}
+
+// next returns the next piece of a line, which is valid until the next call.
+// partial is set if the line continues with the next piece.
+func (lr *lineReader) next() (piece []byte, partial bool, err error) {
+	chunk, err := lr.br.ReadSlice('\n')
+	lr.piece = append(append(lr.piece[:0], lr.carry...), chunk...)
+	lr.carry = lr.carry[:0]
+	if err != bufio.ErrBufferFull {
+		return lr.piece, false, err
+	}
+	// keep an incomplete character at the end for the next piece
+	for i := len(lr.piece) - 1; i >= 0 && i >= len(lr.piece)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(lr.piece[i]) {
+			if !utf8.FullRune(lr.piece[i:]) {
+				lr.carry = append(lr.carry, lr.piece[i:]...)
+				lr.piece = lr.piece[:i]
+			}
+			break
+		}
+	}
+	return lr.piece, true, nil
+}
+
+// readParagraphs segments the input into paragraphs and sends them in batches.
+func readParagraphs(r io.Reader, opts Options, batches chan<- []*Paragraph, stop <-chan struct{}) error {
+	lr := newLineReader(r, opts.MaxParagraph)
+	var sb strings.Builder
+	batch := make([]*Paragraph, 0, opts.BatchSize)
+	index := 0
+	send := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		select {
+		case batches <- batch:
+			batch = make([]*Paragraph, 0, opts.BatchSize)
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	flush := func() bool {
+		if sb.Len() > 0 {
+			text := []rune(sb.String())
+			sb.Reset()
+			batch = append(batch, &Paragraph{Index: index, Text: text, Runs: scriptRuns(text)})
+			index++
+			if len(batch) == opts.BatchSize {
+				return send()
+			}
+		}
+		return true
+	}
+	continued := false // the piece continues the line of the previous one
+	for {
+		piece, partial, err := lr.next()
+		trimmed := piece
+		if !continued {
+			trimmed = bytes.TrimLeftFunc(trimmed, unicode.IsSpace)
+		}
+		if !partial {
+			trimmed = bytes.TrimRightFunc(trimmed, unicode.IsSpace)
+		}
+		blank := !continued && !partial && len(trimmed) == 0
+		if blank || sb.Len()+len(trimmed) > opts.MaxParagraph {
+			if !flush() {
+				return nil
+			}
+		}
+		if len(trimmed) > 0 {
+			if sb.Len() > 0 && !continued {
+				sb.WriteByte(' ')
+			}
+			sb.Write(trimmed)
+		}
+		continued = partial
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if flush() {
+		send()
+	}
+	tracer().Debugf("read %d paragraphs", index)
+	return nil
+}
+
+// scriptRuns splits text into runs of a single script. Characters of common or
+// inherited script belong to the run they appear in; leading ones belong
+// to the first run.
+func scriptRuns(text []rune) []Run {
+	var runs []Run
+	run := Run{}
+	for i, r := range text {
+		script := hblang.LookupScript(r)
+		if !script.IsRealScript() || script == run.Script {
+			continue
+		}
+		if run.Script != 0 {
+			run.End = i
+			runs = append(runs, run)
+			run = Run{Start: i}
+		}
+		run.Script = script
+	}
+	run.End = len(text)
+	if run.End > run.Start {
+		runs = append(runs, run)
+	}
+	return runs
+}
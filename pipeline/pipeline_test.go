@@ -0,0 +1,214 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/engine"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+	"github.com/npillmayer/schuko/tracing/gotestingadapter"
+	"golang.org/x/text/language"
+)
+
+func TestScriptRuns(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.pipeline")
+	defer teardown()
+	//
+	runs := scriptRuns([]rune("(Hello) Καλημέρα, world!"))
+	if len(runs) != 3 {
+		t.Fatalf("expected 3 script runs, have %d: %v", len(runs), runs)
+	}
+	if runs[0].Start != 0 || runs[1].Start != 8 || runs[2].End != 24 {
+		t.Errorf("unexpected run boundaries: %v", runs)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.pipeline")
+	defer teardown()
+	//
+	eng := newTestEngine(t, "Go")
+	defer eng.Close()
+	numGlyphs := harfbuzzgoperf.GlobalFontStore.FindFont("Go").NumGlyphs()
+	text := strings.Join(harfbuzzgoperf.Corpus, "\n\n")
+	text = strings.Replace(text, "designed at Google", "designed\nat Google", 1)
+	opts := DefaultOptions()
+	opts.BatchSize = 4
+	count := 0
+	err := Shape(strings.NewReader(text), eng, opts, func(p *Paragraph) error {
+		if p.Index != count {
+			t.Errorf("expected paragraph #%d, have #%d", count, p.Index)
+		}
+		if string(p.Text) != harfbuzzgoperf.Corpus[count] {
+			t.Errorf("paragraph #%d differs from input", count)
+		}
+		if len(p.Runs) == 0 || len(p.Runs[0].Glyphs) == 0 {
+			t.Errorf("expected paragraph #%d to be shaped", count)
+		}
+		checkRuns(t, p, numGlyphs)
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(harfbuzzgoperf.Corpus) {
+		t.Errorf("expected %d paragraphs, have %d", len(harfbuzzgoperf.Corpus), count)
+	}
+}
+
+func TestStream(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.pipeline")
+	defer teardown()
+	//
+	eng := newTestEngine(t, "Go")
+	defer eng.Close()
+	text := strings.Join(harfbuzzgoperf.Corpus, "\n\n")
+	paragraphs, errc := Stream(strings.NewReader(text), eng, DefaultOptions())
+	count := 0
+	for range paragraphs {
+		count++
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if count != len(harfbuzzgoperf.Corpus) {
+		t.Errorf("expected %d paragraphs, have %d", len(harfbuzzgoperf.Corpus), count)
+	}
+}
+
+func TestLongLines(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.pipeline")
+	defer teardown()
+	//
+	eng := newTestEngine(t, "Go")
+	defer eng.Close()
+	text := strings.Repeat("Grüße, world! ", 1000) // no line breaks
+	opts := DefaultOptions()
+	opts.MaxParagraph = 100
+	var sb strings.Builder
+	err := Shape(strings.NewReader(text), eng, opts, func(p *Paragraph) error {
+		if n := len(string(p.Text)); n > opts.MaxParagraph {
+			t.Errorf("paragraph #%d is longer than %d bytes: %d", p.Index, opts.MaxParagraph, n)
+		}
+		sb.WriteString(string(p.Text))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.String() != strings.TrimSpace(text) {
+		t.Error("expected paragraphs to cover the text")
+	}
+}
+
+func TestPipelineSegments(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.pipeline")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Go", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Script = language.MustParseScript("Latn") // shapers configured for Latin
+	shaper := hb.NewShaper(params)
+	eng, err := engine.New(2, func(int) (harfbuzzgoperf.Shaper, error) {
+		return shaper.NewView(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+	err = Shape(strings.NewReader("Hello שלום עולם"), eng, DefaultOptions(), func(p *Paragraph) error {
+		if len(p.Runs) != 2 {
+			t.Fatalf("expected 2 runs, have %d", len(p.Runs))
+		}
+		hebrew := p.Runs[1].Glyphs
+		if len(hebrew) < 2 || hebrew[0].Cluster <= hebrew[len(hebrew)-1].Cluster {
+			t.Errorf("expected Hebrew run to be shaped right-to-left, have %v", hebrew)
+		}
+		checkRuns(t, p, params.Font.NumGlyphs())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkRuns checks the invariants of the shaped runs of a paragraph.
+func checkRuns(t *testing.T, p *Paragraph, numGlyphs int) {
+	for i, run := range p.Runs {
+		rtl := harfbuzzgoperf.IsRightToLeft(run.Script)
+		if err := harfbuzzgoperf.CheckRun(run.Glyphs, run.End-run.Start, rtl, numGlyphs); err != nil {
+			t.Errorf("paragraph #%d, run #%d: %v", p.Index, i, err)
+		}
+	}
+}
+
+func newTestEngine(t testing.TB, fontname string) *engine.Engine {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams(fontname, 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shaper := hb.NewShaper(params)
+	eng, err := engine.New(4, func(int) (harfbuzzgoperf.Shaper, error) {
+		return shaper.NewView(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eng
+}
+
+// --- Benchmarking ----------------------------------------------------------
+
+// BenchmarkPipeline shapes a multi-megabyte text file end-to-end. The file may be
+// set with environment variable HBPERF_TEXTFILE, otherwise one is generated
+// from the corpus.
+func BenchmarkPipeline(b *testing.B) {
+	path := os.Getenv("HBPERF_TEXTFILE")
+	if path == "" {
+		path = filepath.Join(b.TempDir(), "book.txt")
+		var sb strings.Builder
+		for sb.Len() < 4<<20 {
+			for _, p := range harfbuzzgoperf.Corpus {
+				sb.WriteString(p)
+				sb.WriteString("\n\n")
+			}
+		}
+		if err := os.WriteFile(path, []byte(sb.String()), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	eng := newTestEngine(b, "Calibri.ttf")
+	defer eng.Close()
+	b.SetBytes(info.Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		glyphs := 0
+		err = Shape(f, eng, DefaultOptions(), func(p *Paragraph) error {
+			for _, run := range p.Runs {
+				glyphs += len(run.Glyphs)
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(glyphs), "glyphs/op")
+	}
+}
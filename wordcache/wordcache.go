@@ -0,0 +1,222 @@
+/*
+Package wordcache implements a cache of shaped words on top of the shaping backends.
+
+Real documents repeat words constantly. A cached shaper splits its input at
+spaces, looks up every word in a store of previously shaped words and shapes
+only the words it has not seen before. Spaces are considered safe boundaries:
+kerning or contextual substitutions across a space will be lost. The spaces
+between words are shaped once per shaper configuration, outside of the store,
+and do not count as lookups in its statistics.
+
+Words are concatenated in logical order, which is the order of the glyphs for
+left-to-right text only. Text containing right-to-left characters, and text
+shaped by a right-to-left shaper, is therefore shaped as a whole, bypassing
+the store.
+
+Shaped words are kept in a Store with a bounded memory size, evicting the
+least recently used words first. A Store may be shared between cached shapers
+on different goroutines, whereas a cached Shaper—like the backend shapers—is
+not safe for concurrent use.
+*/
+package wordcache
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/schuko/tracing"
+)
+
+// tracer traces to tracing key 'hbperf.cache'.
+func tracer() tracing.Trace {
+	return tracing.Select("hbperf.cache")
+}
+
+// Key identifies a shaped word: the configuration of the shaper plus the text.
+type Key struct {
+	Shaper harfbuzzgoperf.ShapeKey
+	Text   string
+}
+
+type entry struct {
+	key    Key
+	glyphs []harfbuzzgoperf.ShapedGlyph
+	size   int64
+}
+
+// Store is a LRU cache of shaped words, bounded in memory size.
+// It is safe for concurrent use.
+type Store struct {
+	mx       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List // of *entry, most recently used first
+	words    map[Key]*list.Element
+	stats    Stats
+}
+
+// Stats reports usage statistics of a store.
+type Stats struct {
+	Hits, Misses, Evictions int64
+	Words                   int   // number of cached words
+	Bytes                   int64 // estimated memory used by cached words
+}
+
+// HitRate returns the ratio of cache hits to lookups.
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// NewStore creates a store for shaped words, using at most maxBytes of memory
+// (estimated).
+func NewStore(maxBytes int64) *Store {
+	return &Store{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		words:    make(map[Key]*list.Element),
+	}
+}
+
+// Get looks up a shaped word. The returned glyphs must not be modified.
+func (st *Store) Get(key Key) ([]harfbuzzgoperf.ShapedGlyph, bool) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	if el, ok := st.words[key]; ok {
+		st.lru.MoveToFront(el)
+		st.stats.Hits++
+		return el.Value.(*entry).glyphs, true
+	}
+	st.stats.Misses++
+	return nil, false
+}
+
+var glyphSize = int64(unsafe.Sizeof(harfbuzzgoperf.ShapedGlyph{}))
+
+// entryOverhead is an estimate of the memory used by map and list for an entry.
+const entryOverhead = 160
+
+// Put stores a shaped word, evicting least recently used words if the store
+// exceeds its memory limit.
+func (st *Store) Put(key Key, glyphs []harfbuzzgoperf.ShapedGlyph) {
+	size := entryOverhead + int64(len(key.Text)) + int64(len(glyphs))*glyphSize
+	if size > st.maxBytes {
+		return
+	}
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	if el, ok := st.words[key]; ok {
+		st.lru.MoveToFront(el)
+		return
+	}
+	st.words[key] = st.lru.PushFront(&entry{key: key, glyphs: glyphs, size: size})
+	st.bytes += size
+	for st.bytes > st.maxBytes {
+		el := st.lru.Back()
+		e := el.Value.(*entry)
+		st.lru.Remove(el)
+		delete(st.words, e.key)
+		st.bytes -= e.size
+		st.stats.Evictions++
+	}
+}
+
+// Stats returns usage statistics of the store.
+func (st *Store) Stats() Stats {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	stats := st.stats
+	stats.Words = len(st.words)
+	stats.Bytes = st.bytes
+	return stats
+}
+
+// --- Cached shaper ---------------------------------------------------------
+
+// Shaper is a shaper which shapes words through a store of shaped words.
+// It implements interface harfbuzzgoperf.KeyedShaper.
+type Shaper struct {
+	inner    harfbuzzgoperf.KeyedShaper
+	store    *Store
+	out      []harfbuzzgoperf.ShapedGlyph
+	backward map[harfbuzzgoperf.ShapeKey]bool // inner shapes left-to-right text backwards
+	spaces   map[harfbuzzgoperf.ShapeKey][]harfbuzzgoperf.ShapedGlyph
+}
+
+// New creates a cached shaper on top of a backend shaper.
+func New(inner harfbuzzgoperf.KeyedShaper, store *Store) *Shaper {
+	return &Shaper{
+		inner:    inner,
+		store:    store,
+		backward: make(map[harfbuzzgoperf.ShapeKey]bool),
+		spaces:   make(map[harfbuzzgoperf.ShapeKey][]harfbuzzgoperf.ShapedGlyph),
+	}
+}
+
+// Key is part of interface harfbuzzgoperf.KeyedShaper.
+func (s *Shaper) Key() harfbuzzgoperf.ShapeKey {
+	return s.inner.Key()
+}
+
+// Shape is part of interface harfbuzzgoperf.Shaper. The returned glyphs are
+// valid until the next call to Shape.
+func (s *Shaper) Shape(text []rune) ([]harfbuzzgoperf.ShapedGlyph, error) {
+	s.out = s.out[:0]
+	key := Key{Shaper: s.inner.Key()}
+	if harfbuzzgoperf.HasRightToLeft(text) || s.isBackward(key.Shaper) {
+		return s.inner.Shape(text)
+	}
+	start := 0
+	for start < len(text) {
+		end := start + 1
+		if text[start] != ' ' {
+			for end < len(text) && text[end] != ' ' {
+				end++
+			}
+		}
+		var glyphs []harfbuzzgoperf.ShapedGlyph
+		ok := false
+		if end == start+1 && text[start] == ' ' {
+			glyphs, ok = s.spaces[key.Shaper]
+		} else {
+			key.Text = string(text[start:end])
+			glyphs, ok = s.store.Get(key)
+		}
+		if !ok {
+			shaped, err := s.inner.Shape(text[start:end])
+			if err != nil {
+				return nil, err
+			}
+			glyphs = append([]harfbuzzgoperf.ShapedGlyph(nil), shaped...)
+			if text[start] == ' ' {
+				s.spaces[key.Shaper] = glyphs
+			} else {
+				s.store.Put(key, glyphs)
+			}
+		}
+		for _, g := range glyphs {
+			g.Cluster += start
+			s.out = append(s.out, g)
+		}
+		start = end
+	}
+	return s.out, nil
+}
+
+// isBackward returns true if the inner shaper outputs glyphs of left-to-right
+// text in decreasing cluster order, i.e. the direction of the shaper is set to
+// right-to-left. The direction is probed once per configuration, as shape keys
+// do not share a representation of directions across backends.
+func (s *Shaper) isBackward(key harfbuzzgoperf.ShapeKey) bool {
+	backward, ok := s.backward[key]
+	if !ok {
+		probe, err := s.inner.Shape([]rune("ab"))
+		backward = err == nil && len(probe) > 1 && probe[0].Cluster > probe[len(probe)-1].Cluster
+		s.backward[key] = backward
+	}
+	return backward
+}
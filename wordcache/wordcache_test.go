@@ -0,0 +1,171 @@
+package wordcache
+
+import (
+	"fmt"
+	"testing"
+
+	gohb "github.com/benoitkugler/textlayout/harfbuzz"
+	"github.com/npillmayer/harfbuzzgoperf"
+	"github.com/npillmayer/harfbuzzgoperf/hb"
+	"github.com/npillmayer/schuko/tracing/gotestingadapter"
+)
+
+func TestCachedShaper(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.cache")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Go", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shaper := hb.NewShaper(params)
+	cached := New(hb.NewShaper(params), NewStore(1<<20))
+	for _, text := range harfbuzzgoperf.CorpusRunes {
+		expected, err := shaper.Shape(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		glyphs, err := cached.Shape(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(glyphs) != len(expected) {
+			t.Fatalf("expected %d glyphs, have %d", len(expected), len(glyphs))
+		}
+		if err = harfbuzzgoperf.CheckRun(glyphs, len(text), false, params.Font.NumGlyphs()); err != nil {
+			t.Error(err)
+		}
+		for i := range glyphs {
+			if glyphs[i].GID != expected[i].GID || glyphs[i].Cluster != expected[i].Cluster {
+				t.Errorf("glyph #%d differs: %v vs %v", i, glyphs[i], expected[i])
+			}
+		}
+	}
+	stats := cached.store.Stats()
+	t.Logf("cache stats: %+v", stats)
+	if stats.Hits == 0 {
+		t.Error("expected cache hits for corpus")
+	}
+}
+
+func TestCachedShaperSpaces(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.cache")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Go", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(1 << 20)
+	glyphs, err := New(hb.NewShaper(params), store).Shape([]rune("to be or not to be"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(glyphs) != 18 {
+		t.Errorf("expected 18 glyphs, have %d", len(glyphs))
+	}
+	if stats := store.Stats(); stats.Hits != 2 || stats.Misses != 4 {
+		t.Errorf("expected spaces not to count as lookups, have %+v", stats)
+	}
+}
+
+func TestCachedShaperRightToLeft(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.cache")
+	defer teardown()
+	//
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	params, err := hb.GetHBParams("Go", 12.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backward := *params
+	backward.Direction = gohb.RightToLeft
+	for _, p := range []*hb.HBParams{params, &backward} {
+		shaper := hb.NewShaper(p)
+		cached := New(hb.NewShaper(p), NewStore(1<<20))
+		for _, text := range [][]rune{[]rune("שלום עולם, שלום"), []rune("abc de f abc")} {
+			expected, err := shaper.Shape(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			glyphs, err := cached.Shape(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rtl := p.Direction == gohb.RightToLeft || harfbuzzgoperf.HasRightToLeft(text)
+			if err = harfbuzzgoperf.CheckRun(glyphs, len(text), rtl, p.Font.NumGlyphs()); err != nil {
+				t.Errorf("%q: %v", string(text), err)
+			}
+			if len(glyphs) != len(expected) {
+				t.Fatalf("%q: expected %d glyphs, have %d", string(text), len(expected), len(glyphs))
+			}
+			for i := range glyphs {
+				if glyphs[i].GID != expected[i].GID || glyphs[i].Cluster != expected[i].Cluster {
+					t.Errorf("%q: glyph #%d differs: %v vs %v", string(text), i, glyphs[i], expected[i])
+				}
+			}
+		}
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	teardown := gotestingadapter.QuickConfig(t, "hbperf.cache")
+	defer teardown()
+	//
+	glyphs := make([]harfbuzzgoperf.ShapedGlyph, 1)
+	size := entryOverhead + 1 + glyphSize
+	store := NewStore(3 * size)
+	for _, w := range []string{"a", "b", "c"} {
+		store.Put(Key{Text: w}, glyphs)
+	}
+	store.Get(Key{Text: "a"}) // "b" is now least recently used
+	store.Put(Key{Text: "d"}, glyphs)
+	if _, ok := store.Get(Key{Text: "b"}); ok {
+		t.Error("expected 'b' to be evicted")
+	}
+	if _, ok := store.Get(Key{Text: "a"}); !ok {
+		t.Error("expected 'a' to be cached")
+	}
+	if stats := store.Stats(); stats.Words != 3 || stats.Bytes > 3*size {
+		t.Errorf("expected store to be bounded, is %+v", stats)
+	}
+}
+
+// --- Benchmarking ----------------------------------------------------------
+
+var glyphs []harfbuzzgoperf.ShapedGlyph
+
+func BenchmarkWordCache(b *testing.B) {
+	harfbuzzgoperf.LoadEmbeddedFonts()
+	fontname := "Calibri.ttf"
+	params, err := hb.GetHBParams(fontname, 12.0)
+	if err != nil {
+		b.Fatalf("cannot prepare font %q", fontname)
+	}
+	b.Run("uncached", func(b *testing.B) {
+		shaper := hb.NewShaper(params)
+		for i := 0; i < b.N; i++ {
+			for _, line := range harfbuzzgoperf.CorpusRunes {
+				if glyphs, err = shaper.Shape(line); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	for _, size := range []int64{1 << 12, 1 << 16, 1 << 20} {
+		store := NewStore(size)
+		shaper := New(hb.NewShaper(params), store)
+		b.Run(fmt.Sprintf("cached-%dkB", size>>10), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, line := range harfbuzzgoperf.CorpusRunes {
+					if glyphs, err = shaper.Shape(line); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(100*store.Stats().HitRate(), "hit%")
+		})
+	}
+}